@@ -0,0 +1,180 @@
+package main
+
+import (
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"path"
+	"strconv"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/wolfedale/go-proxy-mail/internal/delivery"
+	"github.com/wolfedale/go-proxy-mail/internal/rewrite"
+	"github.com/wolfedale/go-proxy-mail/internal/store"
+)
+
+/*
+  Bounce Settings
+*/
+const BounceFrom string = "MAILER-DAEMON@"
+const BounceSubject string = "Undelivered Mail Returned to Sender"
+
+/*
+  Release e-mail: send it from the queue to recipients.
+  It's not panicking, so janitor and bulk can keep running.
+*/
+func release(t Mail) error {
+	dat, err := ioutil.ReadFile(path.Join(queueDir, t.Queue))
+	if err != nil {
+		return err
+	}
+	dat = rewrite.Delivered(t.Queue, dat, t.Rewrite)
+	return delivery.SendMail(t.Sender, t.Recipients, delivery.Stamp(dat, t, string(store.StatusReleased)))
+}
+
+/*
+  Discard e-mail: remove it from the queue
+*/
+func discard(t Mail) error {
+	err := os.Remove(path.Join(queueDir, t.Queue))
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+/*
+  Remove sidecar metadata, so e-mail is not coming
+  back from the spool after restart
+*/
+func forget(t Mail) {
+	err := os.Remove(path.Join(queueDir, t.Queue+store.SIDECAR))
+	if err != nil && !os.IsNotExist(err) {
+		log.Println("Cannot remove sidecar of "+t.Queue+": ", err)
+	}
+}
+
+/*
+  Write metadata back to the sidecar, so status is
+  kept after restart. It's written under temporary
+  name first, the same way as the filter does it.
+*/
+func saveSidecar(t Mail) error {
+	return store.WriteSidecar(queueDir, t)
+}
+
+/*
+  Set the final status of the e-mail and save it
+*/
+func decide(t Mail, status store.Status) Mail {
+	updated, err := RepoSetStatus(t.Id, status, time.Now())
+	if err != nil {
+		return t
+	}
+	if err := saveSidecar(updated); err != nil {
+		log.Println("Cannot save sidecar of "+t.Queue+": ", err)
+	}
+	return updated
+}
+
+/*
+  Final status after the action
+*/
+var actionStatus = map[string]store.Status{
+	AuditRelease: store.StatusReleased,
+	AuditDiscard: store.StatusDiscarded,
+	AuditBounce:  store.StatusBounced,
+}
+
+/*
+  Bounce e-mail: let sender know that e-mail has been
+  rejected and remove it from the queue
+*/
+func bounce(t Mail) error {
+	msg := "Subject: " + BounceSubject + "\n\n" +
+		"Your message to " + t.Recipient() + " has been rejected by mailProxy.\n" +
+		"Subject: " + t.Subject + "\n" +
+		"Queue: " + t.Queue + "\n"
+	if err := delivery.SendMail(BounceFrom, []string{t.Sender}, []byte(msg)); err != nil {
+		return err
+	}
+	return discard(t)
+}
+
+/*
+  Run action on one e-mail and write it to the audit log.
+  Result is 500 when the audit log can't be written, even
+  when the action itself is done.
+*/
+func runAction(r *http.Request, action, tag string, id int) BulkResult {
+	audited := func(res BulkResult, outcome string) BulkResult {
+		if err := Audit(r, action, res.Queue, id, outcome); err != nil {
+			return BulkResult{Id: id, Queue: res.Queue, Code: http.StatusInternalServerError, Text: res.Text + ", cannot write audit log: " + err.Error()}
+		}
+		return res
+	}
+
+	stateMu.Lock()
+	defer stateMu.Unlock()
+
+	t := RepoFindMail(id)
+	if t.Id == 0 {
+		return audited(BulkResult{Id: id, Code: http.StatusNotFound, Text: "Not Found"}, "not found")
+	}
+
+	// only held e-mails can be released, discarded or bounced
+	if action != AuditTag && t.Status != store.StatusHeld {
+		return audited(BulkResult{Id: t.Id, Queue: t.Queue, Code: http.StatusConflict, Text: "Mail is already " + string(t.Status)}, "already "+string(t.Status))
+	}
+
+	// bounce has the null sender, there is nobody to bounce it to
+	if action == AuditBounce && t.Sender == "" {
+		return audited(BulkResult{Id: t.Id, Queue: t.Queue, Code: http.StatusConflict, Text: "Mail has no sender to bounce to"}, "no sender")
+	}
+
+	var err error
+	switch action {
+	case AuditRelease:
+		err = release(t)
+	case AuditDiscard:
+		err = discard(t)
+	case AuditBounce:
+		err = bounce(t)
+	case AuditTag:
+		err = RepoTagMail(t.Id, tag)
+	}
+	if err != nil {
+		return audited(BulkResult{Id: t.Id, Queue: t.Queue, Code: http.StatusInternalServerError, Text: err.Error()}, "error: "+err.Error())
+	}
+
+	outcome := "ok"
+	if action == AuditTag {
+		outcome = "ok: " + tag
+		t = RepoFindMail(t.Id)
+		if err := saveSidecar(t); err != nil {
+			log.Println("Cannot save sidecar of "+t.Queue+": ", err)
+		}
+	} else {
+		t = decide(t, actionStatus[action])
+	}
+	Publish(action, t)
+	return audited(BulkResult{Id: t.Id, Queue: t.Queue, Code: http.StatusOK, Text: "OK"}, outcome)
+}
+
+/*
+  Handler running one action on the e-mail from the URL, e.g.
+  curl -i -X POST http://localhost:8080/api/v1/mails/1/discard
+*/
+func MailAction(action string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		mailId, err := strconv.Atoi(mux.Vars(r)["mailId"])
+		if err != nil {
+			writeError(w, r, http.StatusBadRequest, "mailId must be a number")
+			return
+		}
+		res := runAction(r, action, "", mailId)
+		writeJSON(w, res.Code, jsonErr{Code: res.Code, Message: res.Text, RequestId: requestId(r)})
+	}
+}
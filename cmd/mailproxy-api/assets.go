@@ -0,0 +1,70 @@
+package main
+
+import (
+	"embed"
+	"html/template"
+	"io/fs"
+	"net/http"
+	"path"
+)
+
+/*
+  Dashboard templates and static files are part of the
+  binary, so it can be started from any directory.
+*/
+//go:embed templates
+var assets embed.FS
+
+/*
+  templateDir: when it's set, templates and static files
+  are read from the disk on every request (for development)
+*/
+var templateDir string
+
+var indexTemplate *template.Template
+
+/*
+  Parse templates once on startup, error is returned
+  so broken template is stopping the API
+*/
+func LoadTemplates(dir string) error {
+	templateDir = dir
+	t, err := parseIndex()
+	if err != nil {
+		return err
+	}
+	indexTemplate = t
+	return nil
+}
+
+func parseIndex() (*template.Template, error) {
+	if templateDir != "" {
+		return template.ParseFiles(path.Join(templateDir, "index.html"))
+	}
+	return template.ParseFS(assets, "templates/index.html")
+}
+
+/*
+  Return index template, from the disk in development mode
+*/
+func IndexTemplate() (*template.Template, error) {
+	if templateDir != "" {
+		return parseIndex()
+	}
+	return indexTemplate, nil
+}
+
+/*
+  Return file server for the static directory, e.g. "css"
+*/
+func StaticHandler(dir string) http.Handler {
+	if templateDir != "" {
+		return http.FileServer(http.Dir(path.Join(templateDir, dir)))
+	}
+	sub, err := fs.Sub(assets, path.Join("templates", dir))
+	if err != nil {
+		// it can't happen, directories are embedded
+		panic(err)
+	}
+	return http.FileServer(http.FS(sub))
+}
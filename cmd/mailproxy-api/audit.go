@@ -0,0 +1,320 @@
+package main
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"encoding/csv"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"path"
+	"strconv"
+	"sync"
+	"time"
+)
+
+/*
+  AUDITLOG: append-only file with every administrative action.
+  One JSON entry per line, every entry keeps the hash of the
+  previous one, so removing or changing a line breaks the chain.
+*/
+const AUDITLOG string = "/var/spool/mailProxy/logs/audit.log"
+
+/*
+  auditLog is AUDITLOG, tests are using a temporary file
+*/
+var auditLog = AUDITLOG
+
+/*
+  Actions we are writing to the audit log
+*/
+const (
+	AuditViewRaw string = "view-raw"
+	AuditRelease string = "release"
+	AuditDiscard string = "discard"
+	AuditBounce  string = "bounce"
+	AuditTag     string = "tag"
+	AuditPurge   string = "purge"
+	AuditRemove  string = "remove"
+	AuditLogin   string = "login"
+)
+
+/*
+  AuditEntry structure
+  Seq: position in the chain, starting from 1
+  Actor: who did it, authenticated user (see Authenticate),
+  "token" for the bearer token, or anonymous when
+  no users are configured
+  SourceIP: remote address of the request
+  Outcome: ok, not found or error message
+  PrevHash: Hash of the previous entry
+  Hash: sha256 of the entry as JSON, with empty Hash
+*/
+type AuditEntry struct {
+	Seq      int       `json:"seq"`
+	Date     time.Time `json:"date"`
+	Actor    string    `json:"actor"`
+	SourceIP string    `json:"sourceip"`
+	Action   string    `json:"action"`
+	Queue    string    `json:"queue"`
+	MailId   int       `json:"mailid"`
+	Outcome  string    `json:"outcome"`
+	PrevHash string    `json:"prevhash"`
+	Hash     string    `json:"hash"`
+}
+
+type AuditEntries []AuditEntry
+
+var auditMu sync.Mutex
+
+var audits AuditEntries
+
+/*
+  Read existing audit log, so new entries are chained
+  to the last one we wrote before restart.
+*/
+func AuditOpen() error {
+	auditMu.Lock()
+	defer auditMu.Unlock()
+
+	list, err := auditRead()
+	if err != nil {
+		return err
+	}
+	audits = list
+	return nil
+}
+
+/*
+  Read all entries of the audit log file
+*/
+func auditRead() (AuditEntries, error) {
+	f, err := os.Open(auditLog)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var list AuditEntries
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		var e AuditEntry
+		if err := json.Unmarshal(scanner.Bytes(), &e); err != nil {
+			return nil, fmt.Errorf("audit log line %d: %v", len(list)+1, err)
+		}
+		list = append(list, e)
+	}
+	return list, scanner.Err()
+}
+
+/*
+  Write one entry to the audit log. Entry is first written
+  to the file and only then added to the memory. Callers
+  have to handle the error, action which is not in the
+  audit log must not look successful.
+*/
+func Audit(r *http.Request, action, queue string, mailId int, outcome string) error {
+	return auditWrite(auditActor(r), auditIP(r), action, queue, mailId, outcome)
+}
+
+func auditWrite(actor, ip, action, queue string, mailId int, outcome string) error {
+	auditMu.Lock()
+	defer auditMu.Unlock()
+
+	e := AuditEntry{
+		Seq:      len(audits) + 1,
+		Date:     time.Now().UTC(),
+		Actor:    actor,
+		SourceIP: ip,
+		Action:   action,
+		Queue:    queue,
+		MailId:   mailId,
+		Outcome:  outcome,
+	}
+	if len(audits) > 0 {
+		e.PrevHash = audits[len(audits)-1].Hash
+	}
+	e.Hash = auditHash(e)
+
+	line, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+	f, err := os.OpenFile(auditLog, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0600)
+	if err != nil {
+		log.Println("Cannot open audit log: ", err)
+		return err
+	}
+	if _, err := f.Write(append(line, '\n')); err != nil {
+		f.Close()
+		log.Println("Cannot write audit log: ", err)
+		return err
+	}
+	if err := f.Close(); err != nil {
+		log.Println("Cannot write audit log: ", err)
+		return err
+	}
+
+	audits = append(audits, e)
+	return nil
+}
+
+/*
+  Hash of the entry, Hash field itself is not included.
+  Entry is hashed as JSON, so fields can't be shifted
+  from one to another.
+*/
+func auditHash(e AuditEntry) string {
+	e.Hash = ""
+	data, err := json.Marshal(e)
+	if err != nil {
+		return ""
+	}
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+/*
+  Read the audit log file again and walk through the whole
+  chain, return the first entry which is not matching.
+  Entries we wrote have to be in the file as well, so
+  removed lines at the end are found too. 0 means chain
+  is fine.
+*/
+func AuditVerifyChain() (int, error) {
+	auditMu.Lock()
+	defer auditMu.Unlock()
+
+	list, err := auditRead()
+	if err != nil {
+		return 0, err
+	}
+	prev := ""
+	for i, e := range list {
+		if e.Seq != i+1 || e.PrevHash != prev || auditHash(e) != e.Hash {
+			return i + 1, nil
+		}
+		if i < len(audits) && audits[i].Hash != e.Hash {
+			return i + 1, nil
+		}
+		prev = e.Hash
+	}
+	if len(list) < len(audits) {
+		return len(list) + 1, nil
+	}
+	return 0, nil
+}
+
+/*
+  Who is calling, only the identity checked by Authenticate
+  is used, user names sent by the client are not trusted
+*/
+func auditActor(r *http.Request) string {
+	if actor, _ := r.Context().Value(actorKey{}).(string); actor != "" {
+		return actor
+	}
+	return "anonymous"
+}
+
+func auditIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+/*
+  Wrapper for the queue file server, every raw mail view
+  is written to the audit log.
+*/
+func AuditRaw(inner http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		queue := path.Base(r.URL.Path)
+		outcome := "ok"
+		if _, err := os.Stat(path.Join(queueDir, queue)); err != nil {
+			outcome = "not found"
+		}
+		// raw e-mail is not shown when we can't write it down
+		if err := Audit(r, AuditViewRaw, queue, 0, outcome); err != nil {
+			writeError(w, r, http.StatusInternalServerError, "Cannot write audit log")
+			return
+		}
+
+		inner.ServeHTTP(w, r)
+	})
+}
+
+/*
+  AuditIndex returns audit log, we can filter it by
+  action, actor and queue and ask for csv instead of json:
+  curl "http://localhost:8080/audit?action=release&format=csv"
+*/
+func AuditIndex(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+
+	auditMu.Lock()
+	var list AuditEntries
+	for _, e := range audits {
+		if a := q.Get("action"); a != "" && a != e.Action {
+			continue
+		}
+		if a := q.Get("actor"); a != "" && a != e.Actor {
+			continue
+		}
+		if a := q.Get("queue"); a != "" && a != e.Queue {
+			continue
+		}
+		list = append(list, e)
+	}
+	auditMu.Unlock()
+
+	if q.Get("format") == "csv" {
+		w.Header().Set("Content-Type", "text/csv; charset=UTF-8")
+		w.Header().Set("Content-Disposition", "attachment; filename=audit.csv")
+		w.WriteHeader(http.StatusOK)
+		c := csv.NewWriter(w)
+		c.Write([]string{"seq", "date", "actor", "sourceip", "action", "queue", "mailid", "outcome", "prevhash", "hash"})
+		for _, e := range list {
+			c.Write([]string{
+				strconv.Itoa(e.Seq),
+				e.Date.Format(time.RFC3339Nano),
+				e.Actor,
+				e.SourceIP,
+				e.Action,
+				e.Queue,
+				strconv.Itoa(e.MailId),
+				e.Outcome,
+				e.PrevHash,
+				e.Hash,
+			})
+		}
+		c.Flush()
+		return
+	}
+
+	writeJSON(w, http.StatusOK, list)
+}
+
+/*
+  AuditVerify checks the hash chain of the whole audit log
+*/
+func AuditVerify(w http.ResponseWriter, r *http.Request) {
+	broken, err := AuditVerifyChain()
+	if err != nil {
+		writeError(w, r, http.StatusInternalServerError, "Cannot read audit log: "+err.Error())
+		return
+	}
+	if broken > 0 {
+		writeError(w, r, http.StatusConflict, fmt.Sprintf("Audit chain broken at entry %d", broken))
+		return
+	}
+	writeJSON(w, http.StatusOK, jsonErr{Code: http.StatusOK, Message: "OK"})
+}
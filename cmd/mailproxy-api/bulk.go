@@ -0,0 +1,125 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+)
+
+/*
+  BulkRequest structure
+  Ids: list of e-mail ids
+  Filter: the same filters as for GET /mails, e.g. {"sender":"pawel"}
+  Action: release, discard, bounce or tag
+  Tag: tag name for the tag action
+*/
+type BulkRequest struct {
+	Ids    []int             `json:"ids"`
+	Filter map[string]string `json:"filter"`
+	Action string            `json:"action"`
+	Tag    string            `json:"tag"`
+}
+
+/*
+  Result for one e-mail
+*/
+type BulkResult struct {
+	Id    int    `json:"id"`
+	Queue string `json:"queue"`
+	Code  int    `json:"code"`
+	Text  string `json:"text"`
+}
+
+/*
+  BulkResponse structure, Failed > 0 means partial failure
+*/
+type BulkResponse struct {
+	Action  string       `json:"action"`
+	Total   int          `json:"total"`
+	Failed  int          `json:"failed"`
+	Results []BulkResult `json:"results"`
+}
+
+/*
+  MailBulk is a POST request which runs one action on many e-mails:
+  curl -H "Content-Type: application/json" -d '{"ids":[1,2],"action":"release"}' http://localhost:8080/mails/bulk
+  curl -H "Content-Type: application/json" -d '{"filter":{"sender":"pawel"},"action":"discard"}' http://localhost:8080/mails/bulk
+  Returns 200 when everything went fine and 207 when some e-mails failed.
+*/
+func MailBulk(w http.ResponseWriter, r *http.Request) {
+	var req BulkRequest
+	body, err := ioutil.ReadAll(io.LimitReader(r.Body, 1048576))
+	if err != nil {
+		writeError(w, r, http.StatusBadRequest, "Cannot read request body")
+		return
+	}
+	r.Body.Close()
+
+	if err := json.Unmarshal(body, &req); err != nil {
+		writeError(w, r, http.StatusUnprocessableEntity, "Invalid JSON: "+err.Error())
+		return
+	}
+
+	switch req.Action {
+	case AuditRelease, AuditDiscard, AuditBounce:
+	case AuditTag:
+		if req.Tag == "" {
+			writeFieldErrors(w, r, map[string]string{"tag": "is required for the tag action"})
+			return
+		}
+	default:
+		writeFieldErrors(w, r, map[string]string{"action": "must be release, discard, bounce or tag"})
+		return
+	}
+
+	// empty filter would match everything, we don't want it by mistake
+	if len(req.Ids) == 0 && len(req.Filter) == 0 {
+		writeFieldErrors(w, r, map[string]string{"ids": "ids or filter is required"})
+		return
+	}
+
+	var list Mails
+	if len(req.Filter) > 0 {
+		v := url.Values{}
+		for k, f := range req.Filter {
+			v.Set(k, f)
+		}
+		v.Del("cursor")
+		v.Del("limit")
+		q, err := ParseMailQuery(v)
+		if err != nil {
+			writeFieldErrors(w, r, map[string]string{"filter": err.Error()})
+			return
+		}
+		all := RepoMails()
+		q.Limit = len(all) + 1
+		list, _ = q.Run(all)
+	}
+	for _, id := range req.Ids {
+		list = append(list, Mail{Id: id})
+	}
+
+	res := BulkResponse{Action: req.Action}
+	done := map[int]bool{}
+	for _, t := range list {
+		if done[t.Id] {
+			continue
+		}
+		done[t.Id] = true
+
+		result := runAction(r, req.Action, req.Tag, t.Id)
+		if result.Code != http.StatusOK {
+			res.Failed++
+		}
+		res.Total++
+		res.Results = append(res.Results, result)
+	}
+
+	status := http.StatusOK
+	if res.Failed > 0 {
+		status = http.StatusMultiStatus
+	}
+	writeJSON(w, status, res)
+}
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"log"
+	"net/http"
+	"runtime/debug"
+)
+
+/*
+  simple structure for errors
+  Code: HTTP status code
+  Message: what went wrong
+  RequestId: the same as X-Request-Id header, to find it in the logs
+  Fields: validation errors per field
+*/
+type jsonErr struct {
+	Code      int               `json:"code"`
+	Message   string            `json:"message"`
+	RequestId string            `json:"requestid,omitempty"`
+	Fields    map[string]string `json:"fields,omitempty"`
+}
+
+type requestIdKey struct{}
+
+/*
+  Write v as json with the status code. Status is
+  already sent when encoding fails, so we can only log it.
+*/
+func writeJSON(w http.ResponseWriter, code int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json; charset=UTF-8")
+	w.WriteHeader(code)
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		log.Println("Cannot encode response: ", err)
+	}
+}
+
+/*
+  Write jsonErr with the status code
+*/
+func writeError(w http.ResponseWriter, r *http.Request, code int, message string) {
+	writeJSON(w, code, jsonErr{Code: code, Message: message, RequestId: requestId(r)})
+}
+
+/*
+  Write 422 with validation errors per field
+*/
+func writeFieldErrors(w http.ResponseWriter, r *http.Request, fields map[string]string) {
+	code := http.StatusUnprocessableEntity
+	writeJSON(w, code, jsonErr{Code: code, Message: "Validation failed", RequestId: requestId(r), Fields: fields})
+}
+
+/*
+  Return request id of the request
+*/
+func requestId(r *http.Request) string {
+	id, _ := r.Context().Value(requestIdKey{}).(string)
+	return id
+}
+
+/*
+  RequestId is taking X-Request-Id from the request or
+  generating a new one, and sending it back in the response
+*/
+func RequestId(inner http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id := r.Header.Get("X-Request-Id")
+		if id == "" || len(id) > 64 {
+			b := make([]byte, 8)
+			rand.Read(b)
+			id = hex.EncodeToString(b)
+		}
+		w.Header().Set("X-Request-Id", id)
+		inner.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), requestIdKey{}, id)))
+	})
+}
+
+/*
+  Recovery is converting panic in the handler to 500 json response
+*/
+func Recovery(inner http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		defer func() {
+			if e := recover(); e != nil {
+				log.Printf("%s panic: %v\n%s", requestId(r), e, debug.Stack())
+				writeError(w, r, http.StatusInternalServerError, "Internal Server Error")
+			}
+		}()
+		inner.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+)
+
+/*
+  Event structure, sent to the dashboard
+  Type: create, release, discard, bounce, tag or remove
+  Mail: e-mail after the change
+*/
+type Event struct {
+	Type string `json:"type"`
+	Mail Mail   `json:"mail"`
+}
+
+/*
+  EventCreate and EventRemove are used next to the audit
+  actions (release, discard, bounce, tag) as event types
+*/
+const EventCreate string = "create"
+const EventRemove string = "remove"
+
+/*
+  KEEPALIVE: how often we are sending comment to keep
+  connection open through proxies
+*/
+const KEEPALIVE time.Duration = 30 * time.Second
+
+var eventsMu sync.Mutex
+
+var subscribers = map[chan Event]bool{}
+
+/*
+  Send event to all subscribers. Slow subscriber is
+  losing events, it's not blocking the repo.
+*/
+func Publish(t string, mail Mail) {
+	eventsMu.Lock()
+	defer eventsMu.Unlock()
+	for c := range subscribers {
+		select {
+		case c <- Event{Type: t, Mail: mail}:
+		default:
+		}
+	}
+}
+
+func subscribe() chan Event {
+	c := make(chan Event, 16)
+	eventsMu.Lock()
+	subscribers[c] = true
+	eventsMu.Unlock()
+	return c
+}
+
+func unsubscribe(c chan Event) {
+	eventsMu.Lock()
+	delete(subscribers, c)
+	eventsMu.Unlock()
+}
+
+/*
+  Events is a Server-Sent Events stream with every change
+  in the blocked list, to test it:
+  curl -N http://localhost:8080/events
+*/
+func Events(w http.ResponseWriter, r *http.Request) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		writeError(w, r, http.StatusInternalServerError, "Streaming is not supported")
+		return
+	}
+
+	c := subscribe()
+	defer unsubscribe(c)
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("X-Accel-Buffering", "no")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+
+	ticker := time.NewTicker(KEEPALIVE)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case <-ticker.C:
+			fmt.Fprint(w, ": keepalive\n\n")
+			flusher.Flush()
+		case e := <-c:
+			data, err := json.Marshal(e)
+			if err != nil {
+				continue
+			}
+			fmt.Fprintf(w, "event: %s\ndata: %s\n\n", e.Type, data)
+			flusher.Flush()
+		}
+	}
+}
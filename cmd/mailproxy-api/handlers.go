@@ -0,0 +1,193 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"github.com/gorilla/mux"
+	"github.com/wolfedale/go-proxy-mail/internal/store"
+)
+
+/*
+  Data for the dashboard template
+  Mails: current page
+  Query: URL query, so filters are kept in the form
+  Next: URL of the next page ("" for the last one)
+*/
+type IndexPage struct {
+	Mails Mails
+	Query url.Values
+	Next  string
+	Error string
+}
+
+/*
+  API index, using for dashboard, we are using here
+  template and giving access to mails struct
+*/
+func Index(w http.ResponseWriter, r *http.Request) {
+	page := IndexPage{Query: r.URL.Query()}
+
+	// dashboard is showing held e-mails unless asked for more
+	if _, ok := page.Query["status"]; !ok {
+		page.Query.Set("status", string(store.StatusHeld))
+	}
+	q, err := ParseMailQuery(page.Query)
+	if err != nil {
+		page.Error = err.Error()
+	} else {
+		var next string
+		page.Mails, next = q.Run(RepoMails())
+		if next != "" {
+			v := r.URL.Query()
+			v.Set("cursor", next)
+			page.Next = "?" + v.Encode()
+		}
+	}
+
+	t, err := IndexTemplate()
+	if err != nil {
+		log.Println("Cannot parse template: ", err)
+		http.Error(w, "Cannot parse template: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	// rendering to the buffer first, so error is not ending
+	// with half of the page and 200
+	var b bytes.Buffer
+	if err := t.Execute(&b, page); err != nil {
+		log.Println("Cannot render template: ", err)
+		http.Error(w, "Cannot render template", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "text/html; charset=UTF-8")
+	w.WriteHeader(http.StatusOK)
+	b.WriteTo(w)
+}
+
+/*
+  API mailindex is listening blocked e-mails and returning
+  list in json format. We can filter, sort and paginate it:
+  curl "http://localhost:8080/mails?sender=pawel&sort=-date&limit=50"
+  Cursor for the next page is in X-Next-Cursor header.
+*/
+func MailIndex(w http.ResponseWriter, r *http.Request) {
+	q, err := ParseMailQuery(r.URL.Query())
+	if err != nil {
+		writeError(w, r, http.StatusBadRequest, err.Error())
+		return
+	}
+	list, next := q.Run(RepoMails())
+	if list == nil {
+		list = Mails{}
+	}
+
+	if next != "" {
+		w.Header().Set("X-Next-Cursor", next)
+	}
+	writeJSON(w, http.StatusOK, list)
+}
+
+/*
+  mailshow will show us details about one specific e-mail
+  if there is no e-mail we are returing 404
+*/
+func MailShow(w http.ResponseWriter, r *http.Request) {
+	mailId, err := strconv.Atoi(mux.Vars(r)["mailId"])
+	if err != nil {
+		writeError(w, r, http.StatusBadRequest, "mailId must be a number")
+		return
+	}
+	mail := RepoFindMail(mailId)
+	if mail.Id > 0 {
+		writeJSON(w, http.StatusOK, mail)
+		return
+	}
+
+	// If we didn't find it, 404
+	writeError(w, r, http.StatusNotFound, "Not Found")
+}
+
+/*
+  MailCreate is a POST request which can add e-mail to blocked list
+  to test it we can call it like:
+  curl -H "Content-Type: application/json" -d '{"sender":"a@foobar.org","recipients":["b@example.com"],"queue":"ABC123"}' http://localhost:8080/mails
+*/
+func MailCreate(w http.ResponseWriter, r *http.Request) {
+	var mail Mail
+	body, err := ioutil.ReadAll(io.LimitReader(r.Body, 1048576))
+	if err != nil {
+		writeError(w, r, http.StatusBadRequest, "Cannot read request body")
+		return
+	}
+	r.Body.Close()
+
+	if err := json.Unmarshal(body, &mail); err != nil {
+		writeError(w, r, http.StatusUnprocessableEntity, "Invalid JSON: "+err.Error())
+		return
+	}
+	fields := validateMail(mail)
+	if mail.Status != "" {
+		fields["status"] = "is set by the API"
+	}
+	if mail.Released != nil || mail.Reviewed != nil {
+		fields["released"] = "is set by the API"
+	}
+	if len(fields) > 0 {
+		writeFieldErrors(w, r, fields)
+		return
+	}
+
+	// watcher could add it from the spool already
+	t, created := RepoIngestMail(mail)
+	if !created {
+		writeJSON(w, http.StatusOK, t)
+		return
+	}
+	writeJSON(w, http.StatusCreated, t)
+}
+
+/*
+  Check fields of the new e-mail, returns error per field.
+  Status is checked only here, sidecars have it.
+  Queue is used as a file name, so it can't contain anything
+  else than characters used by the filter.
+*/
+func validateMail(mail Mail) map[string]string {
+	fields := map[string]string{}
+	// empty is the null sender of the bounces
+	if mail.Sender != "" && !strings.Contains(mail.Sender, "@") {
+		fields["sender"] = "must be an e-mail address"
+	}
+	if len(mail.Recipients) == 0 {
+		fields["recipients"] = "is required"
+	}
+	if mail.Status != "" && !mail.Status.Valid() {
+		fields["status"] = "is not known"
+	}
+	if mail.Queue == "" {
+		fields["queue"] = "is required"
+	} else if !store.ValidQueue(mail.Queue) {
+		fields["queue"] = "must contain only 1-9 and A-Z"
+	}
+	if mail.Id != 0 {
+		fields["id"] = "is assigned by the API"
+	}
+	return fields
+}
+
+/*
+  MailDelete is a DELETE request which will release e-mail and
+  delete it from the blocked list. If there is nothing to delete
+  it will return 404 HTTP code.
+  To test it:
+  curl -i -X DELETE http://localhost:8080/mails/1
+*/
+var MailDelete = MailAction(AuditRelease)
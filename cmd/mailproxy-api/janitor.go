@@ -0,0 +1,272 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/wolfedale/go-proxy-mail/internal/delivery"
+	"github.com/wolfedale/go-proxy-mail/internal/store"
+)
+
+/*
+  Retention policy for blocked e-mails
+  Action: what we are doing with expired e-mail, "discard" or "release"
+  After: how long e-mail can stay in the queue
+  Warn: how long before expiry we are sending a warning
+*/
+type Retention struct {
+	Action string
+	After  time.Duration
+	Warn   time.Duration
+}
+
+/*
+  RETENTION: retention per rule, "default" is used
+  when there is nothing for the rule of the e-mail.
+  Released, discarded, bounced and expired e-mails are
+  removed with their files After their final status.
+  Orphaned queue files (without record in the repo) get
+  the "default" action after its retention as well.
+*/
+var RETENTION = map[string]Retention{
+	"default": Retention{
+		Action: "discard",
+		After:  30 * 24 * time.Hour,
+		Warn:   3 * 24 * time.Hour,
+	},
+}
+
+/*
+  JANITORINTERVAL: how often janitor is checking the queue
+*/
+const JANITORINTERVAL time.Duration = time.Hour
+
+/*
+  Actor of the janitor in the audit log
+*/
+const AuditJanitor string = "janitor"
+
+/*
+  E-mail Notification Settings
+*/
+const NotificationFrom string = "mailProxy@"
+const NotificationRecipients string = "pawel.grzesik@"
+const NotificationSubject string = "mailProxy retention warning"
+
+/*
+  we are sending only one warning per e-mail and
+  writing orphans we can't release only once
+*/
+var warned = map[int]bool{}
+
+var orphansKept = map[string]bool{}
+
+/*
+  Janitor is running in the background and enforcing
+  retention policy every JANITORINTERVAL.
+*/
+func Janitor() {
+	for {
+		JanitorRun(time.Now())
+		time.Sleep(JANITORINTERVAL)
+	}
+}
+
+/*
+  One janitor run, expire held e-mails, purge old decided
+  ones and remove orphaned files
+*/
+func JanitorRun(now time.Time) {
+	for _, t := range RepoMails() {
+		janitorMail(t.Id, now)
+	}
+
+	janitorOrphans(now)
+}
+
+/*
+  Enforce retention of one e-mail. State lock is held for
+  the whole change, e-mail is read again under it, so it's
+  not changed by the handlers since RepoMails.
+*/
+func janitorMail(id int, now time.Time) {
+	stateMu.Lock()
+	defer stateMu.Unlock()
+
+	t := RepoFindMail(id)
+	if t.Id == 0 {
+		return
+	}
+	r := retentionFor(t.Rule)
+
+	if t.Status != store.StatusHeld {
+		if t.Reviewed != nil && now.After(t.Reviewed.Add(r.After)) {
+			janitorPurge(t)
+		}
+		return
+	}
+
+	expire := t.Received.Add(r.After)
+
+	if now.After(expire) {
+		janitorExpire(t, r)
+		return
+	}
+
+	if r.Warn > 0 && now.After(expire.Add(-r.Warn)) && !warned[t.Id] {
+		warned[t.Id] = true
+		body := t.Queue + " " + t.Sender + " => " + t.Recipient() +
+			" expires on " + expire.Format(time.RFC1123) + " (" + r.Action + ")"
+		log.Println("Retention warning: " + body)
+		delivery.Notify(NotificationFrom, NotificationRecipients, NotificationSubject, body)
+	}
+}
+
+/*
+  Write janitor action to the audit log, there is nobody
+  to answer, so the error is only logged
+*/
+func janitorAudit(action, queue string, mailId int, outcome string) {
+	if err := auditWrite(AuditJanitor, "", action, queue, mailId, outcome); err != nil {
+		log.Println("Janitor cannot write audit log ("+action+" "+queue+"): ", err)
+	}
+}
+
+/*
+  Return retention for the rule
+*/
+func retentionFor(rule string) Retention {
+	if r, ok := RETENTION[rule]; ok {
+		return r
+	}
+	return RETENTION["default"]
+}
+
+/*
+  Release or discard expired e-mail
+*/
+func janitorExpire(t Mail, r Retention) {
+	action := AuditDiscard
+	status := store.StatusExpired
+	outcome := "expired"
+
+	if r.Action == "release" {
+		action = AuditRelease
+		status = store.StatusReleased
+		if err := release(t); err != nil {
+			log.Println("Janitor cannot release "+t.Queue+": ", err)
+			janitorAudit(action, t.Queue, t.Id, "error: "+err.Error())
+			return
+		}
+	} else {
+		if err := discard(t); err != nil {
+			log.Println("Janitor cannot remove "+t.Queue+": ", err)
+			janitorAudit(action, t.Queue, t.Id, "error: "+err.Error())
+			return
+		}
+	}
+
+	t = decide(t, status)
+	Publish(action, t)
+	delete(warned, t.Id)
+	log.Println("Janitor " + action + " " + t.Queue + " (" + outcome + ")")
+	janitorAudit(action, t.Queue, t.Id, outcome)
+}
+
+/*
+  Remove decided e-mail with its files after retention
+*/
+func janitorPurge(t Mail) {
+	if err := discard(t); err != nil {
+		log.Println("Janitor cannot remove "+t.Queue+": ", err)
+		return
+	}
+	forget(t)
+	RepoDestroyMail(t.Id)
+	Publish(EventRemove, t)
+	log.Println("Janitor purged " + t.Queue + " (" + string(t.Status) + ")")
+	janitorAudit(AuditPurge, t.Queue, t.Id, string(t.Status))
+}
+
+/*
+  Queue files without record in the repo get the "default"
+  action. Repo is kept in memory, so after restart every file
+  is an orphan, this is why we are waiting for the "default"
+  retention. Orphans are released with their sidecar, the
+  ones without it can't be released and are kept.
+*/
+func janitorOrphans(now time.Time) {
+	files, err := ioutil.ReadDir(queueDir)
+	if err != nil {
+		log.Println("Janitor cannot read queue: ", err)
+		return
+	}
+	r := RETENTION["default"]
+	for _, f := range files {
+		if f.IsDir() || now.Sub(f.ModTime()) < r.After {
+			continue
+		}
+		queue := strings.TrimSuffix(f.Name(), store.SIDECAR)
+		if r.Action == "release" && queue != f.Name() {
+			// sidecar goes with its e-mail
+			if _, err := os.Stat(path.Join(queueDir, queue)); err == nil {
+				continue
+			}
+		}
+
+		stateMu.Lock()
+		if RepoFindQueue(queue).Id > 0 {
+			stateMu.Unlock()
+			continue
+		}
+		if r.Action == "release" && queue == f.Name() {
+			janitorReleaseOrphan(queue)
+		} else {
+			janitorRemoveOrphan(f.Name())
+		}
+		stateMu.Unlock()
+	}
+}
+
+func janitorRemoveOrphan(name string) {
+	if err := os.Remove(path.Join(queueDir, name)); err != nil {
+		log.Println("Janitor cannot remove orphan "+name+": ", err)
+		return
+	}
+	log.Println("Janitor removed orphan " + name)
+	janitorAudit(AuditDiscard, name, 0, "orphan")
+}
+
+/*
+  Release orphan with the sender and recipients from its sidecar
+*/
+func janitorReleaseOrphan(queue string) {
+	t, err := store.ReadSidecar(path.Join(queueDir, queue+store.SIDECAR))
+	if err == nil && (t.Sender == "" || len(t.Recipients) == 0) {
+		err = fmt.Errorf("no sender or recipients")
+	}
+	if err == nil {
+		t.Queue = queue
+		err = release(t)
+	}
+	if err != nil {
+		if !orphansKept[queue] {
+			orphansKept[queue] = true
+			log.Println("Janitor cannot release orphan "+queue+", it's kept: ", err)
+			janitorAudit(AuditRelease, queue, 0, "orphan kept: "+err.Error())
+		}
+		return
+	}
+	delete(orphansKept, queue)
+	if err := discard(t); err != nil {
+		log.Println("Janitor cannot remove "+queue+": ", err)
+	}
+	forget(t)
+	log.Println("Janitor released orphan " + queue)
+	janitorAudit(AuditRelease, queue, 0, "orphan")
+}
@@ -0,0 +1,100 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+	"time"
+
+	"github.com/wolfedale/go-proxy-mail/internal/store"
+)
+
+/*
+  Janitor with a temporary queue and audit log, time of
+  the run is given to JanitorRun, so nothing is waiting
+*/
+func TestJanitor(t *testing.T) {
+	dir := t.TempDir()
+	queueDir = dir
+	auditLog = path.Join(dir, "audit.log")
+	audits = nil
+	mails = nil
+	currentId = 0
+	defer func(r map[string]Retention) { RETENTION, queueDir, auditLog = r, QUEUEDIR, AUDITLOG }(RETENTION)
+	RETENTION = map[string]Retention{"default": {Action: "discard", After: 30 * 24 * time.Hour}}
+
+	now := time.Date(2026, 10, 1, 12, 0, 0, 0, time.UTC)
+	old := now.Add(-31 * 24 * time.Hour)
+	recent := now.Add(-24 * time.Hour)
+	mail := func(queue string, status store.Status, received time.Time, reviewed, released *time.Time) {
+		if err := ioutil.WriteFile(path.Join(dir, queue), []byte("Subject: "+queue+"\n\nhi\n"), 0600); err != nil {
+			t.Fatal(err)
+		}
+		os.Chtimes(path.Join(dir, queue), old, old)
+		RepoCreateMail(Mail{Queue: queue, Sender: "a@foobar.org", Recipients: []string{"b@example.com"}, Status: status, Received: received, Reviewed: reviewed, Released: released})
+	}
+	mail("HELDOLD", store.StatusHeld, old, nil, nil)
+	mail("HELDNEW", store.StatusHeld, recent, nil, nil)
+	mail("RELEASEDOLD", store.StatusReleased, old, &old, &old)
+	mail("DISCARDEDNEW", store.StatusDiscarded, old, &recent, nil)
+	// Released without Reviewed is not purged
+	mail("RELEASEDONLY", store.StatusReleased, old, nil, &old)
+
+	for file, mtime := range map[string]time.Time{"ORPHANOLD": old, "ORPHANNEW": recent} {
+		if err := ioutil.WriteFile(path.Join(dir, file), []byte("hi"), 0600); err != nil {
+			t.Fatal(err)
+		}
+		os.Chtimes(path.Join(dir, file), mtime, mtime)
+	}
+
+	JanitorRun(now)
+
+	statuses := map[string]store.Status{
+		"HELDOLD":      store.StatusExpired,
+		"HELDNEW":      store.StatusHeld,
+		"RELEASEDOLD":  "",
+		"DISCARDEDNEW": store.StatusDiscarded,
+		"RELEASEDONLY": store.StatusReleased,
+	}
+	for queue, status := range statuses {
+		if m := RepoFindQueue(queue); m.Status != status {
+			t.Errorf("%s: status %q, want %q", queue, m.Status, status)
+		}
+	}
+	files := map[string]bool{
+		"HELDOLD":      false,
+		"HELDNEW":      true,
+		"RELEASEDOLD":  false,
+		"DISCARDEDNEW": true,
+		"RELEASEDONLY": true,
+		"ORPHANOLD":    false,
+		"ORPHANNEW":    true,
+	}
+	for file, kept := range files {
+		if _, err := os.Stat(path.Join(dir, file)); (err == nil) != kept {
+			t.Errorf("%s: kept %v, want %v", file, err == nil, kept)
+		}
+	}
+
+	var got []string
+	for _, e := range audits {
+		got = append(got, e.Actor+" "+e.Action+" "+e.Queue+" "+e.Outcome)
+	}
+	want := []string{
+		"janitor discard HELDOLD expired",
+		"janitor purge RELEASEDOLD released",
+		"janitor discard ORPHANOLD orphan",
+	}
+	if len(got) != len(want) {
+		t.Fatalf("audit log: %q, want %q", got, want)
+	}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Errorf("audit log %d: %q, want %q", i, got[i], want[i])
+		}
+	}
+	if broken, err := AuditVerifyChain(); broken != 0 || err != nil {
+		t.Errorf("audit chain broken at %d: %v", broken, err)
+	}
+}
@@ -13,7 +13,8 @@ func Logger(inner http.Handler, name string) http.Handler {
 		inner.ServeHTTP(w, r)
 
 		log.Printf(
-			"%s\t%s\t%s\t%s",
+			"%s\t%s\t%s\t%s\t%s",
+			requestId(r),
 			r.Method,
 			r.RequestURI,
 			name,
@@ -0,0 +1,16 @@
+package main
+
+import "github.com/wolfedale/go-proxy-mail/internal/store"
+
+/*
+  Mail structure is shared with the filter
+*/
+type Mail = store.Mail
+
+/*
+  Mails - is a slice of []Mail struct
+  This is needed as we are going to create
+  more then one e-mail and keep all of them
+  in the same struct
+*/
+type Mails []Mail
@@ -0,0 +1,118 @@
+/*
+
+ Pawel Grzesik, 2017
+ pawel.grzesik
+
+ It's a really easy and fast implementation of API
+ for mailProxy and DLP purposes.
+
+ Versioned API is under /api/v1, see /api/v1/openapi.json.
+ Old routes are kept for the filter and scripts.
+
+ We can:
+ - GET / to check the dashboard
+ - GET /mails to list all blocked emails
+ - GET /mails/{mailId} to get some details about one email
+ - POST /mails to add email to blocked list
+ - POST /mails/bulk to release, discard, bounce or tag many emails
+ - DELETE /mails/{mailId} to delete e-mail from blocked list
+ - GET /events to get live changes (Server-Sent Events)
+ - GET /audit to list audit log (?format=csv for export)
+ - GET /audit/verify to check the audit log hash chain
+ - GET /api/v1/policy to show the filter policy
+
+With api.users (see users.go) everything except the static
+files needs a user or the bearer token, logins are in the
+audit log.
+
+Dashboard/API is listening on port 8080 - in default
+
+Templates and static files are built into the binary,
+-templates ./templates is reading them from the disk
+on every request (for development).
+*/
+
+package main
+
+import (
+	"flag"
+	"log"
+	"net/http"
+
+	"github.com/wolfedale/go-proxy-mail/internal/store"
+)
+
+/*
+  constant for the path where we are going to keep
+  our blocked e-mails
+*/
+const QUEUEDIR string = store.QUEUEDIR
+
+/*
+  queueDir is QUEUEDIR, tests are using a temporary directory
+*/
+var queueDir = QUEUEDIR
+
+/*
+  here we are starting our API
+*/
+func main() {
+	templates := flag.String("templates", "", "read templates from this directory instead of the binary")
+	flag.Parse()
+
+	// templates are parsed once, broken template is stopping us here
+	if err := LoadTemplates(*templates); err != nil {
+		log.Fatal("Cannot parse templates: ", err)
+	}
+
+	// loading audit log, new entries are chained to the old ones
+	if err := AuditOpen(); err != nil {
+		log.Fatal("Cannot read audit log: ", err)
+	}
+	// changed audit log has to be checked before we write to it
+	if broken, err := AuditVerifyChain(); err != nil {
+		log.Fatal("Cannot verify audit log: ", err)
+	} else if broken > 0 {
+		log.Fatalf("Audit log chain broken at entry %d", broken)
+	}
+
+	// token for adding e-mails and users of the dashboard
+	if err := LoadToken(); err != nil {
+		log.Fatal("Cannot read API token: ", err)
+	}
+	if err := LoadUsers(APIUSERSFILE); err != nil {
+		log.Fatal("Cannot read API users: ", err)
+	}
+	if len(apiUsers) > 0 && apiToken == "" {
+		log.Println("API users without " + APITOKENFILE + ", filter can't add e-mails")
+	}
+
+	// spool is the source of truth, filter is writing
+	// sidecar metadata next to every blocked e-mail
+	if err := ScanQueue(); err != nil {
+		log.Println("Cannot scan queue: ", err)
+	}
+	if err := WatchQueue(); err != nil {
+		log.Println("Cannot watch queue: ", err)
+	}
+
+	// enforcing retention policy in the background
+	go Janitor()
+
+	// creating new router using mux
+	router := NewRouter()
+
+	// giving access to CSS, JS, fonts and QUEUE dir
+	http.Handle("/css/", http.StripPrefix("/css/", StaticHandler("css")))
+	http.Handle("/js/", http.StripPrefix("/js/", StaticHandler("js")))
+	http.Handle("/fonts/", http.StripPrefix("/fonts/", StaticHandler("fonts")))
+
+	qHandler := http.FileServer(http.Dir(queueDir))
+	http.Handle("/queue/", http.StripPrefix("/queue/", Authenticate(AuditRaw(qHandler))))
+
+	http.Handle("/", router)
+
+	//Fatal is equivalent to Print() followed by a call to os.Exit(1).
+	//log.Fatal(http.ListenAndServe(":8080", router))
+	log.Fatal(http.ListenAndServe(":8080", nil))
+}
@@ -0,0 +1,180 @@
+package main
+
+import (
+	"net/http"
+	"reflect"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+/*
+  APIPREFIX: all versioned routes are under this path
+  APIVERSION: version in the OpenAPI document
+*/
+const APIPREFIX string = "/api/v1"
+const APIVERSION string = "1.0.0"
+
+/*
+  ApiRoute is a Route with everything we need for the spec
+  Summary: one line about the route
+  Query: names of the query parameters
+  Request: example value of the request body, nil for none
+  Responses: example value of the response body per status code
+*/
+type ApiRoute struct {
+	Route
+	Summary   string
+	Query     []string
+	Request   interface{}
+	Responses map[int]interface{}
+}
+
+type ApiRoutes []ApiRoute
+
+var pathParam = regexp.MustCompile(`{([^}:]+)(:[^}]+)?}`)
+
+/*
+  Build OpenAPI 3 document from the apiRoutes table,
+  schemas are generated from the Go types.
+*/
+func OpenAPISpec() map[string]interface{} {
+	schemas := map[string]interface{}{}
+	paths := map[string]interface{}{}
+
+	for _, route := range apiRoutes {
+		p := APIPREFIX + pathParam.ReplaceAllString(route.Pattern, "{$1}")
+		item, ok := paths[p].(map[string]interface{})
+		if !ok {
+			item = map[string]interface{}{}
+			paths[p] = item
+		}
+
+		var params []interface{}
+		for _, m := range pathParam.FindAllStringSubmatch(route.Pattern, -1) {
+			params = append(params, map[string]interface{}{
+				"name":     m[1],
+				"in":       "path",
+				"required": true,
+				"schema":   map[string]interface{}{"type": "integer"},
+			})
+		}
+		for _, q := range route.Query {
+			params = append(params, map[string]interface{}{
+				"name":   q,
+				"in":     "query",
+				"schema": map[string]interface{}{"type": "string"},
+			})
+		}
+
+		op := map[string]interface{}{
+			"operationId": route.Name,
+			"summary":     route.Summary,
+		}
+		if len(params) > 0 {
+			op["parameters"] = params
+		}
+		if route.Request != nil {
+			op["requestBody"] = map[string]interface{}{
+				"required": true,
+				"content": map[string]interface{}{
+					"application/json": map[string]interface{}{
+						"schema": schemaOf(reflect.TypeOf(route.Request), schemas),
+					},
+				},
+			}
+		}
+
+		responses := map[string]interface{}{}
+		for code, body := range route.Responses {
+			responses[strconv.Itoa(code)] = map[string]interface{}{
+				"description": http.StatusText(code),
+				"content": map[string]interface{}{
+					"application/json": map[string]interface{}{
+						"schema": schemaOf(reflect.TypeOf(body), schemas),
+					},
+				},
+			}
+		}
+		op["responses"] = responses
+
+		item[strings.ToLower(route.Method)] = op
+	}
+
+	return map[string]interface{}{
+		"openapi": "3.0.3",
+		"info": map[string]interface{}{
+			"title":   "mailProxy API",
+			"version": APIVERSION,
+		},
+		"paths":      paths,
+		"components": map[string]interface{}{"schemas": schemas},
+	}
+}
+
+/*
+  Return JSON schema of the Go type. Structs are added
+  to components and returned as a $ref.
+*/
+func schemaOf(t reflect.Type, schemas map[string]interface{}) map[string]interface{} {
+	if t == reflect.TypeOf(time.Time{}) {
+		return map[string]interface{}{"type": "string", "format": "date-time"}
+	}
+
+	switch t.Kind() {
+	case reflect.Ptr:
+		return schemaOf(t.Elem(), schemas)
+	case reflect.String:
+		return map[string]interface{}{"type": "string"}
+	case reflect.Bool:
+		return map[string]interface{}{"type": "boolean"}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return map[string]interface{}{"type": "integer"}
+	case reflect.Float32, reflect.Float64:
+		return map[string]interface{}{"type": "number"}
+	case reflect.Slice, reflect.Array:
+		return map[string]interface{}{"type": "array", "items": schemaOf(t.Elem(), schemas)}
+	case reflect.Map:
+		return map[string]interface{}{"type": "object", "additionalProperties": schemaOf(t.Elem(), schemas)}
+	case reflect.Struct:
+		name := t.Name()
+		ref := map[string]interface{}{"$ref": "#/components/schemas/" + name}
+		if _, ok := schemas[name]; ok {
+			return ref
+		}
+		// placeholder, so recursive types are not looping forever
+		schemas[name] = map[string]interface{}{}
+
+		props := map[string]interface{}{}
+		for i := 0; i < t.NumField(); i++ {
+			f := t.Field(i)
+			if f.PkgPath != "" {
+				continue
+			}
+			tag := strings.Split(f.Tag.Get("json"), ",")[0]
+			if tag == "-" {
+				continue
+			}
+			if tag == "" {
+				tag = f.Name
+			}
+			props[tag] = schemaOf(f.Type, schemas)
+		}
+		schemas[name] = map[string]interface{}{
+			"type":       "object",
+			"properties": props,
+		}
+		return ref
+	}
+	return map[string]interface{}{}
+}
+
+/*
+  OpenAPI returns the spec:
+  curl http://localhost:8080/api/v1/openapi.json
+*/
+func OpenAPI(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, OpenAPISpec())
+}
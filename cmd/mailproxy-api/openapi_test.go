@@ -0,0 +1,299 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/wolfedale/go-proxy-mail/internal/store"
+)
+
+/*
+  One request of the contract test
+  Route: name of the route in apiRoutes
+  Status: status we are expecting
+*/
+type contractCase struct {
+	Route  string
+	Method string
+	Path   string
+	Body   string
+	Status int
+}
+
+var contractCases = []contractCase{
+	{"ApiMailIndex", "GET", "/mails", "", 200},
+	{"ApiMailIndex", "GET", "/mails?sort=-date&limit=1", "", 200},
+	{"ApiMailIndex", "GET", "/mails?limit=abc", "", 400},
+	{"ApiMailCreate", "POST", "/mails", `{"sender":"a@foobar.org","recipients":["b@example.com"],"queue":"CONTRACTNEW1"}`, 201},
+	{"ApiMailCreate", "POST", "/mails", `{"sender":"a@foobar.org","recipients":["b@example.com"],"queue":"CONTRACTNEW1"}`, 200},
+	{"ApiMailCreate", "POST", "/mails", `{"sender":"","recipients":["b@example.com"],"queue":"CONTRACTBOUNCE1"}`, 201},
+	{"ApiMailCreate", "POST", "/mails", `{"sender":"a"}`, 422},
+	{"ApiMailCreate", "POST", "/mails", `{"sender":"a@foobar.org","recipients":["b@example.com"],"queue":"CONTRACT0"}`, 422},
+	{"ApiMailCreate", "POST", "/mails", `{"sender":"a@foobar.org","recipients":["b@example.com"],"queue":"../CONTRACT"}`, 422},
+	{"ApiMailCreate", "POST", "/mails", `{"sender":"a@foobar.org","recipients":["b@example.com"],"queue":"CONTRACTNEW2","status":"released"}`, 422},
+	{"ApiMailCreate", "POST", "/mails", `{`, 422},
+	{"ApiMailShow", "GET", "/mails/1", "", 200},
+	{"ApiMailShow", "GET", "/mails/999", "", 404},
+	{"ApiMailBulk", "POST", "/mails/bulk", `{"ids":[1],"action":"tag","tag":"seen"}`, 200},
+	{"ApiMailBulk", "POST", "/mails/bulk", `{"ids":[1,999],"action":"tag","tag":"seen"}`, 207},
+	{"ApiMailBulk", "POST", "/mails/bulk", `{"ids":[1]}`, 422},
+	{"ApiMailDiscard", "POST", "/mails/1/discard", "", 200},
+	{"ApiMailDiscard", "POST", "/mails/1/discard", "", 409},
+	{"ApiMailRelease", "POST", "/mails/999/release", "", 404},
+	{"ApiMailRelease", "POST", "/mails/2/release", "", 409},
+	{"ApiMailBounce", "POST", "/mails/999/bounce", "", 404},
+	{"ApiMailBounce", "POST", "/mails/2/bounce", "", 409},
+	{"ApiMailBounce", "POST", "/mails/3/bounce", "", 409},
+	{"ApiPolicyShow", "GET", "/policy", "", 200},
+	{"ApiAuditIndex", "GET", "/audit?action=discard", "", 200},
+	{"ApiAuditVerify", "GET", "/audit/verify", "", 200},
+}
+
+/*
+  Repo with two held (one from the null sender) and one
+  released e-mail, queue, audit log and policy in a
+  temporary directory
+*/
+func contractSetup(t *testing.T) {
+	dir := t.TempDir()
+	for file, data := range map[string]string{"CONTRACTHELD1": "Subject: held\n\nheld\n", "policy.json": `{"domains": ["foobar.org"]}`} {
+		if err := ioutil.WriteFile(path.Join(dir, file), []byte(data), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	auditLog = path.Join(dir, "audit.log")
+	queueDir = dir
+	policyFile = path.Join(dir, "policy.json")
+	audits = nil
+	apiToken = ""
+	apiUsers = map[string]string{}
+
+	mails = nil
+	currentId = 0
+	now := time.Now()
+	RepoCreateMail(Mail{Queue: "CONTRACTHELD1", Sender: "a@foobar.org", Recipients: []string{"b@example.com"}, Status: store.StatusHeld})
+	RepoCreateMail(Mail{Queue: "CONTRACTDONE1", Sender: "a@foobar.org", Recipients: []string{"b@example.com"}, Status: store.StatusReleased, Released: &now})
+	RepoCreateMail(Mail{Queue: "CONTRACTNULL1", Sender: "", Recipients: []string{"b@example.com"}, Status: store.StatusHeld})
+}
+
+func TestContract(t *testing.T) {
+	contractSetup(t)
+	spec := OpenAPISpec()
+	router := NewRouter()
+
+	tested := map[string]bool{}
+	for _, c := range contractCases {
+		route, ok := apiRouteByName(c.Route)
+		if !ok {
+			t.Fatalf("%s: no such route", c.Route)
+		}
+		tested[c.Route] = true
+		name := c.Method + " " + c.Path
+
+		if route.Method != c.Method {
+			t.Errorf("%s: route method is %s", name, route.Method)
+		}
+
+		req := httptest.NewRequest(c.Method, APIPREFIX+c.Path, bytes.NewReader([]byte(c.Body)))
+		rec := httptest.NewRecorder()
+		router.ServeHTTP(rec, req)
+
+		if rec.Code != c.Status {
+			t.Errorf("%s: status %d, want %d: %s", name, rec.Code, c.Status, rec.Body.String())
+			continue
+		}
+
+		op := specOperation(t, spec, route)
+		responses := op["responses"].(map[string]interface{})
+		response, ok := responses[strconv.Itoa(rec.Code)].(map[string]interface{})
+		if !ok {
+			t.Errorf("%s: status %d is not in the spec", name, rec.Code)
+			continue
+		}
+		if ct := rec.Header().Get("Content-Type"); !strings.HasPrefix(ct, "application/json") {
+			t.Errorf("%s: Content-Type %q", name, ct)
+			continue
+		}
+		schema := response["content"].(map[string]interface{})["application/json"].(map[string]interface{})["schema"].(map[string]interface{})
+
+		var v interface{}
+		if err := json.Unmarshal(rec.Body.Bytes(), &v); err != nil {
+			t.Errorf("%s: body is not JSON: %v", name, err)
+			continue
+		}
+		for _, problem := range matchSchema(spec, schema, v, "body") {
+			t.Errorf("%s: %s", name, problem)
+		}
+	}
+
+	for _, route := range apiRoutes {
+		if !tested[route.Name] {
+			t.Errorf("%s has no contract test", route.Name)
+		}
+	}
+	if _, err := os.Stat(path.Join(queueDir, "CONTRACTHELD1")); !os.IsNotExist(err) {
+		t.Errorf("discarded e-mail is in the queue: %v", err)
+	}
+	if m := RepoFindMail(3); m.Status != store.StatusHeld {
+		t.Errorf("e-mail from the null sender is %s after bounce", m.Status)
+	}
+}
+
+func TestContractPolicyMissing(t *testing.T) {
+	contractSetup(t)
+	os.Remove(policyFile)
+	rec := httptest.NewRecorder()
+	NewRouter().ServeHTTP(rec, httptest.NewRequest("GET", APIPREFIX+"/policy", nil))
+	if rec.Code != http.StatusNotFound {
+		t.Errorf("status %d, want 404", rec.Code)
+	}
+}
+
+/*
+  Every versioned route of the router is in the spec
+*/
+func TestContractRoutes(t *testing.T) {
+	spec := OpenAPISpec()
+	paths := spec["paths"].(map[string]interface{})
+	err := NewRouter().Walk(func(r *mux.Route, router *mux.Router, ancestors []*mux.Route) error {
+		tpl, err := r.GetPathTemplate()
+		if err != nil || !strings.HasPrefix(tpl, APIPREFIX+"/") || tpl == APIPREFIX+"/openapi.json" {
+			return nil
+		}
+		methods, _ := r.GetMethods()
+		p := pathParam.ReplaceAllString(tpl, "{$1}")
+		for _, m := range methods {
+			item, _ := paths[p].(map[string]interface{})
+			if _, ok := item[strings.ToLower(m)]; !ok {
+				t.Errorf("%s %s is not in the spec", m, p)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestContractOpenAPI(t *testing.T) {
+	rec := httptest.NewRecorder()
+	NewRouter().ServeHTTP(rec, httptest.NewRequest("GET", APIPREFIX+"/openapi.json", nil))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("status %d", rec.Code)
+	}
+	var v map[string]interface{}
+	if err := json.Unmarshal(rec.Body.Bytes(), &v); err != nil || v["openapi"] == nil {
+		t.Fatalf("not an OpenAPI document: %v", err)
+	}
+}
+
+func apiRouteByName(name string) (ApiRoute, bool) {
+	for _, r := range apiRoutes {
+		if r.Name == name {
+			return r, true
+		}
+	}
+	return ApiRoute{}, false
+}
+
+func specOperation(t *testing.T, spec map[string]interface{}, route ApiRoute) map[string]interface{} {
+	p := APIPREFIX + pathParam.ReplaceAllString(route.Pattern, "{$1}")
+	item, ok := spec["paths"].(map[string]interface{})[p].(map[string]interface{})
+	if !ok {
+		t.Fatalf("%s: %s is not in the spec", route.Name, p)
+	}
+	op, ok := item[strings.ToLower(route.Method)].(map[string]interface{})
+	if !ok {
+		t.Fatalf("%s: %s %s is not in the spec", route.Name, route.Method, p)
+	}
+	return op
+}
+
+/*
+  Check decoded JSON value against the schema of the spec,
+  returns the problems found. Fields which are not in the
+  schema are problems too.
+*/
+func matchSchema(spec, schema map[string]interface{}, v interface{}, at string) []string {
+	if ref, ok := schema["$ref"].(string); ok {
+		name := strings.TrimPrefix(ref, "#/components/schemas/")
+		schemas := spec["components"].(map[string]interface{})["schemas"].(map[string]interface{})
+		s, ok := schemas[name].(map[string]interface{})
+		if !ok {
+			return []string{at + ": unknown " + ref}
+		}
+		return matchSchema(spec, s, v, at)
+	}
+
+	typ, _ := schema["type"].(string)
+	if v == nil {
+		// nil slices, maps and pointers
+		if typ == "array" || typ == "object" || typ == "" {
+			return nil
+		}
+		return []string{at + ": null for " + typ}
+	}
+
+	var problems []string
+	switch typ {
+	case "object":
+		obj, ok := v.(map[string]interface{})
+		if !ok {
+			return []string{at + ": not an object"}
+		}
+		props, _ := schema["properties"].(map[string]interface{})
+		extra, _ := schema["additionalProperties"].(map[string]interface{})
+		for k, fv := range obj {
+			if p, ok := props[k].(map[string]interface{}); ok {
+				problems = append(problems, matchSchema(spec, p, fv, at+"."+k)...)
+			} else if extra != nil {
+				problems = append(problems, matchSchema(spec, extra, fv, at+"."+k)...)
+			} else {
+				problems = append(problems, at+"."+k+": not in the schema")
+			}
+		}
+	case "array":
+		list, ok := v.([]interface{})
+		if !ok {
+			return []string{at + ": not an array"}
+		}
+		items, _ := schema["items"].(map[string]interface{})
+		for i, iv := range list {
+			problems = append(problems, matchSchema(spec, items, iv, at+"["+strconv.Itoa(i)+"]")...)
+		}
+	case "string":
+		s, ok := v.(string)
+		if !ok {
+			return []string{at + ": not a string"}
+		}
+		if schema["format"] == "date-time" {
+			if _, err := time.Parse(time.RFC3339Nano, s); err != nil {
+				problems = append(problems, at+": not a date-time")
+			}
+		}
+	case "integer":
+		if f, ok := v.(float64); !ok || f != math.Trunc(f) {
+			problems = append(problems, at+": not an integer")
+		}
+	case "number":
+		if _, ok := v.(float64); !ok {
+			problems = append(problems, at+": not a number")
+		}
+	case "boolean":
+		if _, ok := v.(bool); !ok {
+			problems = append(problems, at+": not a boolean")
+		}
+	}
+	return problems
+}
@@ -0,0 +1,33 @@
+package main
+
+import (
+	"io/ioutil"
+	"net/http"
+	"os"
+
+	"github.com/wolfedale/go-proxy-mail/internal/policy"
+)
+
+/*
+  policyFile is policy.POLICYFILE, tests are using a temporary file
+*/
+var policyFile = policy.POLICYFILE
+
+/*
+  PolicyShow returns the policy file of the filter:
+  curl http://localhost:8080/api/v1/policy
+*/
+func PolicyShow(w http.ResponseWriter, r *http.Request) {
+	data, err := ioutil.ReadFile(policyFile)
+	if os.IsNotExist(err) {
+		writeError(w, r, http.StatusNotFound, "No policy file, built in policy is used")
+		return
+	}
+	if err != nil {
+		writeError(w, r, http.StatusInternalServerError, "Cannot read policy: "+err.Error())
+		return
+	}
+	w.Header().Set("Content-Type", "application/json; charset=UTF-8")
+	w.WriteHeader(http.StatusOK)
+	w.Write(data)
+}
@@ -0,0 +1,229 @@
+package main
+
+import (
+	"encoding/base64"
+	"fmt"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/wolfedale/go-proxy-mail/internal/store"
+)
+
+/*
+  Default and max number of e-mails on one page
+*/
+const PAGELIMIT int = 100
+const PAGEMAX int = 1000
+
+/*
+  MailQuery structure, built from the URL query:
+  sender, senderheader, recipient, rule: substring match
+  status: held, released, discarded, expired or bounced
+  q: free-text search in the subject
+  since, until: date range (2006-01-02 or RFC3339)
+  sort: id, date, sender, senderheader, recipient, rule, status, subject
+        with "-" prefix for descending order
+  cursor: returned in X-Next-Cursor header by the previous page
+  limit: page size
+*/
+type MailQuery struct {
+	Sender       string
+	SenderHeader string
+	Recipient    string
+	Rule         string
+	Status       string
+	Text         string
+	Since        time.Time
+	Until        time.Time
+	Sort         string
+	Desc         bool
+	Cursor       string
+	Limit        int
+}
+
+/*
+  Read MailQuery from the URL query
+*/
+func ParseMailQuery(v url.Values) (MailQuery, error) {
+	q := MailQuery{
+		Sender:       v.Get("sender"),
+		SenderHeader: v.Get("senderheader"),
+		Recipient:    v.Get("recipient"),
+		Rule:         v.Get("rule"),
+		Status:       v.Get("status"),
+		Text:         v.Get("q"),
+		Sort:         v.Get("sort"),
+		Cursor:       v.Get("cursor"),
+		Limit:        PAGELIMIT,
+	}
+
+	if _, _, ok := decodeCursor(q.Cursor); q.Cursor != "" && !ok {
+		return q, fmt.Errorf("cursor is not valid")
+	}
+
+	if q.Status != "" && !store.Status(q.Status).Valid() {
+		return q, fmt.Errorf("status must be one of %v", store.Statuses)
+	}
+
+	if strings.HasPrefix(q.Sort, "-") {
+		q.Desc = true
+		q.Sort = q.Sort[1:]
+	}
+	if q.Sort == "" {
+		q.Sort = "id"
+	}
+	if _, ok := sortKeys[q.Sort]; !ok {
+		return q, fmt.Errorf("cannot sort by %q", q.Sort)
+	}
+
+	var err error
+	if s := v.Get("since"); s != "" {
+		if q.Since, err = parseDate(s); err != nil {
+			return q, fmt.Errorf("since: %v", err)
+		}
+	}
+	if s := v.Get("until"); s != "" {
+		if q.Until, err = parseDate(s); err != nil {
+			return q, fmt.Errorf("until: %v", err)
+		}
+	}
+
+	if s := v.Get("limit"); s != "" {
+		if q.Limit, err = strconv.Atoi(s); err != nil || q.Limit < 1 {
+			return q, fmt.Errorf("limit must be a positive number")
+		}
+		if q.Limit > PAGEMAX {
+			q.Limit = PAGEMAX
+		}
+	}
+	return q, nil
+}
+
+/*
+  Date can be a day or full RFC3339 time
+*/
+func parseDate(s string) (time.Time, error) {
+	if t, err := time.Parse(time.RFC3339, s); err == nil {
+		return t, nil
+	}
+	return time.ParseInLocation("2006-01-02", s, time.Local)
+}
+
+/*
+  sortKeys returns string used for sorting, ids and dates
+  are formatted so string order is the same as real order
+*/
+var sortKeys = map[string]func(Mail) string{
+	"id":           func(m Mail) string { return fmt.Sprintf("%012d", m.Id) },
+	"date":         func(m Mail) string { return m.Received.UTC().Format("2006-01-02T15:04:05.000000000") },
+	"sender":       func(m Mail) string { return strings.ToLower(m.Sender) },
+	"senderheader": func(m Mail) string { return strings.ToLower(m.SenderHeader) },
+	"recipient":    func(m Mail) string { return strings.ToLower(m.Recipient()) },
+	"rule":         func(m Mail) string { return m.Rule },
+	"status":       func(m Mail) string { return string(m.Status) },
+	"subject":      func(m Mail) string { return strings.ToLower(m.Subject) },
+}
+
+/*
+  Check if e-mail is matching all the filters
+*/
+func (q MailQuery) Match(m Mail) bool {
+	if !containsFold(m.Sender, q.Sender) ||
+		!containsFold(m.SenderHeader, q.SenderHeader) ||
+		!containsFold(m.Recipient(), q.Recipient) ||
+		!containsFold(m.Rule, q.Rule) ||
+		!containsFold(m.Subject, q.Text) {
+		return false
+	}
+	if q.Status != "" && q.Status != string(m.Status) {
+		return false
+	}
+	if !q.Since.IsZero() && m.Received.Before(q.Since) {
+		return false
+	}
+	if !q.Until.IsZero() && !m.Received.Before(q.Until) {
+		return false
+	}
+	return true
+}
+
+func containsFold(s, substr string) bool {
+	return strings.Contains(strings.ToLower(s), strings.ToLower(substr))
+}
+
+/*
+  Run query on the list of e-mails, returns one page
+  and the cursor for the next one ("" for the last page)
+*/
+func (q MailQuery) Run(list Mails) (Mails, string) {
+	key := sortKeys[q.Sort]
+
+	var found Mails
+	for _, m := range list {
+		if q.Match(m) {
+			found = append(found, m)
+		}
+	}
+
+	// id as a second key, so order is always the same
+	less := func(a, b Mail) bool {
+		ka, kb := key(a), key(b)
+		if ka != kb {
+			return ka < kb
+		}
+		return a.Id < b.Id
+	}
+	sort.Slice(found, func(i, j int) bool {
+		if q.Desc {
+			return less(found[j], found[i])
+		}
+		return less(found[i], found[j])
+	})
+
+	// skipping everything up to the cursor
+	if q.Cursor != "" {
+		if ck, cid, ok := decodeCursor(q.Cursor); ok {
+			i := sort.Search(len(found), func(i int) bool {
+				k := key(found[i])
+				if k == ck {
+					return (!q.Desc && found[i].Id > cid) || (q.Desc && found[i].Id < cid)
+				}
+				return (!q.Desc && k > ck) || (q.Desc && k < ck)
+			})
+			found = found[i:]
+		}
+	}
+
+	if len(found) <= q.Limit {
+		return found, ""
+	}
+	page := found[:q.Limit]
+	last := page[len(page)-1]
+	return page, encodeCursor(key(last), last.Id)
+}
+
+/*
+  Cursor is a sort key and id of the last e-mail on the page
+*/
+func encodeCursor(key string, id int) string {
+	return base64.RawURLEncoding.EncodeToString([]byte(key + "\x00" + strconv.Itoa(id)))
+}
+
+func decodeCursor(cursor string) (string, int, bool) {
+	b, err := base64.RawURLEncoding.DecodeString(cursor)
+	if err != nil {
+		return "", 0, false
+	}
+	parts := strings.SplitN(string(b), "\x00", 2)
+	if len(parts) != 2 {
+		return "", 0, false
+	}
+	id, err := strconv.Atoi(parts[1])
+	if err != nil {
+		return "", 0, false
+	}
+	return parts[0], id, true
+}
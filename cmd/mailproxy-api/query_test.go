@@ -0,0 +1,100 @@
+package main
+
+import (
+	"fmt"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/wolfedale/go-proxy-mail/internal/store"
+)
+
+func queryMails() Mails {
+	var list Mails
+	start := time.Date(2026, 10, 1, 12, 0, 0, 0, time.UTC)
+	for i := 1; i <= 25; i++ {
+		list = append(list, Mail{
+			Id:         i,
+			Queue:      fmt.Sprintf("Q%d", i),
+			Sender:     fmt.Sprintf("user%d@foobar.org", i%4),
+			Recipients: []string{"b@example.com"},
+			Status:     store.StatusHeld,
+			// the same date for pairs of e-mails
+			Received: start.Add(time.Duration(i/2) * time.Minute),
+		})
+	}
+	return list
+}
+
+/*
+  Pages read with the cursors have every e-mail once
+  and in the same order as one big page
+*/
+func TestCursorRoundTrip(t *testing.T) {
+	list := queryMails()
+	for _, sort := range []string{"id", "-id", "date", "-date", "sender", "-sender"} {
+		q, err := ParseMailQuery(url.Values{"sort": {sort}, "limit": {"1000"}})
+		if err != nil {
+			t.Fatal(err)
+		}
+		all, next := q.Run(list)
+		if len(all) != len(list) || next != "" {
+			t.Fatalf("%s: %d e-mails, cursor %q", sort, len(all), next)
+		}
+
+		var paged Mails
+		cursor := ""
+		for pages := 0; ; pages++ {
+			if pages > len(list) {
+				t.Fatalf("%s: cursor is not moving", sort)
+			}
+			q, err := ParseMailQuery(url.Values{"sort": {sort}, "limit": {"4"}, "cursor": {cursor}})
+			if err != nil {
+				t.Fatalf("%s: %v", sort, err)
+			}
+			page, next := q.Run(list)
+			paged = append(paged, page...)
+			if next == "" {
+				break
+			}
+			cursor = next
+		}
+		if len(paged) != len(all) {
+			t.Fatalf("%s: %d e-mails in pages, want %d", sort, len(paged), len(all))
+		}
+		for i := range all {
+			if paged[i].Id != all[i].Id {
+				t.Errorf("%s: e-mail %d is %d, want %d", sort, i, paged[i].Id, all[i].Id)
+				break
+			}
+		}
+	}
+}
+
+func TestCursorTampered(t *testing.T) {
+	bad := []string{
+		"!!!",
+		encodeCursor("000000000005", 5) + "=",
+		"eA",                      // "x", no id
+		"MDAwMDAwMDAwMDA1AGZpdmU", // id is not a number
+	}
+	for _, c := range bad {
+		if _, err := ParseMailQuery(url.Values{"cursor": {c}}); err == nil {
+			t.Errorf("%q: accepted", c)
+		}
+	}
+
+	// cursor changed by hand but well formed is only a position
+	q, err := ParseMailQuery(url.Values{"limit": {"5"}, "cursor": {encodeCursor(fmt.Sprintf("%012d", 20), 20)}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	page, next := q.Run(queryMails())
+	if len(page) != 5 || page[0].Id != 21 || next != "" {
+		t.Errorf("page after 20: %d e-mails from %d, cursor %q", len(page), page[0].Id, next)
+	}
+	q, _ = ParseMailQuery(url.Values{"cursor": {encodeCursor("zzz", 0)}})
+	if page, _ := q.Run(queryMails()); len(page) != 0 {
+		t.Errorf("page after the end: %d e-mails", len(page))
+	}
+}
@@ -0,0 +1,163 @@
+package main
+
+import "fmt"
+import "sync"
+import "time"
+
+import "github.com/wolfedale/go-proxy-mail/internal/store"
+
+/*
+  mu is guarding mails and currentId, API handlers
+  and janitor are using them at the same time
+*/
+var mu sync.Mutex
+
+/*
+  stateMu is held for the whole change of the e-mail state:
+  check of the status, the action and the new status. Handlers,
+  janitor and watcher are taking it, so they can't release and
+  expire the same e-mail at the same time. It's taken before mu.
+*/
+var stateMu sync.Mutex
+
+var currentId int
+
+var mails Mails
+
+/*
+  Find e-mail in our struct
+*/
+func RepoFindMail(id int) Mail {
+	mu.Lock()
+	defer mu.Unlock()
+	for _, t := range mails {
+		if t.Id == id {
+			return t
+		}
+	}
+	// return empty Mail if not found
+	return Mail{}
+}
+
+/*
+  Add e-mail to blocked list
+*/
+func RepoCreateMail(t Mail) Mail {
+	mu.Lock()
+	defer mu.Unlock()
+	return repoCreateMail(t)
+}
+
+func repoCreateMail(t Mail) Mail {
+	currentId += 1
+	t.Id = currentId
+
+	// filter is setting Received, old clients are not
+	if t.Received.IsZero() {
+		t.Received = time.Now()
+	}
+	if t.Status == "" {
+		t.Status = store.StatusHeld
+	}
+
+	mails = append(mails, t)
+	return t
+}
+
+/*
+  Add e-mail to blocked list only if we don't know its queue yet,
+  the same e-mail can come from the spool watcher and POST /mails.
+  Returns false when e-mail was already there.
+*/
+func RepoIngestMail(t Mail) (Mail, bool) {
+	mu.Lock()
+	defer mu.Unlock()
+	for _, old := range mails {
+		if old.Queue == t.Queue {
+			return old, false
+		}
+	}
+	t = repoCreateMail(t)
+	Publish(EventCreate, t)
+	return t, true
+}
+
+/*
+  Delete e-mail from blocked list
+*/
+func RepoDestroyMail(id int) error {
+	mu.Lock()
+	defer mu.Unlock()
+	for i, t := range mails {
+		if t.Id == id {
+			mails = append(mails[:i], mails[i+1:]...)
+			return nil
+		}
+	}
+	return fmt.Errorf("Could not find Mail with id of %d to delete", id)
+}
+
+/*
+  Return copy of all e-mails from blocked list
+*/
+func RepoMails() Mails {
+	mu.Lock()
+	defer mu.Unlock()
+	list := make(Mails, len(mails))
+	copy(list, mails)
+	return list
+}
+
+/*
+  Find e-mail by the queue name
+*/
+func RepoFindQueue(queue string) Mail {
+	mu.Lock()
+	defer mu.Unlock()
+	for _, t := range mails {
+		if t.Queue == queue {
+			return t
+		}
+	}
+	return Mail{}
+}
+
+/*
+  Add tag to the e-mail, tags are unique
+*/
+func RepoTagMail(id int, tag string) error {
+	mu.Lock()
+	defer mu.Unlock()
+	for i, t := range mails {
+		if t.Id == id {
+			for _, old := range t.Tags {
+				if old == tag {
+					return nil
+				}
+			}
+			mails[i].Tags = append(append([]string{}, t.Tags...), tag)
+			return nil
+		}
+	}
+	return fmt.Errorf("Could not find Mail with id of %d to tag", id)
+}
+
+/*
+  Change status of the e-mail, Reviewed is set to the time
+  of the change, Released only when it's released
+*/
+func RepoSetStatus(id int, status store.Status, when time.Time) (Mail, error) {
+	mu.Lock()
+	defer mu.Unlock()
+	for i, t := range mails {
+		if t.Id == id {
+			mails[i].Status = status
+			mails[i].Reviewed = &when
+			if status == store.StatusReleased {
+				mails[i].Released = &when
+			}
+			return mails[i], nil
+		}
+	}
+	return Mail{}, fmt.Errorf("Could not find Mail with id of %d to update", id)
+}
@@ -0,0 +1,45 @@
+package main
+
+import (
+	"net/http"
+
+	"github.com/gorilla/mux"
+)
+
+func NewRouter() *mux.Router {
+	/* When true, if the route path is "/path/", accessing "/path"
+	   will redirect to the former and vice versa. In other words,
+	   your application will always see the path as specified in the route.
+	   When false, if the route path is "/path", accessing "/path/"
+	   will not match this route and vice versa.
+	*/
+	router := mux.NewRouter().StrictSlash(true)
+	for _, route := range routes {
+		addRoute(router, route)
+	}
+
+	// versioned API and its spec
+	api := router.PathPrefix(APIPREFIX).Subrouter()
+	for _, route := range apiRoutes {
+		addRoute(api, route.Route)
+	}
+	addRoute(api, Route{"ApiOpenAPI", "GET", "/openapi.json", OpenAPI})
+
+	return router
+}
+
+func addRoute(router *mux.Router, route Route) {
+	// logs && logger
+	var handler http.Handler
+	handler = route.HandlerFunc
+	handler = Authenticate(handler)
+	handler = Recovery(handler)
+	handler = Logger(handler, route.Name)
+	handler = RequestId(handler)
+
+	router.
+		Methods(route.Method).
+		Path(route.Pattern).
+		Name(route.Name).
+		Handler(handler)
+}
@@ -0,0 +1,150 @@
+package main
+
+import (
+	"net/http"
+
+	"github.com/wolfedale/go-proxy-mail/internal/policy"
+)
+
+type Route struct {
+	Name        string
+	Method      string
+	Pattern     string
+	HandlerFunc http.HandlerFunc
+}
+
+type Routes []Route
+
+// all our routes, /mails and /audit are kept for the filter
+// and old scripts, new clients should use apiRoutes
+var routes = Routes{
+	Route{
+		"Index",
+		"GET",
+		"/",
+		Index,
+	},
+	Route{
+		"MailIndex",
+		"GET",
+		"/mails",
+		MailIndex,
+	},
+	Route{
+		"MailShow",
+		"GET",
+		"/mails/{mailId}",
+		MailShow,
+	},
+	Route{
+		"MailCreate",
+		"POST",
+		"/mails",
+		RequireToken(MailCreate),
+	},
+	Route{
+		"MailBulk",
+		"POST",
+		"/mails/bulk",
+		MailBulk,
+	},
+	Route{
+		"MailDelete",
+		"DELETE",
+		"/mails/{mailId}",
+		MailDelete,
+	},
+	Route{
+		"Events",
+		"GET",
+		"/events",
+		Events,
+	},
+	Route{
+		"AuditIndex",
+		"GET",
+		"/audit",
+		AuditIndex,
+	},
+	Route{
+		"AuditVerify",
+		"GET",
+		"/audit/verify",
+		AuditVerify,
+	},
+}
+
+// versioned routes, served under APIPREFIX and
+// documented in /api/v1/openapi.json
+var apiRoutes = ApiRoutes{
+	ApiRoute{
+		Route{"ApiMailIndex", "GET", "/mails", MailIndex},
+		"List blocked e-mails, cursor for the next page is in X-Next-Cursor header",
+		[]string{"sender", "senderheader", "recipient", "rule", "status", "q", "since", "until", "sort", "cursor", "limit"},
+		nil,
+		map[int]interface{}{200: Mails{}, 400: jsonErr{}},
+	},
+	ApiRoute{
+		Route{"ApiMailCreate", "POST", "/mails", RequireToken(MailCreate)},
+		"Add e-mail to blocked list, bearer token is required when configured",
+		nil,
+		Mail{},
+		map[int]interface{}{200: Mail{}, 201: Mail{}, 400: jsonErr{}, 401: jsonErr{}, 422: jsonErr{}},
+	},
+	ApiRoute{
+		Route{"ApiMailBulk", "POST", "/mails/bulk", MailBulk},
+		"Release, discard, bounce or tag many e-mails",
+		nil,
+		BulkRequest{},
+		map[int]interface{}{200: BulkResponse{}, 207: BulkResponse{}, 422: jsonErr{}},
+	},
+	ApiRoute{
+		Route{"ApiMailShow", "GET", "/mails/{mailId:[0-9]+}", MailShow},
+		"Show one blocked e-mail",
+		nil,
+		nil,
+		map[int]interface{}{200: Mail{}, 404: jsonErr{}},
+	},
+	ApiRoute{
+		Route{"ApiMailRelease", "POST", "/mails/{mailId:[0-9]+}/release", MailAction(AuditRelease)},
+		"Send blocked e-mail to recipients and remove it from the queue",
+		nil,
+		nil,
+		map[int]interface{}{200: jsonErr{}, 404: jsonErr{}, 409: jsonErr{}, 500: jsonErr{}},
+	},
+	ApiRoute{
+		Route{"ApiMailDiscard", "POST", "/mails/{mailId:[0-9]+}/discard", MailAction(AuditDiscard)},
+		"Remove blocked e-mail without sending it",
+		nil,
+		nil,
+		map[int]interface{}{200: jsonErr{}, 404: jsonErr{}, 409: jsonErr{}, 500: jsonErr{}},
+	},
+	ApiRoute{
+		Route{"ApiMailBounce", "POST", "/mails/{mailId:[0-9]+}/bounce", MailAction(AuditBounce)},
+		"Let sender know that e-mail has been rejected and remove it",
+		nil,
+		nil,
+		map[int]interface{}{200: jsonErr{}, 404: jsonErr{}, 409: jsonErr{}, 500: jsonErr{}},
+	},
+	ApiRoute{
+		Route{"ApiPolicyShow", "GET", "/policy", PolicyShow},
+		"Show the policy file of the filter",
+		nil,
+		nil,
+		map[int]interface{}{200: policy.Policy{}, 404: jsonErr{}, 500: jsonErr{}},
+	},
+	ApiRoute{
+		Route{"ApiAuditIndex", "GET", "/audit", AuditIndex},
+		"List audit log, format=csv for export",
+		[]string{"action", "actor", "queue", "format"},
+		nil,
+		map[int]interface{}{200: AuditEntries{}},
+	},
+	ApiRoute{
+		Route{"ApiAuditVerify", "GET", "/audit/verify", AuditVerify},
+		"Check the audit log hash chain",
+		nil,
+		nil,
+		map[int]interface{}{200: jsonErr{}, 409: jsonErr{}},
+	},
+}
@@ -0,0 +1,98 @@
+/*
+  Live updates of the dashboard, using /events stream.
+  New e-mails are added on top of the table and counted,
+  released/discarded/bounced e-mails are removed.
+*/
+$(document).ready(function () {
+    if (!window.EventSource) {
+        return;
+    }
+
+    var newCount = 0;
+
+    function cell(text) {
+        return $('<td>').text(text === undefined || text === null ? '' : text);
+    }
+
+    function row(mail) {
+        var $tr = $('<tr>').attr('data-id', mail.id).addClass('info');
+        $tr.append($('<td>').append($('<input type="checkbox" class="select-mail">').val(mail.id)));
+        $tr.append(cell(mail.id));
+        $tr.append(cell(mail.sender));
+        var $from = cell(mail.senderheader);
+        if (mail.auth) {
+            $from.append('<br>');
+            $.each([
+                ['spf', mail.auth.spf, [mail.auth.spfdomain, mail.auth.clientip, mail.auth.spfreason].join(' ')],
+                ['dkim', mail.auth.dkim, (mail.auth.dkimdomains || []).join(' ') + (mail.auth.dkimreason || '')],
+                ['dmarc', mail.auth.dmarc, mail.auth.fromdomain + ' p=' + (mail.auth.dmarcpolicy || '')]
+            ], function (i, a) {
+                var label = a[1] == 'pass' ? 'success' : (a[0] == 'dmarc' && a[1] == 'fail' ? 'danger' : 'default');
+                $from.append(' ', $('<span class="label label-' + label + '">').attr('title', a[2]).text(a[0] + ' ' + a[1]));
+            });
+        }
+        $tr.append($from);
+        $tr.append(cell((mail.recipients || []).join(' ')));
+        $tr.append(cell(mail.subject));
+        $tr.append(cell((mail.received || '').replace('T', ' ').substring(0, 19)));
+        $tr.append(cell(mail.status));
+        var $rule = cell(mail.rule);
+        $.each(mail.tags || [], function (i, tag) {
+            $rule.append(' ', $('<span class="label label-info">').text(tag));
+        });
+        $.each(mail.findings || [], function (i, f) {
+            $rule.append(' ', $('<span class="label label-danger">')
+                .attr('title', (f.snippets || []).join('\n'))
+                .text(f.detector + ' (' + f.count + ')'));
+        });
+        if (mail.score || (mail.signals || []).length) {
+            $rule.append(' ', $('<span class="label label-warning">')
+                .attr('title', $.map(mail.signals || [], function (s) {
+                    return s.name + ' ' + s.score + ': ' + s.reason;
+                }).join('\n'))
+                .text('score ' + (mail.score || 0)));
+        }
+        $tr.append($rule);
+        $tr.append($('<td>').append($('<a>').attr('href', 'queue/' + mail.queue).text(mail.queue)));
+        var $send = $('<td>');
+        if (mail.status == 'held') {
+            $send.append($('<button type="button" class="send-button">').attr('data-id', mail.id).text('Send'));
+        }
+        $tr.append($send);
+        return $tr;
+    }
+
+    function removeRow(mail) {
+        $('#mails tr[data-id="' + mail.id + '"]').remove();
+    }
+
+    var source = new EventSource('/events');
+
+    source.addEventListener('create', function (e) {
+        var ev = JSON.parse(e.data);
+        $('#mails').prepend(row(ev.mail));
+        newCount++;
+        $('#new-count').text(newCount);
+    });
+
+    $.each(['release', 'discard', 'bounce', 'remove'], function (i, type) {
+        source.addEventListener(type, function (e) {
+            removeRow(JSON.parse(e.data).mail);
+        });
+    });
+
+    source.addEventListener('tag', function (e) {
+        var mail = JSON.parse(e.data).mail;
+        var $old = $('#mails tr[data-id="' + mail.id + '"]');
+        if ($old.length) {
+            $old.replaceWith(row(mail).removeClass('info'));
+        }
+    });
+
+    $('#new-items').on('click', function (e) {
+        e.preventDefault();
+        newCount = 0;
+        $('#new-count').text(newCount);
+        $('#mails tr.info').removeClass('info');
+    });
+});
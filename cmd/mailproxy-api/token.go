@@ -0,0 +1,48 @@
+package main
+
+import (
+	"crypto/subtle"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"strings"
+)
+
+/*
+  APITOKENFILE: bearer token which the filter has to send
+  when adding e-mails, no token is required when it's missing
+*/
+const APITOKENFILE string = "/var/spool/mailProxy/api.token"
+
+var apiToken string
+
+/*
+  Read the token on startup
+*/
+func LoadToken() error {
+	b, err := ioutil.ReadFile(APITOKENFILE)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	apiToken = strings.TrimSpace(string(b))
+	return nil
+}
+
+/*
+  RequireToken is checking Authorization: Bearer header
+*/
+func RequireToken(inner http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if apiToken != "" {
+			got := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+			if subtle.ConstantTimeCompare([]byte(got), []byte(apiToken)) != 1 {
+				writeError(w, r, http.StatusUnauthorized, "Unauthorized")
+				return
+			}
+		}
+		inner(w, r)
+	}
+}
@@ -0,0 +1,158 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"crypto/subtle"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+/*
+  APIUSERSFILE: users of the dashboard and the API, one
+  "name:bcrypt hash of the password" per line, e.g.
+    pawel.grzesik:$2a$10$RK5QcviuoXi9u02GwMhB2Oy3Jzq3PV4dmfr8TUJY9OHPrhube6D.G
+  hash can be made with: htpasswd -bnBC 10 "" 'password' | tr -d ':\n'
+  When it's missing nobody is authenticated, every request
+  is allowed and written to the audit log as anonymous.
+  With users the filter needs APITOKENFILE to add e-mails.
+*/
+const APIUSERSFILE string = "/var/spool/mailProxy/api.users"
+
+/*
+  Actor of the requests with the bearer token (the filter)
+*/
+const AuditToken string = "token"
+
+var apiUsers = map[string]string{}
+
+/*
+  Compared for the unknown users, so they take
+  as long as the known ones
+*/
+var unknownUser, _ = bcrypt.GenerateFromPassword([]byte("unknown"), bcrypt.DefaultCost)
+
+type actorKey struct{}
+
+/*
+  we are writing only the first login of the user
+  from the address, not every request
+*/
+var loginsMu sync.Mutex
+
+var logins = map[string]bool{}
+
+/*
+  Read the users on startup
+*/
+func LoadUsers(file string) error {
+	f, err := os.Open(file)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	users := map[string]string{}
+	scanner := bufio.NewScanner(f)
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		kv := strings.SplitN(line, ":", 2)
+		if len(kv) != 2 || kv[0] == "" {
+			return fmt.Errorf("%s line %d: must be name:bcrypt hash", file, n)
+		}
+		if _, err := bcrypt.Cost([]byte(kv[1])); err != nil {
+			return fmt.Errorf("%s line %d: not a bcrypt hash: %v", file, n, err)
+		}
+		users[kv[0]] = kv[1]
+	}
+	if err := scanner.Err(); err != nil {
+		return err
+	}
+	apiUsers = users
+	return nil
+}
+
+/*
+  Authenticate is checking who is calling: basic auth user
+  from APIUSERSFILE or the bearer token of the filter. Only
+  this identity is used in the audit log. Wrong password is
+  always written to the audit log, the first login of the
+  user from the address too.
+*/
+func Authenticate(inner http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		actor, code := authenticate(r)
+		if code != http.StatusOK {
+			if code == http.StatusUnauthorized {
+				w.Header().Set("WWW-Authenticate", `Basic realm="mailProxy"`)
+			}
+			writeError(w, r, code, http.StatusText(code))
+			return
+		}
+		inner.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), actorKey{}, actor)))
+	})
+}
+
+func authenticate(r *http.Request) (string, int) {
+	if len(apiUsers) > 0 {
+		if user, password, ok := r.BasicAuth(); ok {
+			if !checkPassword(user, password) {
+				if err := Audit(r, AuditLogin, "", 0, "wrong password for "+user); err != nil {
+					return "", http.StatusInternalServerError
+				}
+				return "", http.StatusUnauthorized
+			}
+			return user, auditLogin(r, user)
+		}
+	}
+
+	got := r.Header.Get("Authorization")
+	if apiToken != "" && strings.HasPrefix(got, "Bearer ") &&
+		subtle.ConstantTimeCompare([]byte(strings.TrimPrefix(got, "Bearer ")), []byte(apiToken)) == 1 {
+		return AuditToken, http.StatusOK
+	}
+
+	// no users, no authentication
+	if len(apiUsers) == 0 {
+		return "", http.StatusOK
+	}
+	return "", http.StatusUnauthorized
+}
+
+func checkPassword(user, password string) bool {
+	want, ok := apiUsers[user]
+	if !ok {
+		bcrypt.CompareHashAndPassword(unknownUser, []byte(password))
+		return false
+	}
+	return bcrypt.CompareHashAndPassword([]byte(want), []byte(password)) == nil
+}
+
+/*
+  Write the first login of the user from the address
+*/
+func auditLogin(r *http.Request, user string) int {
+	key := user + " " + auditIP(r)
+	loginsMu.Lock()
+	defer loginsMu.Unlock()
+	if logins[key] {
+		return http.StatusOK
+	}
+	r = r.WithContext(context.WithValue(r.Context(), actorKey{}, user))
+	if err := Audit(r, AuditLogin, "", 0, "ok"); err != nil {
+		return http.StatusInternalServerError
+	}
+	logins[key] = true
+	return http.StatusOK
+}
@@ -0,0 +1,45 @@
+package main
+
+import (
+	"io/ioutil"
+	"path"
+	"testing"
+)
+
+const passwordHash string = "$2a$10$RK5QcviuoXi9u02GwMhB2Oy3Jzq3PV4dmfr8TUJY9OHPrhube6D.G"
+
+func TestLoadUsers(t *testing.T) {
+	defer func() { apiUsers = map[string]string{} }()
+	file := path.Join(t.TempDir(), "api.users")
+	cases := []struct {
+		name  string
+		users string
+		ok    bool
+	}{
+		{"bcrypt", "# users\npawel.grzesik:" + passwordHash + "\n", true},
+		{"sha256", "pawel.grzesik:5e884898da28047151d0e56f8dc6292773603d0d6aabbdd62a11ef721d1542d8\n", false},
+		{"plain text", "pawel.grzesik:password\n", false},
+		{"no name", ":" + passwordHash + "\n", false},
+	}
+	for _, c := range cases {
+		if err := ioutil.WriteFile(file, []byte(c.users), 0600); err != nil {
+			t.Fatal(err)
+		}
+		if err := LoadUsers(file); (err == nil) != c.ok {
+			t.Errorf("%s: %v", c.name, err)
+		}
+	}
+
+	if err := ioutil.WriteFile(file, []byte("pawel.grzesik:"+passwordHash+"\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := LoadUsers(file); err != nil {
+		t.Fatal(err)
+	}
+	if !checkPassword("pawel.grzesik", "password") {
+		t.Errorf("right password refused")
+	}
+	if checkPassword("pawel.grzesik", "wrong") || checkPassword("nobody", "password") {
+		t.Errorf("wrong password or user accepted")
+	}
+}
@@ -0,0 +1,124 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"log"
+	"os"
+	"path"
+	"strings"
+
+	"github.com/fsnotify/fsnotify"
+	"github.com/wolfedale/go-proxy-mail/internal/store"
+)
+
+/*
+  Actor of the watcher in the audit log
+*/
+const AuditWatcher string = "watcher"
+
+/*
+  Read all sidecars from the queue directory. Spool is the
+  source of truth, so this is how we are getting blocked
+  e-mails back after restart.
+*/
+func ScanQueue() error {
+	files, err := ioutil.ReadDir(queueDir)
+	if err != nil {
+		return err
+	}
+	for _, f := range files {
+		if !f.IsDir() && strings.HasSuffix(f.Name(), store.SIDECAR) {
+			ingest(path.Join(queueDir, f.Name()))
+		}
+	}
+	return nil
+}
+
+/*
+  WatchQueue is running in the background and adding e-mails
+  as soon as the filter is writing the sidecar. When e-mail
+  is removed from the queue by hand it's removed from the repo.
+*/
+func WatchQueue() error {
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		return err
+	}
+	if err := watcher.Add(queueDir); err != nil {
+		watcher.Close()
+		return err
+	}
+
+	go func() {
+		defer watcher.Close()
+		for {
+			select {
+			case event, ok := <-watcher.Events:
+				if !ok {
+					return
+				}
+				name := path.Base(event.Name)
+				switch {
+				case strings.HasSuffix(name, store.SIDECAR) && event.Op&(fsnotify.Create|fsnotify.Write) != 0:
+					ingest(event.Name)
+				case !strings.HasSuffix(name, store.SIDECAR) && event.Op&(fsnotify.Remove|fsnotify.Rename) != 0:
+					stateMu.Lock()
+					if t := RepoFindQueue(name); t.Id > 0 && t.Status == store.StatusHeld {
+						log.Println("Watcher: " + name + " removed from the queue")
+						forget(t)
+						RepoDestroyMail(t.Id)
+						Publish(EventRemove, t)
+						if err := auditWrite(AuditWatcher, "", AuditRemove, t.Queue, t.Id, "removed from the queue"); err != nil {
+							log.Println("Watcher cannot write audit log ("+t.Queue+"): ", err)
+						}
+					}
+					stateMu.Unlock()
+				}
+			case err, ok := <-watcher.Errors:
+				if !ok {
+					return
+				}
+				log.Println("Watcher error: ", err)
+			}
+		}
+	}()
+	return nil
+}
+
+/*
+  Add e-mail from the sidecar file
+*/
+func ingest(file string) {
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		// it could be already released and removed
+		if !os.IsNotExist(err) {
+			log.Println("Watcher cannot read "+file+": ", err)
+		}
+		return
+	}
+
+	var mail Mail
+	if err := json.Unmarshal(data, &mail); err != nil {
+		log.Println("Watcher cannot parse "+file+": ", err)
+		return
+	}
+	if fields := validateMail(mail); len(fields) > 0 {
+		log.Printf("Watcher: %s is not valid: %v", file, fields)
+		return
+	}
+	if strings.TrimSuffix(path.Base(file), store.SIDECAR) != mail.Queue {
+		log.Println("Watcher: " + file + " has different queue " + mail.Queue)
+		return
+	}
+
+	// old sidecars have no time, using time from the spool
+	if fi, err := os.Stat(file); err == nil && mail.Received.IsZero() {
+		mail.Received = fi.ModTime()
+	}
+
+	if t, created := RepoIngestMail(mail); created {
+		log.Println("Watcher: " + t.Queue + " added from the spool")
+	}
+}
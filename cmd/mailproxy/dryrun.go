@@ -0,0 +1,120 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/wolfedale/go-proxy-mail/internal/policy"
+	"github.com/wolfedale/go-proxy-mail/internal/store"
+)
+
+/*
+  Exit code of the dry run when e-mail would be held or
+  rejected, the same as mailproxyctl policy test
+*/
+const DRYRUNBLOCKED int = 5
+
+/*
+  Dry run, checking e-mail from the file the same way as postfix
+  e-mail, but without sendmail, saving it or calling the API:
+  > mailproxy --dry-run [-policy file] [-eml file] sender recipient...
+  > mailproxy --explain [-policy file] [-eml file] sender recipient...
+  --explain is printing every check, e-mail is read from STDIN
+  when -eml is missing.
+*/
+func dryRun(args []string) int {
+	fs := flag.NewFlagSet("mailproxy", flag.ContinueOnError)
+	fs.Bool("dry-run", false, "print the verdict only")
+	explain := fs.Bool("explain", false, "print every check")
+	policyFile := fs.String("policy", policy.POLICYFILE, "policy file, built in policy is used when missing")
+	eml := fs.String("eml", "", "e-mail file, STDIN when missing")
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+	if fs.NArg() < 2 {
+		fmt.Fprintln(os.Stderr, "Usage: mailproxy --dry-run|--explain [-policy file] [-eml file] sender recipient...")
+		return 2
+	}
+	sender := fs.Arg(0)
+	recipients := fs.Args()[1:]
+	if sender != "" && !strings.Contains(sender, "@") {
+		fmt.Fprintln(os.Stderr, "Envelope sender must have @ or be empty (bounce): "+sender)
+		return 2
+	}
+
+	var data []byte
+	var err error
+	if *eml == "" || *eml == "-" {
+		data, err = ioutil.ReadAll(os.Stdin)
+	} else {
+		data, err = ioutil.ReadFile(*eml)
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Cannot read e-mail: ", err)
+		return 1
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	out := func(format string, a ...interface{}) {
+		if *explain {
+			fmt.Fprintf(w, format, a...)
+		}
+	}
+	defer w.Flush()
+
+	out("Envelope sender:\t%s\n", sender)
+	out("Recipients:\t%s\n", strings.Join(recipients, " "))
+
+	if mM, err := readMail(strings.NewReader(string(data))); err == nil {
+		out("From:\t%s\n", mM.Header.Get("From"))
+		out("Subject:\t%s\n", mM.Header.Get("Subject"))
+	}
+
+	pol, err := policy.Load(*policyFile)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Cannot load policy, using built in one: ", err)
+		pol = policy.Default
+	}
+
+	// the same steps as in main(), e-mail which can't be
+	// checked is passed and saved for the investigation
+	verdict := pol.CheckMail(sender, recipients, data)
+	out("\nCHECK\tVALUE\tRESULT\n")
+	for _, s := range verdict.Trace {
+		out("%s\t%s\t%v\n", s.Check, s.Value, s.Result)
+	}
+	out("\n")
+
+	line := strings.ToUpper(verdict.Action)
+	if verdict.Rule != "" {
+		line += " " + verdict.Rule
+	}
+	if verdict.Reason != "" {
+		line += " (" + verdict.Reason + ")"
+	}
+	fmt.Fprintln(w, "Verdict:\t"+line)
+	if len(verdict.Tags) > 0 {
+		out("Tags:\t%s\n", strings.Join(verdict.Tags, ", "))
+	}
+	if verdict.Notify {
+		out("Notify:\t%v\n", verdict.Notify)
+	}
+	out("Score:\t%s\n", store.ScoreSummary(verdict.Score, verdict.Signals))
+	if verdict.Rewrite != nil {
+		out("Rewrite:\t%s\n", store.RewriteSummary(verdict.Rewrite))
+	}
+	for _, f := range verdict.Findings {
+		for _, sn := range f.Snippets {
+			out("DLP %s:\t%s\n", f.Detector, sn)
+		}
+	}
+
+	if verdict.Action != policy.ActionPass {
+		return DRYRUNBLOCKED
+	}
+	return 0
+}
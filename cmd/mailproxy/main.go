@@ -0,0 +1,545 @@
+/**
+#
+# Pawel Grzesik, 2016
+#
+# To run as a test:
+# > go run ./cmd/mailproxy
+#
+# To run on the production we need to compile it:
+# > go build ./cmd/mailproxy
+# > ./mailproxy
+#
+# To check an e-mail without sending it:
+# > ./mailproxy --explain -eml mail.eml sender recipient
+#
+**/
+
+/*
+  Main Package
+*/
+package main
+
+/*
+  Here we are importing few modules that
+  we need to use.
+*/
+import (
+	"fmt"
+	"io/ioutil"
+	"log"
+	"math/rand"
+	"net/mail"
+	"os"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/wolfedale/go-proxy-mail/internal/client"
+	"github.com/wolfedale/go-proxy-mail/internal/content"
+	"github.com/wolfedale/go-proxy-mail/internal/delivery"
+	"github.com/wolfedale/go-proxy-mail/internal/policy"
+	"github.com/wolfedale/go-proxy-mail/internal/rewrite"
+	"github.com/wolfedale/go-proxy-mail/internal/store"
+)
+
+/*
+  PROXYDIR: main directory for the proxyMail tool
+  PROXYLOG: directory/path for the log file
+  Blocked mails are kept in store.QUEUEDIR
+*/
+const PROXYDIR string = store.PROXYDIR
+const PROXYLOG string = "/logs/proxy.log"
+
+/*
+  API Settings
+  APIURL: where we are sending blocked e-mails
+  APITIMEOUT: timeout of one API call
+  APIRETRIES: how many times we are trying before spooling
+  APITOKENFILE: bearer token for the API, not used when missing
+  APICERT, APIKEY, APICA: client certificate and CA for mTLS
+  APISPOOL: pending API calls, sent again on the next run
+*/
+const APIURL string = "http://localhost:8080/mails"
+const APITIMEOUT time.Duration = 5 * time.Second
+const APIRETRIES int = 2
+const APITOKENFILE string = PROXYDIR + "api.token"
+const APICERT string = ""
+const APIKEY string = ""
+const APICA string = ""
+const APISPOOL string = PROXYDIR + "apispool"
+
+/*
+  APIPOST: sending blocked e-mails to the API by HTTP POST.
+  API is reading sidecar metadata from the queue anyway,
+  POST is only making the dashboard faster.
+*/
+const APIPOST bool = true
+
+/*
+  E-mail Notification Settings
+*/
+const NotificationFrom string = "mailProxy@"
+const NotificationRecipients string = "pawel.grzesik@"
+const NotificationSubject string = "mailProxy problem!"
+
+/*
+  Our main MailStruct struct type
+  MailQueue: queue_num
+  BackupFile: path to the blocked mail
+  LogFile: log file
+  MailData: raw mail source
+*/
+type MailStruct struct {
+	MailQueue  string
+	BackupFile string
+	LogFile    string
+	MailData   []byte
+}
+
+/*
+  EXUNAVAILABLE: exit code for rejected e-mails,
+  postfix pipe is bouncing them (sysexits.h)
+*/
+const EXUNAVAILABLE int = 69
+
+/*
+  DEBUG MODE
+  true or false
+*/
+const DEBUG bool = false
+
+func main() {
+	/*
+	  Dry run, checking e-mail without sending or saving it.
+	  Postfix is never calling us with flags.
+	*/
+	if len(os.Args) > 1 && (os.Args[1] == "--dry-run" || os.Args[1] == "--explain") {
+		os.Exit(dryRun(os.Args[1:]))
+	}
+
+	received := time.Now()
+
+	/*
+	  Needed for random queue string every time when we execute the code
+	*/
+	rand.Seed(time.Now().UnixNano())
+
+	/*
+	  Generate random string with 10 characters.
+	*/
+	queue, err := RandStringBytesRmndr(10)
+	if err != nil {
+		log.Println("Problem with RandStringBytesRmndr: ", err)
+		os.Exit(0)
+	}
+
+	/*
+	  Setup correct PATHs for the app
+	*/
+	archiveFile := store.QueueFile(queue)
+	logFile := path.Join(PROXYDIR, PROXYLOG)
+
+	/*
+	   Initialization
+	   This allocates memory for all the fields, sets each of them
+	   to their zero value and returns a pointer.
+	*/
+	s := &MailStruct{
+		MailQueue:  queue,
+		BackupFile: archiveFile,
+		LogFile:    logFile,
+	}
+
+	/*
+	  Open and deal with the log file
+	*/
+	f, err := os.OpenFile(logFile, os.O_RDWR|os.O_CREATE|os.O_APPEND, 0644)
+	if err != nil {
+		log.Println(s.MailQueue+" Problem with opening os.OpenFile(): ", err)
+		s.saveMail()
+		s.sendNotification("Problem with opening os.OpenFile()")
+		os.Exit(0)
+	}
+	defer f.Close()
+
+	log.SetOutput(f)
+
+	/*
+	   Read mail source (raw) from the STDIN
+	*/
+	struct_err := s.readData()
+	if struct_err != nil {
+		log.Println(s.MailQueue+" Problem with maildata: ", struct_err)
+		s.sendNotification("Problem with maildata")
+	}
+
+	/*
+	   From now on we need to backup mail raw source in case of any problems.
+	*/
+
+	/*
+	  Check who is the sender from the mail Headers
+	*/
+	sender, err := MailSender()
+	log.Println(s.MailQueue + " Sender from args postfix: " + sender)
+	if err != nil {
+		log.Println(s.MailQueue+" no sender ", err)
+		s.saveMail()
+		s.sendNotification("no sender")
+		os.Exit(0)
+	}
+
+	/*
+	  Check recipients and create string from them
+	*/
+	recipients, err := MailRecipients()
+	log.Println(s.MailQueue + " Recipients from args postfix: " + recipients)
+	if err != nil {
+		log.Println(s.MailQueue+" no recipients ", err)
+		s.saveMail()
+		s.sendNotification("no recipients")
+		os.Exit(0)
+	}
+	recipientList := os.Args[2:]
+
+	/*
+	  Check who is the sender from the mail Body
+	  If we cannot verify it, e-mail will be send
+	  and save for the later investigation
+	*/
+
+	// Convert raw mail to string
+	mailString, err := stdinToString(s.MailData)
+	if err != nil {
+		log.Println(s.MailQueue+" Cannot convert raw mail to string ", err)
+		s.saveMail()
+		s.sendNotification("Cannot convert raw mail to string")
+		os.Exit(0)
+	}
+
+	// Read mail and return *mail.Message
+	mM, err := readMail(mailString)
+	if err != nil {
+		log.Println(s.MailQueue+" Cannot convert mail to *mail.Message ", err)
+		s.saveMail()
+		s.sendNotification("Cannot convert mail to *mail.Message")
+		delivery.SendMail(sender, recipientList, delivery.Stamp(s.MailData, store.Mail{Queue: queue}, "unchecked"))
+		os.Exit(0)
+	}
+
+	// Check header
+	header, err := mailHeader(mM)
+	if err != nil {
+		log.Println(s.MailQueue+" Cannot parse mailHeader ", err)
+		s.saveMail()
+		s.sendNotification("Cannot parse mailHeader")
+		delivery.SendMail(sender, recipientList, delivery.Stamp(s.MailData, store.Mail{Queue: queue}, "unchecked"))
+		os.Exit(0)
+	}
+
+	// Check "From" from header
+	senderHeader, err := MailSenderHeader(header)
+	log.Println(s.MailQueue + " Sender from *mail.Message: " + senderHeader)
+	if err != nil {
+		log.Println(s.MailQueue+" Cannot check From header: ", err)
+		s.saveMail()
+		s.sendNotification("Cannot check From header")
+		delivery.SendMail(sender, recipientList, delivery.Stamp(s.MailData, store.Mail{Queue: queue}, "unchecked"))
+		os.Exit(0)
+	}
+
+	// Check if Sender From has a correct format
+	senderFromFormat, err := policy.SenderFormat(senderHeader)
+	if err != nil {
+		log.Println(s.MailQueue+" Cannot check From format: ", err)
+		s.saveMail()
+		s.sendNotification("Cannot check From format")
+		delivery.SendMail(sender, recipientList, delivery.Stamp(s.MailData, store.Mail{Queue: queue}, "unchecked"))
+		os.Exit(0)
+	}
+
+	if senderFromFormat == false {
+		log.Println(s.MailQueue+" Wrong From format: ", err)
+		s.saveMail()
+		s.sendNotification("Wrong From format")
+		delivery.SendMail(sender, recipientList, delivery.Stamp(s.MailData, store.Mail{Queue: queue}, "unchecked"))
+		os.Exit(0)
+	}
+
+	/*
+	  Load the policy. Built in policy is used when the file
+	  is broken, so we are still checking e-mails.
+	*/
+	pol, err := policy.Load(policy.POLICYFILE)
+	if err != nil {
+		log.Println(s.MailQueue+" Cannot load policy: ", err)
+		s.sendNotification("Cannot load policy")
+		pol = policy.Default
+	}
+
+	/*
+	  Checking rules of the policy. Without rules we are checking if
+	  sender is in our WHITELIST, pass an e-mail if it is. Block it if
+	  sender is from OURDOMAIN, is on the list and envelope sender
+	  is not the same as From header.
+	*/
+	in := policy.Input{Sender: sender, Recipients: recipientList, Header: header, Data: s.MailData}
+	if in.Parts, err = content.Walk(mM); err != nil {
+		log.Println(s.MailQueue+" Cannot read all MIME parts: ", err)
+		in.Incomplete = err.Error()
+	}
+	verdict := pol.Evaluate(in)
+	if err := policy.AddHits(policy.HITSFILE, verdict.Matched); err != nil {
+		log.Println(s.MailQueue+" Cannot count rule hits: ", err)
+	}
+	if verdict.Notify {
+		s.sendNotification(strings.ToUpper(verdict.Action) + " (" + verdict.Rule + "): " + sender + "=>" + recipients)
+	}
+	if len(verdict.Tags) > 0 {
+		log.Println(s.MailQueue + " Tags: " + strings.Join(verdict.Tags, ", "))
+	}
+	if verdict.Rewrite != nil {
+		log.Println(s.MailQueue + " Rewrite: " + store.RewriteSummary(verdict.Rewrite))
+	}
+	log.Println(s.MailQueue + " Score: " + store.ScoreSummary(verdict.Score, verdict.Signals))
+
+	// Record of the e-mail, for the API and the verdict headers
+	call := &store.Mail{
+		Queue:        queue,
+		Sender:       sender,
+		SenderHeader: senderHeader,
+		Recipients:   os.Args[2:],
+		Subject:      header.Get("Subject"),
+		MessageId:    header.Get("Message-Id"),
+		Size:         len(s.MailData),
+		Attachments:  verdict.Attachments,
+		Rule:         verdict.Rule,
+		Reason:       verdict.Reason,
+		Tags:         verdict.Tags,
+		Findings:     verdict.Findings,
+		Auth:         verdict.Auth,
+		Score:        verdict.Score,
+		Signals:      verdict.Signals,
+		Rewrite:      verdict.Rewrite,
+		Received:     received,
+		Decided:      time.Now(),
+	}
+
+	// check whitelist domains
+	if verdict.Rule == "whitelist" {
+		log.Println(s.MailQueue + " PASSED (WHITELISTED domain): " + sender + " => " + recipients)
+		doMail := delivery.SendMail(sender, recipientList, delivery.Stamp(s.rewrite(call.Rewrite), *call, verdict.Action))
+		if doMail != nil {
+			log.Println(s.MailQueue+" sendMail() ", doMail)
+		}
+		exit(0)
+	}
+
+	// reject, postfix is bouncing e-mail to the sender
+	if verdict.Action == policy.ActionReject {
+		log.Println(s.MailQueue + " REJECTED (" + verdict.Rule + "): " + sender + " => " + recipients)
+		fmt.Println("Rejected by mailProxy: " + verdict.Reason)
+		exit(EXUNAVAILABLE)
+	}
+
+	if verdict.Action == policy.ActionHold {
+		// Log it
+		log.Println(s.MailQueue + " BLOCKED: " + sender + " => " + recipients)
+
+		// Send notification
+		s.sendNotification("BLOCKED: " + sender + "=>" + recipients)
+
+		// Archive Mail
+		log.Println(s.MailQueue + " saved to: " + archiveFile)
+		s.saveMail()
+
+		call.Status = store.StatusHeld
+
+		// Metadata for the API, next to the blocked e-mail
+		if DEBUG == false {
+			err = s.saveMeta(call)
+			if err != nil {
+				log.Println(s.MailQueue+" Cannot save metadata: ", err)
+				s.sendNotification("Cannot save metadata")
+			}
+		}
+
+		// Check DEBUG mode
+		if DEBUG == true {
+			doMail := delivery.SendMail(sender, recipientList, delivery.Stamp(s.rewrite(call.Rewrite), *call, verdict.Action))
+			if doMail != nil {
+				log.Println(s.MailQueue+" sendMail(debug=true) ", doMail)
+			}
+			// it's not held, so it's not sent to the API
+			log.Println(s.MailQueue + " mail has been sent (DEBUG=true) ")
+			exit(0)
+		} else if APIPOST == true {
+			// error is logged, the call is in the spool then
+			api(call)
+		}
+		exit(0)
+	}
+	// Log it
+	log.Println(s.MailQueue + " PASSED: " + sender + " => " + recipients)
+	doMail := delivery.SendMail(sender, recipientList, delivery.Stamp(s.rewrite(call.Rewrite), *call, verdict.Action))
+	if doMail != nil {
+		log.Println(s.MailQueue+" sendMail() ", doMail)
+	}
+	exit(0)
+}
+
+/*
+  Exit after sending API calls waiting in the spool, so they
+  are not waiting for the next blocked e-mail. It's used when
+  the e-mail is already delivered, held or rejected.
+*/
+func exit(code int) {
+	if c, err := apiClient(); err == nil {
+		if n := c.Flush(); n > 0 {
+			log.Printf("%d API calls are still in the spool", n)
+		}
+	}
+	os.Exit(code)
+}
+
+/*
+  return MAIL_FROM (checking mail headers)
+*/
+func MailSender() (string, error) {
+	sender := os.Args[1]
+	return sender, nil
+}
+
+/*
+  return MAIL_RECIPIENTS as a one string
+*/
+func MailRecipients() (string, error) {
+	var templist []string
+	for _, rec := range os.Args[2:] {
+		templist = append(templist, rec)
+	}
+	recipients := strings.Join(templist, " ")
+	return recipients, nil
+}
+
+/*
+  return MAIL_FROM (checking mail body)
+*/
+func MailSenderHeader(header mail.Header) (string, error) {
+	sender := header.Get("From")
+	return sender, nil
+}
+
+/*
+  Generate random string for a mail queue
+*/
+func RandStringBytesRmndr(n int) (string, error) {
+	const letterBytes = store.QUEUECHARS
+	b := make([]byte, n)
+	for i := range b {
+		b[i] = letterBytes[rand.Int63()%int64(len(letterBytes))]
+	}
+	return string(b), nil
+}
+
+/*
+  Convert mail raw to string
+*/
+func stdinToString(maildata []byte) (*strings.Reader, error) {
+	r := strings.NewReader(string(maildata))
+	return r, nil
+}
+
+/*
+  Return header from the Mail.
+*/
+func mailHeader(m *mail.Message) (mail.Header, error) {
+	header := m.Header
+	return header, nil
+}
+
+/*
+  Read mail string and return *mail.Message
+*/
+func readMail(r *strings.Reader) (*mail.Message, error) {
+	m, err := mail.ReadMessage(r)
+	return m, err
+}
+
+/*
+  Read mail and add it to the MailStruct
+*/
+func (s *MailStruct) readData() error {
+	data, err := ioutil.ReadAll(os.Stdin)
+	s.MailData = data
+	return err
+}
+
+/*
+  Save mail. Reasons:
+    - blocked
+	- error
+*/
+func (s *MailStruct) saveMail() error {
+	err := ioutil.WriteFile(s.BackupFile, s.MailData, 0644)
+	return err
+}
+
+/*
+  Save metadata of the blocked mail next to it
+*/
+func (s *MailStruct) saveMeta(call *store.Mail) error {
+	return store.WriteSidecar(path.Dir(s.BackupFile), *call)
+}
+
+/*
+  E-mail changed by the rewrite rules, the original
+  one is sent when it can't be changed
+*/
+func (s *MailStruct) rewrite(r *store.Rewrite) []byte {
+	return rewrite.Delivered(s.MailQueue, s.MailData, r)
+}
+
+/*
+  Send e-mail notification
+*/
+func (s *MailStruct) sendNotification(body string) error {
+	return delivery.Notify(NotificationFrom, NotificationRecipients, NotificationSubject, s.MailQueue+" "+body)
+}
+
+/*
+  Client of the API with our settings
+*/
+func apiClient() (*client.Client, error) {
+	token, _ := ioutil.ReadFile(APITOKENFILE)
+	return client.New(client.Config{
+		URL:      APIURL,
+		Timeout:  APITIMEOUT,
+		Retries:  APIRETRIES,
+		Token:    strings.TrimSpace(string(token)),
+		CertFile: APICERT,
+		KeyFile:  APIKEY,
+		CAFile:   APICA,
+		SpoolDir: APISPOOL,
+	})
+}
+
+/*
+  Send blocked e-mail to the API. If API is down
+  call is spooled and sent on the next run.
+*/
+func api(call *store.Mail) error {
+	c, err := apiClient()
+	if err != nil {
+		log.Println(call.Queue+" Cannot create API client: ", err)
+		return err
+	}
+	// status is set by the API
+	event := *call
+	event.Status = ""
+	err = c.Send(event)
+	if err != nil {
+		log.Println(call.Queue+" Cannot send to the API: ", err)
+	}
+	return err
+}
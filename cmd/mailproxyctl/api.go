@@ -0,0 +1,181 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"time"
+)
+
+/*
+  Error returned by the API, Code is the HTTP status,
+  Fields are validation errors per field
+*/
+type apiError struct {
+	Code      int               `json:"code"`
+	Message   string            `json:"message"`
+	RequestId string            `json:"requestid"`
+	Fields    map[string]string `json:"fields"`
+}
+
+func (e *apiError) Error() string {
+	msg := fmt.Sprintf("%d %s", e.Code, e.Message)
+	if e.RequestId != "" {
+		msg += " (request " + e.RequestId + ")"
+	}
+	var fields []string
+	for f, problem := range e.Fields {
+		fields = append(fields, f+": "+problem)
+	}
+	sort.Strings(fields)
+	for _, f := range fields {
+		msg += "\n  " + f
+	}
+	return msg
+}
+
+/*
+  Client for the versioned API
+  URL: API url with the prefix, e.g. http://localhost:8080/api/v1
+  Token: bearer token, not sent when empty
+  User, Password: user of the API (see api.users), it's in the
+  audit log. Sent instead of the token when Password is set.
+*/
+type apiClient struct {
+	URL      string
+	Token    string
+	User     string
+	Password string
+	http     *http.Client
+}
+
+func newClient(apiURL, token, user, password string, timeout time.Duration) *apiClient {
+	return &apiClient{
+		URL:      strings.TrimSuffix(apiURL, "/"),
+		Token:    token,
+		User:     user,
+		Password: password,
+		http:     &http.Client{Timeout: timeout},
+	}
+}
+
+/*
+  Server root, raw e-mails are served outside of the API prefix
+*/
+func (c *apiClient) root() string {
+	return strings.TrimSuffix(c.URL, APIPREFIX)
+}
+
+/*
+  Send request and return the response, every status
+  other than 2xx is returned as *apiError
+*/
+func (c *apiClient) do(method, u string, body io.Reader) (*http.Response, error) {
+	req, err := http.NewRequest(method, u, body)
+	if err != nil {
+		return nil, err
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	if c.User != "" && c.Password != "" {
+		req.SetBasicAuth(c.User, c.Password)
+	} else if c.Token != "" {
+		req.Header.Set("Authorization", "Bearer "+c.Token)
+	}
+
+	resp, err := c.http.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode/100 != 2 {
+		defer resp.Body.Close()
+		e := &apiError{}
+		data, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 65536))
+		if json.Unmarshal(data, e) != nil || e.Code == 0 {
+			e.Code = resp.StatusCode
+			e.Message = strings.TrimSpace(string(data))
+		}
+		return nil, e
+	}
+	return resp, nil
+}
+
+/*
+  Send request and decode json response to v
+*/
+func (c *apiClient) call(method, p string, v interface{}) (*http.Response, error) {
+	resp, err := c.do(method, c.URL+p, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if v != nil {
+		if err := json.NewDecoder(resp.Body).Decode(v); err != nil {
+			return nil, fmt.Errorf("cannot decode response: %v", err)
+		}
+	}
+	return resp, nil
+}
+
+/*
+  One page of e-mails, next is the cursor of the next page
+*/
+func (c *apiClient) Mails(q url.Values) (mails []Mail, next string, err error) {
+	resp, err := c.call("GET", "/mails?"+q.Encode(), &mails)
+	if err != nil {
+		return nil, "", err
+	}
+	return mails, resp.Header.Get("X-Next-Cursor"), nil
+}
+
+/*
+  All e-mails matching the query, following the cursor
+*/
+func (c *apiClient) AllMails(q url.Values) ([]Mail, error) {
+	var all []Mail
+	q.Set("limit", "1000")
+	for {
+		page, next, err := c.Mails(q)
+		if err != nil {
+			return nil, err
+		}
+		all = append(all, page...)
+		if next == "" {
+			return all, nil
+		}
+		q.Set("cursor", next)
+	}
+}
+
+func (c *apiClient) Mail(id int) (Mail, error) {
+	var m Mail
+	_, err := c.call("GET", fmt.Sprintf("/mails/%d", id), &m)
+	return m, err
+}
+
+/*
+  Run release, discard or bounce on the e-mail
+*/
+func (c *apiClient) Action(id int, action string) error {
+	_, err := c.call("POST", fmt.Sprintf("/mails/%d/%s", id, action), nil)
+	return err
+}
+
+/*
+  Copy raw e-mail from the queue to w
+*/
+func (c *apiClient) Raw(queue string, w io.Writer) error {
+	resp, err := c.do("GET", c.root()+"/queue/"+url.PathEscape(queue), nil)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	_, err = io.Copy(w, resp.Body)
+	return err
+}
@@ -0,0 +1,591 @@
+/*
+
+ mailproxyctl is a command line tool for operators,
+ it's talking to the mailProxyAPI, so we don't need curl.
+
+ Usage:
+ > mailproxyctl [flags] list [key=value ...]
+ > mailproxyctl [flags] show <id>
+ > mailproxyctl [flags] raw <id>
+ > mailproxyctl [flags] release <id> [id ...]
+ > mailproxyctl [flags] discard <id> [id ...]
+ > mailproxyctl [flags] stats
+ > mailproxyctl policy validate [file]
+ > mailproxyctl policy test [-policy file] [-rcpt a,b] [-header "Name: value"] <envelope-from> <header-from>
+ > mailproxyctl policy hits
+ > mailproxyctl policy replay [-current file] -candidate file [-all] dir [dir ...]
+
+ list is taking the same filters as GET /api/v1/mails,
+ e.g. mailproxyctl list status=held sender=pawel sort=-date
+
+ When the API has users, -user and MAILPROXY_PASSWORD are sent
+ instead of the token, so the user is in the audit log.
+
+*/
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/mail"
+	"net/textproto"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/wolfedale/go-proxy-mail/internal/policy"
+	"github.com/wolfedale/go-proxy-mail/internal/store"
+)
+
+type Mail = store.Mail
+
+/*
+  APIURL: default API url, MAILPROXY_API is used when set
+  APIPREFIX: prefix of the versioned API
+  APITOKENFILE: bearer token, MAILPROXY_TOKEN is used when set
+*/
+const APIURL string = "http://localhost:8080/api/v1"
+const APIPREFIX string = "/api/v1"
+const APITOKENFILE string = store.PROXYDIR + "api.token"
+
+/*
+  Exit codes, so scripts know what happened
+*/
+const (
+	ExitOK       = 0 // done
+	ExitError    = 1 // API or I/O error
+	ExitUsage    = 2 // wrong arguments
+	ExitNotFound = 3 // e-mail not found
+	ExitConflict = 4 // e-mail is not held anymore
+	ExitBlocked  = 5 // policy test: e-mail would be held or rejected
+	ExitInvalid  = 6 // policy validate: policy is not valid
+	ExitChanged  = 7 // policy replay: some verdicts would change
+)
+
+/*
+  Output in json instead of the table
+*/
+var jsonOutput bool
+
+type command func(c *apiClient, args []string) int
+
+var commands = map[string]command{
+	"list":    cmdList,
+	"show":    cmdShow,
+	"raw":     cmdRaw,
+	"release": cmdAction("release"),
+	"discard": cmdAction("discard"),
+	"stats":   cmdStats,
+	"policy":  cmdPolicy,
+}
+
+func usage() {
+	fmt.Fprintln(os.Stderr, `Usage: mailproxyctl [flags] command [args]
+
+Commands:
+  list [key=value ...]        list e-mails, e.g. status=held sender=pawel
+  show <id>                   show one e-mail
+  raw <id>                    print raw e-mail from the queue
+  release <id> [id ...]       send held e-mails to recipients
+  discard <id> [id ...]       remove held e-mails without sending
+  stats                       count e-mails by status and rule
+  policy validate [file]      check policy file
+  policy test [-policy file] [-rcpt a,b] [-header "Name: value"] <envelope-from> <header-from>
+                              show verdict of the policy
+  policy hits                 show hit counters of the rules
+  policy replay [-current file] -candidate file [-all] dir [dir ...]
+                              show e-mails of the corpus directories which
+                              would get a different verdict with candidate
+                              policy (the queue has only held e-mails)
+
+Exit codes:
+  0 ok, 1 error, 2 usage, 3 not found, 4 not held,
+  5 policy test held or rejected, 6 policy not valid,
+  7 policy replay found changes
+
+Flags:`)
+	flag.PrintDefaults()
+}
+
+func main() {
+	apiURL := flag.String("api", env("MAILPROXY_API", APIURL), "API url")
+	tokenFile := flag.String("token", APITOKENFILE, "file with the bearer token")
+	user := flag.String("user", os.Getenv("USER"), "API user, sent with MAILPROXY_PASSWORD instead of the token")
+	timeout := flag.Duration("timeout", 10*time.Second, "API timeout")
+	flag.BoolVar(&jsonOutput, "json", false, "json output")
+	flag.Usage = usage
+	flag.Parse()
+
+	if flag.NArg() == 0 {
+		usage()
+		os.Exit(ExitUsage)
+	}
+	cmd, ok := commands[flag.Arg(0)]
+	if !ok {
+		fmt.Fprintln(os.Stderr, "Unknown command: "+flag.Arg(0))
+		usage()
+		os.Exit(ExitUsage)
+	}
+
+	token := os.Getenv("MAILPROXY_TOKEN")
+	if token == "" {
+		b, _ := ioutil.ReadFile(*tokenFile)
+		token = strings.TrimSpace(string(b))
+	}
+	os.Exit(cmd(newClient(*apiURL, token, *user, os.Getenv("MAILPROXY_PASSWORD"), *timeout), flag.Args()[1:]))
+}
+
+func env(name, def string) string {
+	if v := os.Getenv(name); v != "" {
+		return v
+	}
+	return def
+}
+
+/*
+  Print error and return exit code for it
+*/
+func fail(err error) int {
+	fmt.Fprintln(os.Stderr, "Error: "+err.Error())
+	if e, ok := err.(*apiError); ok {
+		switch e.Code {
+		case 404:
+			return ExitNotFound
+		case 409:
+			return ExitConflict
+		case 400, 422:
+			return ExitUsage
+		}
+	}
+	return ExitError
+}
+
+func printJSON(v interface{}) {
+	enc := json.NewEncoder(os.Stdout)
+	enc.SetIndent("", "  ")
+	enc.Encode(v)
+}
+
+func parseId(s string) (int, bool) {
+	id, err := strconv.Atoi(s)
+	if err != nil || id <= 0 {
+		fmt.Fprintln(os.Stderr, "Wrong id: "+s)
+		return 0, false
+	}
+	return id, true
+}
+
+func cut(s string, n int) string {
+	if len(s) > n {
+		return s[:n-3] + "..."
+	}
+	return s
+}
+
+/*
+  list [key=value ...]
+*/
+func cmdList(c *apiClient, args []string) int {
+	q := make(map[string][]string)
+	for _, a := range args {
+		kv := strings.SplitN(a, "=", 2)
+		if len(kv) != 2 {
+			fmt.Fprintln(os.Stderr, "Filter must be key=value: "+a)
+			return ExitUsage
+		}
+		q[kv[0]] = append(q[kv[0]], kv[1])
+	}
+
+	mails, next, err := c.Mails(q)
+	if err != nil {
+		return fail(err)
+	}
+	if jsonOutput {
+		if mails == nil {
+			mails = []Mail{}
+		}
+		printJSON(mails)
+	} else {
+		w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+		fmt.Fprintln(w, "ID\tSTATUS\tRECEIVED\tQUEUE\tSENDER\tRECIPIENTS\tRULE\tSUBJECT")
+		for _, m := range mails {
+			fmt.Fprintf(w, "%d\t%s\t%s\t%s\t%s\t%s\t%s\t%s\n",
+				m.Id, m.Status, m.Received.Format("2006-01-02 15:04"), m.Queue,
+				m.Sender, cut(m.Recipient(), 40), m.Rule, cut(m.Subject, 40))
+		}
+		w.Flush()
+	}
+	if next != "" {
+		fmt.Fprintln(os.Stderr, "Next page: cursor="+next)
+	}
+	return ExitOK
+}
+
+/*
+  show <id>
+*/
+func cmdShow(c *apiClient, args []string) int {
+	if len(args) != 1 {
+		fmt.Fprintln(os.Stderr, "Usage: mailproxyctl show <id>")
+		return ExitUsage
+	}
+	id, ok := parseId(args[0])
+	if !ok {
+		return ExitUsage
+	}
+	m, err := c.Mail(id)
+	if err != nil {
+		return fail(err)
+	}
+	if jsonOutput {
+		printJSON(m)
+		return ExitOK
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintf(w, "Id:\t%d\n", m.Id)
+	fmt.Fprintf(w, "Queue:\t%s\n", m.Queue)
+	fmt.Fprintf(w, "Status:\t%s\n", m.Status)
+	fmt.Fprintf(w, "Sender:\t%s\n", m.Sender)
+	fmt.Fprintf(w, "From:\t%s\n", m.SenderHeader)
+	fmt.Fprintf(w, "Recipients:\t%s\n", m.Recipient())
+	fmt.Fprintf(w, "Subject:\t%s\n", m.Subject)
+	fmt.Fprintf(w, "Message-Id:\t%s\n", m.MessageId)
+	fmt.Fprintf(w, "Size:\t%d\n", m.Size)
+	fmt.Fprintf(w, "Rule:\t%s\n", m.Rule)
+	fmt.Fprintf(w, "Reason:\t%s\n", m.Reason)
+	fmt.Fprintf(w, "Tags:\t%s\n", strings.Join(m.Tags, ", "))
+	fmt.Fprintf(w, "Score:\t%d\n", m.Score)
+	for _, s := range m.Signals {
+		fmt.Fprintf(w, "\t  %+d %s: %s\n", s.Score, s.Name, s.Reason)
+	}
+	if m.Rewrite != nil {
+		fmt.Fprintf(w, "Rewrite:\t%s\n", store.RewriteSummary(m.Rewrite))
+	}
+	fmt.Fprintf(w, "Received:\t%s\n", m.Received.Format(time.RFC1123))
+	if !m.Decided.IsZero() {
+		fmt.Fprintf(w, "Decided:\t%s\n", m.Decided.Format(time.RFC1123))
+	}
+	if m.Reviewed != nil {
+		fmt.Fprintf(w, "Reviewed:\t%s\n", m.Reviewed.Format(time.RFC1123))
+	}
+	if m.Released != nil {
+		fmt.Fprintf(w, "Released:\t%s\n", m.Released.Format(time.RFC1123))
+	}
+	printAttachments(w, m.Attachments, 0)
+	if a := m.Auth; a != nil {
+		fmt.Fprintf(w, "SPF:\t%s (%s %s) %s\n", a.SPF, a.SPFDomain, a.ClientIP, a.SPFReason)
+		fmt.Fprintf(w, "DKIM:\t%s %s%s\n", a.DKIM, strings.Join(a.DKIMDomains, ", "), a.DKIMReason)
+		fmt.Fprintf(w, "DMARC:\t%s (%s p=%s)\n", a.DMARC, a.FromDomain, a.DMARCPolicy)
+	}
+	for _, f := range m.Findings {
+		fmt.Fprintf(w, "DLP:\t%s (%d matches in %s)\n", f.Detector, f.Count, strings.Join(f.Parts, ", "))
+		for _, sn := range f.Snippets {
+			fmt.Fprintf(w, "\t  %s\n", sn)
+		}
+	}
+	w.Flush()
+	return ExitOK
+}
+
+/*
+  Attachments with the real type, files of the archives are indented
+*/
+func printAttachments(w io.Writer, list []store.Attachment, depth int) {
+	prefix := "Attachment:\t"
+	if depth > 0 {
+		prefix = "\t" + strings.Repeat("  ", depth)
+	}
+	for _, a := range list {
+		fmt.Fprintf(w, "%s%s (%s, %s, %d bytes)", prefix, a.Name, a.ContentType, a.Type, a.Size)
+		if a.Encrypted {
+			fmt.Fprint(w, " ENCRYPTED")
+		}
+		if a.Error != "" {
+			fmt.Fprint(w, " NOT INSPECTED: "+a.Error)
+		}
+		fmt.Fprintln(w)
+		printAttachments(w, a.Files, depth+1)
+	}
+}
+
+/*
+  raw <id>, every view is in the audit log
+*/
+func cmdRaw(c *apiClient, args []string) int {
+	if len(args) != 1 {
+		fmt.Fprintln(os.Stderr, "Usage: mailproxyctl raw <id>")
+		return ExitUsage
+	}
+	id, ok := parseId(args[0])
+	if !ok {
+		return ExitUsage
+	}
+	m, err := c.Mail(id)
+	if err != nil {
+		return fail(err)
+	}
+	if err := c.Raw(m.Queue, os.Stdout); err != nil {
+		return fail(err)
+	}
+	return ExitOK
+}
+
+/*
+  release and discard, running for every id even when
+  one of them fails, exit code is the one of the last failure
+*/
+func cmdAction(action string) command {
+	return func(c *apiClient, args []string) int {
+		if len(args) == 0 {
+			fmt.Fprintln(os.Stderr, "Usage: mailproxyctl "+action+" <id> [id ...]")
+			return ExitUsage
+		}
+		type result struct {
+			Id      int    `json:"id"`
+			Code    int    `json:"code"`
+			Message string `json:"message"`
+		}
+		var results []result
+		code := ExitOK
+		for _, a := range args {
+			id, ok := parseId(a)
+			if !ok {
+				code = ExitUsage
+				continue
+			}
+			err := c.Action(id, action)
+			switch e := err.(type) {
+			case nil:
+				results = append(results, result{id, 200, "OK"})
+				if !jsonOutput {
+					fmt.Printf("%d: %s OK\n", id, action)
+				}
+			case *apiError:
+				results = append(results, result{id, e.Code, e.Message})
+				code = fail(err)
+			default:
+				return fail(err)
+			}
+		}
+		if jsonOutput {
+			printJSON(results)
+		}
+		return code
+	}
+}
+
+/*
+  stats, counting all e-mails by status and rule
+*/
+func cmdStats(c *apiClient, args []string) int {
+	mails, err := c.AllMails(map[string][]string{})
+	if err != nil {
+		return fail(err)
+	}
+	stats := struct {
+		Total  int            `json:"total"`
+		Status map[string]int `json:"status"`
+		Rule   map[string]int `json:"rule"`
+	}{len(mails), map[string]int{}, map[string]int{}}
+	for _, m := range mails {
+		stats.Status[string(m.Status)]++
+		if m.Rule != "" {
+			stats.Rule[m.Rule]++
+		}
+	}
+	if jsonOutput {
+		printJSON(stats)
+		return ExitOK
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintf(w, "Total:\t%d\n", stats.Total)
+	for _, s := range store.Statuses {
+		fmt.Fprintf(w, "Status %s:\t%d\n", s, stats.Status[string(s)])
+	}
+	var rules []string
+	for r := range stats.Rule {
+		rules = append(rules, r)
+	}
+	sort.Strings(rules)
+	for _, r := range rules {
+		fmt.Fprintf(w, "Rule %s:\t%d\n", r, stats.Rule[r])
+	}
+	w.Flush()
+	return ExitOK
+}
+
+/*
+  policy validate [file]
+  policy test [-policy file] [-rcpt a,b] [-header "Name: value"] <envelope-from> <header-from>
+  policy replay [-current file] -candidate file [-all] dir [dir ...]
+  policy hits
+*/
+func cmdPolicy(c *apiClient, args []string) int {
+	if len(args) == 0 {
+		fmt.Fprintln(os.Stderr, "Usage: mailproxyctl policy validate|test|replay|hits ...")
+		return ExitUsage
+	}
+	switch args[0] {
+	case "validate":
+		return policyValidate(args[1:])
+	case "test":
+		return policyTest(args[1:])
+	case "replay":
+		return policyReplay(args[1:])
+	case "hits":
+		return policyHits(args[1:])
+	}
+	fmt.Fprintln(os.Stderr, "Unknown policy command: "+args[0])
+	return ExitUsage
+}
+
+func policyValidate(args []string) int {
+	file := policy.POLICYFILE
+	if len(args) > 0 {
+		file = args[0]
+	}
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		return fail(err)
+	}
+
+	_, errs := policy.Parse(data)
+	var problems []string
+	for _, e := range errs {
+		problems = append(problems, e.Error())
+	}
+	if jsonOutput {
+		printJSON(struct {
+			File   string   `json:"file"`
+			Valid  bool     `json:"valid"`
+			Errors []string `json:"errors,omitempty"`
+		}{file, len(errs) == 0, problems})
+	} else if len(errs) == 0 {
+		fmt.Println(file + ": OK")
+	} else {
+		for _, p := range problems {
+			fmt.Println(file + ": " + p)
+		}
+	}
+	if len(errs) > 0 {
+		return ExitInvalid
+	}
+	return ExitOK
+}
+
+/*
+  Headers given as -header "Name: value", flag can be repeated
+*/
+type headerFlag map[string][]string
+
+func (h headerFlag) String() string { return "" }
+
+func (h headerFlag) Set(v string) error {
+	kv := strings.SplitN(v, ":", 2)
+	if len(kv) != 2 {
+		return fmt.Errorf("header must be \"Name: value\"")
+	}
+	name := textproto.CanonicalMIMEHeaderKey(strings.TrimSpace(kv[0]))
+	h[name] = append(h[name], strings.TrimSpace(kv[1]))
+	return nil
+}
+
+func policyTest(args []string) int {
+	fs := flag.NewFlagSet("policy test", flag.ContinueOnError)
+	file := fs.String("policy", policy.POLICYFILE, "policy file, built in policy is used when missing")
+	rcpt := fs.String("rcpt", "", "recipients, separated by comma")
+	header := headerFlag{}
+	fs.Var(header, "header", "other header, e.g. -header \"Subject: hello\", can be repeated")
+	if err := fs.Parse(args); err != nil {
+		return ExitUsage
+	}
+	if fs.NArg() != 2 {
+		fmt.Fprintln(os.Stderr, "Usage: mailproxyctl policy test [-policy file] [-rcpt a,b] [-header \"Name: value\"] <envelope-from> <header-from>")
+		return ExitUsage
+	}
+	sender, senderHeader := fs.Arg(0), fs.Arg(1)
+	if sender != "" && !strings.Contains(sender, "@") {
+		fmt.Fprintln(os.Stderr, "Envelope sender must have @ or be empty (bounce): "+sender)
+		return ExitUsage
+	}
+	if ok, _ := policy.SenderFormat(senderHeader); !ok {
+		fmt.Fprintln(os.Stderr, "Wrong From format: "+senderHeader)
+		return ExitUsage
+	}
+	header["From"] = []string{senderHeader}
+	var recipients []string
+	if *rcpt != "" {
+		recipients = strings.Split(*rcpt, ",")
+	}
+
+	p, err := policy.Load(*file)
+	if err != nil {
+		return fail(err)
+	}
+	v := p.Evaluate(policy.Input{Sender: sender, Recipients: recipients, Header: mail.Header(header)})
+	if jsonOutput {
+		printJSON(v)
+	} else {
+		w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+		fmt.Fprintln(w, "CHECK\tVALUE\tRESULT")
+		for _, s := range v.Trace {
+			fmt.Fprintf(w, "%s\t%s\t%v\n", s.Check, s.Value, s.Result)
+		}
+		fmt.Fprintf(w, "\nVerdict:\t%s\n", strings.ToUpper(v.Action))
+		if v.Rule != "" {
+			fmt.Fprintf(w, "Rule:\t%s\n", v.Rule)
+		}
+		if v.Reason != "" {
+			fmt.Fprintf(w, "Reason:\t%s\n", v.Reason)
+		}
+		if len(v.Tags) > 0 {
+			fmt.Fprintf(w, "Tags:\t%s\n", strings.Join(v.Tags, ", "))
+		}
+		if v.Notify {
+			fmt.Fprintf(w, "Notify:\t%v\n", v.Notify)
+		}
+		fmt.Fprintf(w, "Score:\t%s\n", store.ScoreSummary(v.Score, v.Signals))
+		if v.Rewrite != nil {
+			fmt.Fprintf(w, "Rewrite:\t%s\n", store.RewriteSummary(v.Rewrite))
+		}
+		w.Flush()
+	}
+	if v.Action != policy.ActionPass {
+		return ExitBlocked
+	}
+	return ExitOK
+}
+
+/*
+  policy hits, counters of the rules from the filter
+*/
+func policyHits(args []string) int {
+	hits, err := policy.Hits(policy.HITSFILE)
+	if err != nil {
+		return fail(err)
+	}
+	if jsonOutput {
+		printJSON(hits)
+		return ExitOK
+	}
+	var names []string
+	for n := range hits {
+		names = append(names, n)
+	}
+	sort.Strings(names)
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "RULE\tHITS")
+	for _, n := range names {
+		fmt.Fprintf(w, "%s\t%d\n", n, hits[n])
+	}
+	w.Flush()
+	return ExitOK
+}
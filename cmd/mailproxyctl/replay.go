@@ -0,0 +1,209 @@
+package main
+
+import (
+	"bytes"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"net/mail"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/wolfedale/go-proxy-mail/internal/policy"
+	"github.com/wolfedale/go-proxy-mail/internal/store"
+)
+
+/*
+  Verdicts of one e-mail
+  Skipped: why e-mail was not checked, e.g. no envelope sender
+*/
+type replayResult struct {
+	File      string          `json:"file"`
+	Sender    string          `json:"sender"`
+	From      string          `json:"from"`
+	Current   *policy.Verdict `json:"current,omitempty"`
+	Candidate *policy.Verdict `json:"candidate,omitempty"`
+	Changed   bool            `json:"changed"`
+	Skipped   string          `json:"skipped,omitempty"`
+}
+
+type replayReport struct {
+	Total       int            `json:"total"`
+	Checked     int            `json:"checked"`
+	Skipped     int            `json:"skipped"`
+	Changed     int            `json:"changed"`
+	PassToBlock int            `json:"passtoblock"`
+	BlockToPass int            `json:"blocktopass"`
+	RuleChanges map[string]int `json:"rulechanges"`
+	Results     []replayResult `json:"results"`
+}
+
+/*
+  policy replay [-current file] -candidate file [-all] dir [dir ...]
+  Replay e-mails from the directories against current and candidate
+  policy and show which verdicts would change. Envelope is read
+  from the sidecar, Return-Path header is used when there is no
+  sidecar. Directory is required: the queue has only held e-mails,
+  so it can't show e-mails which would be blocked now.
+*/
+func policyReplay(args []string) int {
+	fs := flag.NewFlagSet("policy replay", flag.ContinueOnError)
+	current := fs.String("current", policy.POLICYFILE, "current policy, built in policy is used when missing")
+	candidate := fs.String("candidate", "", "candidate policy")
+	all := fs.Bool("all", false, "show e-mails without changes too")
+	if err := fs.Parse(args); err != nil {
+		return ExitUsage
+	}
+	dirs := fs.Args()
+	if *candidate == "" || len(dirs) == 0 {
+		fmt.Fprintln(os.Stderr, "Usage: mailproxyctl policy replay [-current file] -candidate file [-all] dir [dir ...]")
+		fmt.Fprintln(os.Stderr, "dir is a corpus of passed and held e-mails, "+store.QUEUEDIR+" has only the held ones")
+		return ExitUsage
+	}
+
+	cur, err := policy.Load(*current)
+	if err != nil {
+		return fail(err)
+	}
+	data, err := ioutil.ReadFile(*candidate)
+	if err != nil {
+		return fail(err)
+	}
+	cand, errs := policy.Parse(data)
+	if len(errs) > 0 {
+		for _, e := range errs {
+			fmt.Fprintln(os.Stderr, *candidate+": "+e.Error())
+		}
+		return ExitInvalid
+	}
+
+	report := replayReport{RuleChanges: map[string]int{}}
+	for _, dir := range dirs {
+		files, err := ioutil.ReadDir(dir)
+		if err != nil {
+			return fail(err)
+		}
+		for _, f := range files {
+			name := f.Name()
+			if f.IsDir() || strings.HasPrefix(name, ".") || strings.HasSuffix(name, store.SIDECAR) {
+				continue
+			}
+			r := replayOne(path.Join(dir, name), cur, cand)
+			report.add(r)
+		}
+	}
+
+	if jsonOutput {
+		if !*all {
+			var changed []replayResult
+			for _, r := range report.Results {
+				if r.Changed {
+					changed = append(changed, r)
+				}
+			}
+			report.Results = changed
+		}
+		printJSON(report)
+	} else {
+		report.print(*all)
+	}
+	if report.Changed > 0 {
+		return ExitChanged
+	}
+	return ExitOK
+}
+
+/*
+  Check one e-mail against both policies
+*/
+func replayOne(file string, cur, cand *policy.Policy) replayResult {
+	r := replayResult{File: file}
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		r.Skipped = err.Error()
+		return r
+	}
+
+	var recipients []string
+	if m, err := store.ReadSidecar(file + store.SIDECAR); err == nil {
+		r.Sender = m.Sender
+		recipients = m.Recipients
+	} else if m, err := mail.ReadMessage(bytes.NewReader(data)); err == nil {
+		if a, err := mail.ParseAddress(m.Header.Get("Return-Path")); err == nil {
+			r.Sender = a.Address
+		}
+	}
+	if !strings.Contains(r.Sender, "@") {
+		r.Skipped = "no envelope sender"
+		return r
+	}
+	if m, err := mail.ReadMessage(bytes.NewReader(data)); err == nil {
+		r.From = m.Header.Get("From")
+	}
+
+	vc := cur.CheckMail(r.Sender, recipients, data)
+	vn := cand.CheckMail(r.Sender, recipients, data)
+	vc.Trace, vn.Trace = nil, nil
+	r.Current, r.Candidate = &vc, &vn
+	r.Changed = vc.Action != vn.Action || vc.Rule != vn.Rule
+	return r
+}
+
+func (rep *replayReport) add(r replayResult) {
+	rep.Total++
+	rep.Results = append(rep.Results, r)
+	if r.Skipped != "" {
+		rep.Skipped++
+		return
+	}
+	rep.Checked++
+	if !r.Changed {
+		return
+	}
+	rep.Changed++
+	switch {
+	case r.Current.Action == policy.ActionPass && r.Candidate.Action != policy.ActionPass:
+		rep.PassToBlock++
+	case r.Current.Action != policy.ActionPass && r.Candidate.Action == policy.ActionPass:
+		rep.BlockToPass++
+	}
+	rep.RuleChanges[verdictString(*r.Current)+" -> "+verdictString(*r.Candidate)]++
+}
+
+func verdictString(v policy.Verdict) string {
+	if v.Rule != "" {
+		return v.Action + "/" + v.Rule
+	}
+	return v.Action
+}
+
+func (rep *replayReport) print(all bool) {
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "FILE\tSENDER\tFROM\tCURRENT\tCANDIDATE")
+	for _, r := range rep.Results {
+		switch {
+		case r.Skipped != "":
+			if all {
+				fmt.Fprintf(w, "%s\t%s\t%s\tskipped: %s\t\n", r.File, r.Sender, r.From, r.Skipped)
+			}
+		case r.Changed || all:
+			fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\n", r.File, r.Sender, cut(r.From, 40),
+				verdictString(*r.Current), verdictString(*r.Candidate))
+		}
+	}
+	w.Flush()
+
+	fmt.Printf("\nTotal: %d, checked: %d, skipped: %d\n", rep.Total, rep.Checked, rep.Skipped)
+	fmt.Printf("Changed: %d (pass -> block: %d, block -> pass: %d)\n", rep.Changed, rep.PassToBlock, rep.BlockToPass)
+	var changes []string
+	for c := range rep.RuleChanges {
+		changes = append(changes, c)
+	}
+	sort.Strings(changes)
+	for _, c := range changes {
+		fmt.Printf("  %s: %d\n", c, rep.RuleChanges[c])
+	}
+}
@@ -0,0 +1,12 @@
+module github.com/wolfedale/go-proxy-mail
+
+go 1.21
+
+require (
+	github.com/fsnotify/fsnotify v1.7.0
+	github.com/gorilla/mux v1.8.1
+	golang.org/x/crypto v0.24.0
+	golang.org/x/text v0.16.0
+)
+
+require golang.org/x/sys v0.21.0 // indirect
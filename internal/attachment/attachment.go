@@ -0,0 +1,578 @@
+/*
+  Package attachment is checking attachments of the e-mail: real
+  type from the magic bytes (not the declared Content-Type) and
+  files inside zip, tar and gzip archives.
+*/
+package attachment
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"compress/gzip"
+	"encoding/binary"
+	"html"
+	"io"
+	"io/ioutil"
+	"path"
+	"regexp"
+	"strings"
+
+	"github.com/wolfedale/go-proxy-mail/internal/content"
+	"github.com/wolfedale/go-proxy-mail/internal/store"
+)
+
+/*
+  Limits of the archive inspection, archive over them
+  is not inspected and has Error set
+  MAXDEPTH: archives inside archives
+  MAXFILES: files in all archives of one e-mail
+  MAXUNPACKED: bytes unpacked from one e-mail
+  MAXRATIO: compression ratio, bigger one is rather a bomb
+*/
+const MAXDEPTH int = 3
+const MAXFILES int = 1000
+const MAXUNPACKED int64 = 100 << 20
+const MAXRATIO int64 = 100
+
+/*
+  Types which are known for the extensions, file with the
+  extension from the list and other type is a mismatch
+*/
+var extensionTypes = map[string][]string{
+	"pdf":  {"pdf"},
+	"zip":  {"zip"},
+	"gz":   {"gzip"},
+	"tgz":  {"gzip"},
+	"tar":  {"tar"},
+	"rar":  {"rar"},
+	"7z":   {"7z"},
+	"exe":  {"exe"},
+	"dll":  {"exe"},
+	"png":  {"png"},
+	"jpg":  {"jpeg"},
+	"jpeg": {"jpeg"},
+	"gif":  {"gif"},
+	"bmp":  {"bmp"},
+	"tif":  {"tiff"},
+	"tiff": {"tiff"},
+	"doc":  {"ole"},
+	"xls":  {"ole"},
+	"ppt":  {"ole"},
+	"msg":  {"ole"},
+	"docx": {"docx"},
+	"xlsx": {"xlsx"},
+	"pptx": {"pptx"},
+	"jar":  {"jar", "zip"},
+	"rtf":  {"rtf"},
+	"txt":  {"text"},
+	"csv":  {"text"},
+	"htm":  {"html", "text"},
+	"html": {"html", "text"},
+}
+
+/*
+  Magic bytes of the types, the first match wins. Short
+  magics are found in text files too, valid is checking
+  the rest of the header then.
+*/
+var magics = []struct {
+	offset int
+	magic  string
+	typ    string
+	valid  func(data []byte) bool
+}{
+	{0, "%PDF-", "pdf", nil},
+	{0, "PK\x03\x04", "zip", nil},
+	{0, "PK\x05\x06", "zip", nil},
+	{0, "\x1f\x8b", "gzip", nil},
+	{257, "ustar", "tar", nil},
+	{0, "Rar!\x1a\x07", "rar", nil},
+	{0, "7z\xbc\xaf\x27\x1c", "7z", nil},
+	{0, "MZ", "exe", validPE},
+	{0, "\x7fELF", "elf", nil},
+	{0, "\xfe\xed\xfa\xce", "macho", nil},
+	{0, "\xfe\xed\xfa\xcf", "macho", nil},
+	{0, "\xcf\xfa\xed\xfe", "macho", nil},
+	{0, "\xce\xfa\xed\xfe", "macho", nil},
+	{0, "\x89PNG\r\n\x1a\n", "png", nil},
+	{0, "\xff\xd8\xff", "jpeg", nil},
+	{0, "GIF87a", "gif", nil},
+	{0, "GIF89a", "gif", nil},
+	{0, "BM", "bmp", validBMP},
+	{0, "II*\x00", "tiff", nil},
+	{0, "MM\x00*", "tiff", nil},
+	{0, "\xd0\xcf\x11\xe0\xa1\xb1\x1a\xe1", "ole", nil},
+	{0, "{\\rtf", "rtf", nil},
+	{0, "#!", "script", validScript},
+}
+
+/*
+  Detect type of the file from the magic bytes,
+  zip files are checked for office documents and jars
+*/
+func Detect(data []byte) string {
+	for _, m := range magics {
+		if len(data) >= m.offset+len(m.magic) && string(data[m.offset:m.offset+len(m.magic)]) == m.magic {
+			if m.valid != nil && !m.valid(data) {
+				continue
+			}
+			if m.typ == "zip" {
+				return zipType(data)
+			}
+			return m.typ
+		}
+	}
+
+	head := data
+	if len(head) > 512 {
+		head = head[:512]
+	}
+	lower := strings.ToLower(string(head))
+	switch {
+	case len(data) == 0:
+		return "empty"
+	case strings.Contains(lower, "<html") || strings.Contains(lower, "<!doctype html"):
+		return "html"
+	case isText(head):
+		return "text"
+	}
+	return "unknown"
+}
+
+/*
+  Windows executable: "PE\0\0" at the offset from the DOS header
+*/
+func validPE(data []byte) bool {
+	if len(data) < 0x40 {
+		return false
+	}
+	offset := int(binary.LittleEndian.Uint32(data[0x3c:]))
+	return offset >= 0x40 && offset+4 <= len(data) && string(data[offset:offset+4]) == "PE\x00\x00"
+}
+
+/*
+  Bitmap: reserved fields are zero and size of the
+  DIB header is one of the known ones
+*/
+func validBMP(data []byte) bool {
+	if len(data) < 18 || binary.LittleEndian.Uint32(data[6:]) != 0 {
+		return false
+	}
+	switch binary.LittleEndian.Uint32(data[14:]) {
+	case 12, 16, 40, 52, 56, 64, 108, 124:
+		return true
+	}
+	return false
+}
+
+/*
+  Script: interpreter path after "#!", e.g. "#!/bin/sh"
+*/
+func validScript(data []byte) bool {
+	line := bytes.TrimLeft(data[2:], " \t")
+	return len(line) > 0 && line[0] == '/'
+}
+
+func zipType(data []byte) string {
+	zr, err := zip.NewReader(bytes.NewReader(data), int64(len(data)))
+	if err != nil {
+		return "zip"
+	}
+	for _, f := range zr.File {
+		switch {
+		case strings.HasPrefix(f.Name, "word/"):
+			return "docx"
+		case strings.HasPrefix(f.Name, "xl/"):
+			return "xlsx"
+		case strings.HasPrefix(f.Name, "ppt/"):
+			return "pptx"
+		case f.Name == "META-INF/MANIFEST.MF":
+			return "jar"
+		}
+	}
+	return "zip"
+}
+
+func isText(data []byte) bool {
+	for _, c := range data {
+		if c < 0x09 || (c > 0x0d && c < 0x20 && c != 0x1b) {
+			return false
+		}
+	}
+	return true
+}
+
+/*
+  Extension of the file name, lower case without the dot
+*/
+func Extension(name string) string {
+	return strings.TrimPrefix(strings.ToLower(path.Ext(name)), ".")
+}
+
+/*
+  Extension is known and real type is different
+*/
+func Mismatch(name, typ string) bool {
+	types, ok := extensionTypes[Extension(name)]
+	if !ok || typ == "unknown" {
+		return false
+	}
+	for _, t := range types {
+		if t == typ {
+			return false
+		}
+	}
+	return true
+}
+
+/*
+  Return attachments of the e-mail with the real type and
+  files from the archives
+*/
+func Inspect(parts []content.Part) []store.Attachment {
+	var list []store.Attachment
+	budget := &limits{files: MAXFILES, bytes: MAXUNPACKED}
+	for _, p := range parts {
+		if !p.IsAttachment() {
+			continue
+		}
+		a := store.Attachment{
+			Name:        p.Filename,
+			ContentType: p.ContentType,
+			Size:        int(p.Size),
+			Type:        Detect(p.Data),
+		}
+		switch {
+		case p.Broken:
+			a.Error = "broken transfer encoding"
+		case p.Truncated:
+			a.Error = "too big to inspect"
+		default:
+			unpack(&a, p.Data, 1, budget)
+		}
+		list = append(list, a)
+	}
+	return list
+}
+
+/*
+  What is left for the e-mail
+*/
+type limits struct {
+	files int
+	bytes int64
+}
+
+/*
+  Add files from the archive to a.Files
+*/
+func unpack(a *store.Attachment, data []byte, depth int, budget *limits) {
+	switch a.Type {
+	case "zip", "jar":
+	case "tar", "gzip":
+	default:
+		return
+	}
+	if depth > MAXDEPTH {
+		a.Error = "too deep"
+		return
+	}
+
+	switch a.Type {
+	case "zip", "jar":
+		unzip(a, data, depth, budget)
+	case "tar":
+		untar(a, bytes.NewReader(data), depth, budget)
+	case "gzip":
+		gunzip(a, data, depth, budget)
+	}
+}
+
+func unzip(a *store.Attachment, data []byte, depth int, budget *limits) {
+	zr, err := zip.NewReader(bytes.NewReader(data), int64(len(data)))
+	if err != nil {
+		a.Error = "broken zip: " + err.Error()
+		return
+	}
+	for _, f := range zr.File {
+		if f.FileInfo().IsDir() {
+			continue
+		}
+		if !budget.take(a) {
+			return
+		}
+		file := store.Attachment{Name: f.Name, Size: int(f.UncompressedSize64), Type: "unknown"}
+
+		// encrypted files can't be read, bit 0 of the flags
+		if f.Flags&0x1 != 0 {
+			file.Encrypted = true
+			a.Encrypted = true
+			a.Files = append(a.Files, file)
+			continue
+		}
+		if f.CompressedSize64 > 0 && int64(f.UncompressedSize64/f.CompressedSize64) > MAXRATIO && f.UncompressedSize64 > 1<<20 {
+			file.Error = "compression ratio too big"
+			a.Error = file.Error
+			a.Files = append(a.Files, file)
+			continue
+		}
+		if int64(f.UncompressedSize64) > budget.bytes {
+			file.Error = "too big to inspect"
+			a.Error = file.Error
+			a.Files = append(a.Files, file)
+			return
+		}
+
+		rc, err := f.Open()
+		if err != nil {
+			file.Error = err.Error()
+			a.Files = append(a.Files, file)
+			continue
+		}
+		body, err := read(rc, budget)
+		rc.Close()
+		if err != nil {
+			file.Error = err.Error()
+			a.Error = file.Error
+		}
+		addFile(a, file, body, depth, budget)
+	}
+}
+
+func untar(a *store.Attachment, r io.Reader, depth int, budget *limits) {
+	tr := tar.NewReader(r)
+	for {
+		h, err := tr.Next()
+		if err == io.EOF {
+			return
+		}
+		if err != nil {
+			a.Error = "broken tar: " + err.Error()
+			return
+		}
+		if h.Typeflag != tar.TypeReg {
+			continue
+		}
+		if !budget.take(a) {
+			return
+		}
+		file := store.Attachment{Name: h.Name, Size: int(h.Size)}
+		body, err := read(tr, budget)
+		if err != nil {
+			file.Error = err.Error()
+			a.Error = file.Error
+		}
+		addFile(a, file, body, depth, budget)
+	}
+}
+
+func gunzip(a *store.Attachment, data []byte, depth int, budget *limits) {
+	zr, err := gzip.NewReader(bytes.NewReader(data))
+	if err != nil {
+		a.Error = "broken gzip: " + err.Error()
+		return
+	}
+	defer zr.Close()
+	if !budget.take(a) {
+		return
+	}
+	name := zr.Name
+	if name == "" {
+		name = strings.TrimSuffix(path.Base(a.Name), path.Ext(a.Name))
+	}
+	body, err := read(zr, budget)
+	file := store.Attachment{Name: name, Size: len(body)}
+	if err != nil {
+		file.Error = err.Error()
+		a.Error = file.Error
+	}
+	addFile(a, file, body, depth, budget)
+}
+
+/*
+  Detect type of the file, look inside if it's an archive
+  and add it to the parent
+*/
+func addFile(parent *store.Attachment, file store.Attachment, body []byte, depth int, budget *limits) {
+	file.Type = Detect(body)
+	if file.Error == "" {
+		unpack(&file, body, depth+1, budget)
+	}
+	if file.Encrypted {
+		parent.Encrypted = true
+	}
+	if file.Error != "" && parent.Error == "" {
+		parent.Error = file.Error
+	}
+	parent.Files = append(parent.Files, file)
+}
+
+func (b *limits) take(a *store.Attachment) bool {
+	if b.files <= 0 {
+		a.Error = "too many files"
+		return false
+	}
+	b.files--
+	return true
+}
+
+/*
+  Read the file, but not more than the budget
+*/
+func read(r io.Reader, budget *limits) ([]byte, error) {
+	body, err := ioutil.ReadAll(io.LimitReader(r, budget.bytes+1))
+	if int64(len(body)) > budget.bytes {
+		budget.bytes = 0
+		return body[:0], errTooBig
+	}
+	budget.bytes -= int64(len(body))
+	return body, err
+}
+
+type limitError string
+
+func (e limitError) Error() string { return string(e) }
+
+var errTooBig = limitError("unpacked size too big")
+
+/*
+  All files: attachments and files from the archives
+*/
+func Files(list []store.Attachment) []store.Attachment {
+	var out []store.Attachment
+	for _, a := range list {
+		out = append(out, a)
+		out = append(out, Files(a.Files)...)
+	}
+	return out
+}
+
+/*
+  Text found in the e-mail, Path is the part or the
+  file in the archive, e.g. "2/word/document.xml"
+*/
+type Text struct {
+	Path string
+	Text string
+}
+
+/*
+  XML of the office documents with the text
+  and the ends of paragraphs and cells
+*/
+var officeFiles = regexp.MustCompile(`^(word/(document|header\d*|footer\d*|footnotes|endnotes|comments)\.xml|xl/sharedStrings\.xml|xl/worksheets/[^/]+\.xml|ppt/slides/[^/]+\.xml)$`)
+var officeBreaks = regexp.MustCompile(`</(w:p|w:tc|a:p|si|c|row)>|<w:(br|tab)/>`)
+var xmlTags = regexp.MustCompile(`<[^>]*>`)
+
+/*
+  Text of all parts for the DLP: text parts and attachments
+  by the real type, not the declared Content-Type, files in
+  the zip, tar and gzip archives and office documents too.
+  All archives of the e-mail share the limits.
+*/
+func Texts(parts []content.Part) []Text {
+	var list []Text
+	budget := &limits{files: MAXFILES, bytes: MAXUNPACKED}
+	for _, p := range parts {
+		// declared type is not trusted, archive sent as text/plain is unpacked
+		switch Detect(p.Data) {
+		case "text", "html", "empty", "unknown":
+			if text := p.Text(); text != "" {
+				list = append(list, Text{Path: p.Path, Text: text})
+				continue
+			}
+		}
+		if !p.Truncated && !p.Broken {
+			texts(p.Path, p.Data, 1, budget, &list)
+		}
+	}
+	return list
+}
+
+func texts(name string, data []byte, depth int, budget *limits, list *[]Text) {
+	typ := Detect(data)
+	switch typ {
+	case "text":
+		*list = append(*list, Text{Path: name, Text: string(data)})
+		return
+	case "html":
+		*list = append(*list, Text{Path: name, Text: content.HTMLText(string(data))})
+		return
+	case "zip", "jar", "docx", "xlsx", "pptx", "tar", "gzip":
+	default:
+		return
+	}
+	if depth > MAXDEPTH {
+		return
+	}
+
+	var a store.Attachment
+	add := func(file string, r io.Reader) bool {
+		if !budget.take(&a) {
+			return false
+		}
+		body, err := read(r, budget)
+		if err != nil {
+			return false
+		}
+		if typ == "docx" || typ == "xlsx" || typ == "pptx" {
+			text := xmlTags.ReplaceAllString(officeBreaks.ReplaceAllString(string(body), "\n"), "")
+			*list = append(*list, Text{Path: name + "/" + file, Text: html.UnescapeString(text)})
+			return true
+		}
+		texts(name+"/"+file, body, depth+1, budget, list)
+		return true
+	}
+
+	switch typ {
+	case "tar":
+		tr := tar.NewReader(bytes.NewReader(data))
+		for {
+			h, err := tr.Next()
+			if err != nil {
+				return
+			}
+			if h.Typeflag == tar.TypeReg && !add(h.Name, tr) {
+				return
+			}
+		}
+	case "gzip":
+		zr, err := gzip.NewReader(bytes.NewReader(data))
+		if err != nil {
+			return
+		}
+		defer zr.Close()
+		file := zr.Name
+		if file == "" {
+			file = "-"
+		}
+		add(file, zr)
+	default:
+		zr, err := zip.NewReader(bytes.NewReader(data), int64(len(data)))
+		if err != nil {
+			return
+		}
+		for _, f := range zr.File {
+			// encrypted files can't be read, bit 0 of the flags
+			if f.FileInfo().IsDir() || f.Flags&0x1 != 0 {
+				continue
+			}
+			if typ != "zip" && typ != "jar" && !officeFiles.MatchString(f.Name) {
+				continue
+			}
+			if f.CompressedSize64 > 0 && int64(f.UncompressedSize64/f.CompressedSize64) > MAXRATIO && f.UncompressedSize64 > 1<<20 {
+				continue
+			}
+			rc, err := f.Open()
+			if err != nil {
+				continue
+			}
+			ok := add(f.Name, rc)
+			rc.Close()
+			if !ok {
+				return
+			}
+		}
+	}
+}
@@ -0,0 +1,192 @@
+package attachment
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"compress/gzip"
+	"encoding/binary"
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/wolfedale/go-proxy-mail/internal/content"
+)
+
+func zipped(t *testing.T, files map[string]string) []byte {
+	var buf bytes.Buffer
+	w := zip.NewWriter(&buf)
+	for name, body := range files {
+		f, err := w.Create(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		f.Write([]byte(body))
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func tarred(t *testing.T, name string, body []byte) []byte {
+	var buf bytes.Buffer
+	w := tar.NewWriter(&buf)
+	if err := w.WriteHeader(&tar.Header{Name: name, Mode: 0644, Size: int64(len(body)), Typeflag: tar.TypeReg}); err != nil {
+		t.Fatal(err)
+	}
+	w.Write(body)
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func gzipped(t *testing.T, body []byte) []byte {
+	var buf bytes.Buffer
+	w := gzip.NewWriter(&buf)
+	w.Write(body)
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+/*
+  Smallest header of the Windows executable, "PE\0\0" at 0x40
+*/
+func pe() []byte {
+	data := make([]byte, 0x48)
+	copy(data, "MZ")
+	binary.LittleEndian.PutUint32(data[0x3c:], 0x40)
+	copy(data[0x40:], "PE\x00\x00")
+	return data
+}
+
+func TestDetect(t *testing.T) {
+	bmp := make([]byte, 54)
+	copy(bmp, "BM")
+	binary.LittleEndian.PutUint32(bmp[14:], 40)
+	cases := []struct {
+		name string
+		data []byte
+		typ  string
+	}{
+		{"pdf", []byte("%PDF-1.4\n"), "pdf"},
+		{"zip", zipped(t, map[string]string{"a.txt": "a"}), "zip"},
+		{"docx", zipped(t, map[string]string{"word/document.xml": "<w:document/>"}), "docx"},
+		{"xlsx", zipped(t, map[string]string{"xl/workbook.xml": "<workbook/>"}), "xlsx"},
+		{"jar", zipped(t, map[string]string{"META-INF/MANIFEST.MF": "Manifest-Version: 1.0"}), "jar"},
+		{"gzip", gzipped(t, []byte("a")), "gzip"},
+		{"tar", tarred(t, "a.txt", []byte("a")), "tar"},
+		{"exe", pe(), "exe"},
+		{"MZ text", []byte("MZ is the start of this text, not an executable at all, it is long enough"), "text"},
+		{"elf", []byte("\x7fELF\x02\x01\x01"), "elf"},
+		{"png", []byte("\x89PNG\r\n\x1a\n\x00\x00"), "png"},
+		{"bmp", bmp, "bmp"},
+		{"BM text", []byte("BMW is a car, not a bitmap"), "text"},
+		{"script", []byte("#!/bin/sh\necho hi\n"), "script"},
+		{"#! text", []byte("#!important note\n"), "text"},
+		{"html", []byte("<!DOCTYPE html><html></html>"), "html"},
+		{"empty", nil, "empty"},
+		{"unknown", []byte{0x00, 0x01, 0x02, 0x03}, "unknown"},
+	}
+	for _, c := range cases {
+		if got := Detect(c.data); got != c.typ {
+			t.Errorf("%s: %s, want %s", c.name, got, c.typ)
+		}
+	}
+}
+
+func TestInspectNested(t *testing.T) {
+	inner := gzipped(t, tarred(t, "setup.exe", pe()))
+	data := zipped(t, map[string]string{"files.tar.gz": string(inner)})
+	list := Inspect([]content.Part{{Filename: "invoice.pdf", ContentType: "application/pdf", Data: data, Size: int64(len(data))}})
+	if len(list) != 1 {
+		t.Fatalf("attachments: %+v", list)
+	}
+	a := list[0]
+	if a.Type != "zip" || !Mismatch(a.Name, a.Type) || a.Error != "" {
+		t.Errorf("attachment: %s %s mismatch %v error %q", a.Name, a.Type, Mismatch(a.Name, a.Type), a.Error)
+	}
+	var got []string
+	for _, f := range Files(list) {
+		got = append(got, f.Name+"="+f.Type)
+	}
+	want := "invoice.pdf=zip, files.tar.gz=gzip, files.tar=tar, setup.exe=exe"
+	if strings.Join(got, ", ") != want {
+		t.Errorf("files: %s, want %s", strings.Join(got, ", "), want)
+	}
+}
+
+func TestInspectLimits(t *testing.T) {
+	// zip in zip in zip ... deeper than MAXDEPTH
+	deep := zipped(t, map[string]string{"a.txt": "a"})
+	for i := 0; i < MAXDEPTH+1; i++ {
+		deep = zipped(t, map[string]string{fmt.Sprintf("%d.zip", i): string(deep)})
+	}
+	bomb := zipped(t, map[string]string{"zeros.txt": strings.Repeat("0", 10<<20)})
+	many := map[string]string{}
+	for i := 0; i <= MAXFILES; i++ {
+		many[fmt.Sprintf("%d.txt", i)] = "a"
+	}
+
+	var encrypted bytes.Buffer
+	w := zip.NewWriter(&encrypted)
+	f, err := w.CreateHeader(&zip.FileHeader{Name: "secret.txt", Flags: 0x1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.Write([]byte("not really encrypted"))
+	w.Close()
+
+	cases := []struct {
+		name      string
+		data      []byte
+		err       string
+		encrypted bool
+	}{
+		{"too deep", deep, "too deep", false},
+		{"bomb", bomb, "compression ratio too big", false},
+		{"too many files", zipped(t, many), "too many files", false},
+		{"encrypted", encrypted.Bytes(), "", true},
+		{"broken", []byte("PK\x03\x04broken"), "broken zip: zip: not a valid zip file", false},
+	}
+	for _, c := range cases {
+		list := Inspect([]content.Part{{Filename: c.name + ".zip", Data: c.data, Size: int64(len(c.data))}})
+		if len(list) != 1 || list[0].Error != c.err || list[0].Encrypted != c.encrypted {
+			t.Errorf("%s: error %q encrypted %v, want %q %v", c.name, list[0].Error, list[0].Encrypted, c.err, c.encrypted)
+		}
+	}
+}
+
+/*
+  Declared type is not trusted, zip sent as text/plain
+  is unpacked like any other zip
+*/
+func TestTextsDeclaredType(t *testing.T) {
+	data := zipped(t, map[string]string{"cards.txt": "4111 1111 1111 1111"})
+	parts := []content.Part{
+		{Path: "1", ContentType: "text/plain", Data: []byte("Hello")},
+		{Path: "2", ContentType: "text/plain", Data: data, Size: int64(len(data))},
+	}
+	var got []string
+	for _, text := range Texts(parts) {
+		got = append(got, text.Path+"="+text.Text)
+	}
+	want := "1=Hello, 2/cards.txt=4111 1111 1111 1111"
+	if strings.Join(got, ", ") != want {
+		t.Errorf("texts: %q, want %q", strings.Join(got, ", "), want)
+	}
+}
+
+func TestInspectIncomplete(t *testing.T) {
+	parts := []content.Part{
+		{Path: "1", Filename: "a.zip", Data: []byte("PK"), Broken: true},
+		{Path: "2", Filename: "b.zip", Data: []byte("PK"), Truncated: true},
+	}
+	list := Inspect(parts)
+	if len(list) != 2 || list[0].Error != "broken transfer encoding" || list[1].Error != "too big to inspect" {
+		t.Errorf("errors: %+v", list)
+	}
+}
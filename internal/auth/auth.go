@@ -0,0 +1,79 @@
+/*
+  Package auth is verifying SPF, DKIM and DMARC of the e-mail.
+  DNS is used through the Resolver, so the checks can run
+  offline with the records from a fixtures file.
+*/
+package auth
+
+import (
+	"net"
+	"net/mail"
+	"regexp"
+	"strings"
+
+	"github.com/wolfedale/go-proxy-mail/internal/store"
+)
+
+var receivedIP = regexp.MustCompile(`(?i)^\s*from\s[^;]*?\[(?:ipv6:)?([0-9a-f.:]+)\]`)
+
+/*
+  IP address of the client from the first Received header,
+  the one added by our postfix
+*/
+func ClientIP(header mail.Header) net.IP {
+	for _, h := range header["Received"] {
+		if m := receivedIP.FindStringSubmatch(h); m != nil {
+			return net.ParseIP(m[1])
+		}
+	}
+	return nil
+}
+
+func domainOf(addr string) string {
+	if a, err := mail.ParseAddress(addr); err == nil {
+		addr = a.Address
+	}
+	addr = strings.Trim(strings.TrimSpace(addr), "<>")
+	if i := strings.LastIndex(addr, "@"); i >= 0 {
+		return strings.ToLower(addr[i+1:])
+	}
+	return ""
+}
+
+/*
+  Verify SPF of the envelope sender, DKIM signatures
+  and DMARC of the From header
+*/
+func Verify(r Resolver, data []byte, sender string, header mail.Header) store.Auth {
+	a := store.Auth{
+		SPFDomain:  domainOf(sender),
+		FromDomain: domainOf(header.Get("From")),
+	}
+	ip := ClientIP(header)
+	if ip != nil {
+		a.ClientIP = ip.String()
+	}
+	if a.SPFDomain == "" {
+		a.SPF, a.SPFReason = None, "no envelope sender domain"
+	} else {
+		a.SPF, a.SPFReason = SPF(r, ip, a.SPFDomain, sender)
+	}
+
+	dkim := DKIM(r, data)
+	a.DKIM = None
+	for _, d := range dkim {
+		if d.Result == Pass {
+			a.DKIM = Pass
+			a.DKIMDomains = append(a.DKIMDomains, d.Domain)
+		} else if a.DKIM == None {
+			a.DKIM = d.Result
+			a.DKIMReason = d.Domain + ": " + d.Reason
+		}
+	}
+	if a.DKIM == Pass {
+		a.DKIMReason = ""
+	}
+
+	a.DMARC, a.DMARCPolicy = DMARC(r, a.FromDomain, a.SPF, a.SPFDomain, dkim)
+	return a
+}
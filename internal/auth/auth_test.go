@@ -0,0 +1,300 @@
+package auth
+
+import (
+	"crypto"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"fmt"
+	"net"
+	"strings"
+	"testing"
+)
+
+var spfFixtures = &Fixtures{
+	TXT: map[string][]string{
+		"foobar.com":        {"v=spf1 ip4:192.0.2.0/24 include:_spf.partner.net -all"},
+		"_spf.partner.net":  {"v=spf1 ip4:198.51.100.0/24 ~all"},
+		"redirect.com":      {"v=spf1 redirect=foobar.com"},
+		"redirect-none.com": {"v=spf1 redirect=nothing.com"},
+		"include-none.com":  {"v=spf1 include:nothing.com -all"},
+		"mx.com":            {"v=spf1 mx/24 -all"},
+		"macro.com":         {"v=spf1 exists:%{i}.%{l}._spf.macro.com -all"},
+		"macro-bad.com":     {"v=spf1 exists:%{x}.macro.com -all"},
+		"lookups.com":       {"v=spf1 a a a a a a a a a a a -all"},
+		"loop.com":          {"v=spf1 include:loop.com -all"},
+		"two.com":           {"v=spf1 -all", "v=spf1 +all"},
+		"unknown.com":       {"v=spf1 foo:bar -all"},
+		"other.com":         {"google-site-verification=abc"},
+	},
+	A: map[string][]string{
+		"lookups.com":                     {"203.0.113.1"},
+		"mail.mx.com":                     {"203.0.113.10"},
+		"192.0.2.10.alice._spf.macro.com": {"127.0.0.2"},
+	},
+	MX: map[string][]string{
+		"mx.com": {"mail.mx.com"},
+	},
+}
+
+func TestSPF(t *testing.T) {
+	cases := []struct {
+		ip     string
+		domain string
+		sender string
+		want   string
+	}{
+		{"192.0.2.1", "foobar.com", "a@foobar.com", Pass},
+		{"203.0.113.1", "foobar.com", "a@foobar.com", Fail},
+		{"", "foobar.com", "a@foobar.com", None},
+		{"192.0.2.1", "nothing.com", "a@nothing.com", None},
+		{"192.0.2.1", "other.com", "a@other.com", None},
+		{"192.0.2.1", "two.com", "a@two.com", PermError},
+		{"192.0.2.1", "unknown.com", "a@unknown.com", PermError},
+
+		// include: pass of the included domain matches, softfail doesn't
+		{"198.51.100.1", "foobar.com", "a@foobar.com", Pass},
+		{"198.51.100.1", "_spf.partner.net", "a@partner.net", Pass},
+		{"203.0.113.1", "_spf.partner.net", "a@partner.net", SoftFail},
+		{"192.0.2.1", "include-none.com", "a@include-none.com", PermError},
+
+		// redirect
+		{"192.0.2.1", "redirect.com", "a@redirect.com", Pass},
+		{"203.0.113.1", "redirect.com", "a@redirect.com", Fail},
+		{"192.0.2.1", "redirect-none.com", "a@redirect-none.com", PermError},
+
+		// mx with the prefix length
+		{"203.0.113.99", "mx.com", "a@mx.com", Pass},
+		{"198.51.100.1", "mx.com", "a@mx.com", Fail},
+
+		// the 10 lookups limit
+		{"192.0.2.1", "lookups.com", "a@lookups.com", PermError},
+		{"192.0.2.1", "loop.com", "a@loop.com", PermError},
+
+		// macros
+		{"192.0.2.10", "macro.com", "alice@macro.com", Pass},
+		{"192.0.2.10", "macro.com", "bob@macro.com", Fail},
+		{"192.0.2.11", "macro.com", "alice@macro.com", Fail},
+		{"192.0.2.10", "macro-bad.com", "alice@macro-bad.com", PermError},
+	}
+	for _, c := range cases {
+		got, why := SPF(spfFixtures, net.ParseIP(c.ip), c.domain, c.sender)
+		if got != c.want {
+			t.Errorf("SPF %s %s %s: %s (%s), want %s", c.ip, c.domain, c.sender, got, why, c.want)
+		}
+	}
+}
+
+func TestCidrs(t *testing.T) {
+	cases := []struct {
+		arg    string
+		cidr4  int
+		cidr6  int
+		broken bool
+	}{
+		{"", 32, 128, false},
+		{"/24", 24, 128, false},
+		{"//64", 32, 64, false},
+		{"/24//64", 24, 64, false},
+		{"/33", 0, 0, true},
+		{"//129", 0, 0, true},
+		{"24", 0, 0, true},
+	}
+	for _, c := range cases {
+		cidr4, cidr6, err := cidrs(c.arg)
+		if (err != nil) != c.broken || cidr4 != c.cidr4 || cidr6 != c.cidr6 {
+			t.Errorf("cidrs(%q): %d %d %v", c.arg, cidr4, cidr6, err)
+		}
+	}
+}
+
+const dkimMessage = "From: Alice <alice@foobar.com>\r\n" +
+	"To: bob@example.com\r\n" +
+	"Subject: Quarterly  report\r\n" +
+	"\r\n" +
+	"Hello Bob,  \r\n" +
+	"numbers are attached.\r\n" +
+	"\r\n\r\n"
+
+/*
+  Signature of the e-mail with the canonicalization,
+  Sign is always using relaxed/relaxed
+*/
+func signTest(t *testing.T, data, selector string, key crypto.Signer, canon string) string {
+	fields, body := splitMessage([]byte(data))
+	relaxedHeader, relaxedBody := strings.HasPrefix(canon, "relaxed/"), strings.HasSuffix(canon, "/relaxed")
+
+	algorithm := RSASHA256
+	if _, ok := key.(ed25519.PrivateKey); ok {
+		algorithm = ED25519SHA256
+	}
+	names := []string{"from", "to", "subject"}
+	bh := sha256.Sum256(canonBody(body, relaxedBody))
+	value := fmt.Sprintf(" v=1; a=%s; c=%s; d=foobar.com; s=%s;\r\n\th=%s;\r\n\tbh=%s;\r\n\tb=",
+		algorithm, canon, selector, strings.Join(names, ":"), base64.StdEncoding.EncodeToString(bh[:]))
+
+	field := headerField{Name: "DKIM-Signature", Raw: "DKIM-Signature:" + value}
+	h := strings.TrimSuffix(selectHeaders(fields, names, relaxedHeader)+canonHeader(field, relaxedHeader), "\r\n")
+	hash := sha256.Sum256([]byte(h))
+
+	opts := crypto.SignerOpts(crypto.SHA256)
+	if algorithm == ED25519SHA256 {
+		opts = crypto.Hash(0)
+	}
+	signature, err := key.Sign(rand.Reader, hash[:], opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return field.Raw + base64.StdEncoding.EncodeToString(signature) + "\r\n" + data
+}
+
+func TestDKIM(t *testing.T) {
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rsaPublic, _ := x509.MarshalPKIXPublicKey(&rsaKey.PublicKey)
+	edPublic, edKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fixtures := &Fixtures{TXT: map[string][]string{
+		"rsa._domainkey.foobar.com":     {"v=DKIM1; k=rsa; p=" + base64.StdEncoding.EncodeToString(rsaPublic)},
+		"ed._domainkey.foobar.com":      {"v=DKIM1; k=ed25519; p=" + base64.StdEncoding.EncodeToString(edPublic)},
+		"revoked._domainkey.foobar.com": {"v=DKIM1; p="},
+	}}
+
+	// whitespace changes survive only the relaxed canonicalization
+	spaces := func(s string) string {
+		s = strings.Replace(s, "Subject: Quarterly  report", "Subject:  Quarterly report", 1)
+		return strings.Replace(s, "Hello Bob,  \r\n", "Hello  Bob,\r\n", 1)
+	}
+	body := func(s string) string { return strings.Replace(s, "numbers", "Numbers", 1) }
+	subject := func(s string) string { return strings.Replace(s, "Quarterly", "Yearly", 1) }
+	none := func(s string) string { return s }
+
+	cases := []struct {
+		name     string
+		selector string
+		key      crypto.Signer
+		canon    string
+		change   func(string) string
+		want     string
+	}{
+		{"rsa relaxed", "rsa", rsaKey, "relaxed/relaxed", none, Pass},
+		{"rsa simple", "rsa", rsaKey, "simple/simple", none, Pass},
+		{"rsa relaxed/simple", "rsa", rsaKey, "relaxed/simple", none, Pass},
+		{"rsa relaxed spaces", "rsa", rsaKey, "relaxed/relaxed", spaces, Pass},
+		{"rsa simple spaces", "rsa", rsaKey, "simple/simple", spaces, Fail},
+		{"rsa body", "rsa", rsaKey, "relaxed/relaxed", body, Fail},
+		{"rsa subject", "rsa", rsaKey, "relaxed/relaxed", subject, Fail},
+		{"ed25519 relaxed", "ed", edKey, "relaxed/relaxed", none, Pass},
+		{"ed25519 simple", "ed", edKey, "simple/simple", none, Pass},
+		{"ed25519 relaxed spaces", "ed", edKey, "relaxed/relaxed", spaces, Pass},
+		{"ed25519 simple spaces", "ed", edKey, "simple/simple", spaces, Fail},
+		{"ed25519 subject", "ed", edKey, "simple/simple", subject, Fail},
+		{"rsa signature with ed25519 key", "ed", rsaKey, "relaxed/relaxed", none, PermError},
+		{"revoked key", "revoked", rsaKey, "relaxed/relaxed", none, PermError},
+		{"missing key", "missing", rsaKey, "relaxed/relaxed", none, PermError},
+	}
+	for _, c := range cases {
+		data := c.change(signTest(t, dkimMessage, c.selector, c.key, c.canon))
+		results := DKIM(fixtures, []byte(data))
+		if len(results) != 1 {
+			t.Errorf("%s: %d results", c.name, len(results))
+			continue
+		}
+		if results[0].Result != c.want {
+			t.Errorf("%s: %s (%s), want %s", c.name, results[0].Result, results[0].Reason, c.want)
+		}
+	}
+
+	// signatures made by Sign are verified
+	for _, key := range []crypto.Signer{rsaKey, edKey} {
+		selector := "rsa"
+		if _, ok := key.(ed25519.PrivateKey); ok {
+			selector = "ed"
+		}
+		field, err := Sign([]byte(dkimMessage), "foobar.com", selector, key, SIGNHEADERS)
+		if err != nil {
+			t.Fatal(err)
+		}
+		results := DKIM(fixtures, []byte(field+dkimMessage))
+		if len(results) != 1 || results[0].Result != Pass {
+			t.Errorf("Sign %s: %+v", selector, results)
+		}
+	}
+}
+
+func TestDMARC(t *testing.T) {
+	fixtures := &Fixtures{TXT: map[string][]string{
+		"_dmarc.foobar.com":     {"v=DMARC1; p=reject"},
+		"_dmarc.strict.com":     {"v=DMARC1; p=quarantine; aspf=s; adkim=s"},
+		"_dmarc.example.co.uk":  {"v=DMARC1; p=none; sp=reject"},
+		"_dmarc.broken.com":     {"v=DMARC1; p=maybe"},
+		"_dmarc.two.com":        {"v=DMARC1; p=none", "v=DMARC1; p=reject"},
+		"_dmarc.other.com":      {"something else"},
+		"_dmarc.sub.foobar.com": {"v=DMARC1; p=none"},
+	}}
+	cases := []struct {
+		from       string
+		spf        string
+		spfDomain  string
+		dkim       []DKIMResult
+		want       string
+		wantPolicy string
+	}{
+		{"foobar.com", Pass, "foobar.com", nil, Pass, "reject"},
+		{"foobar.com", Pass, "mail.foobar.com", nil, Pass, "reject"},
+		{"foobar.com", Pass, "foobar.net", nil, Fail, "reject"},
+		{"foobar.com", Fail, "foobar.com", nil, Fail, "reject"},
+		{"foobar.com", Fail, "foobar.com", []DKIMResult{{Domain: "news.foobar.com", Result: Pass}}, Pass, "reject"},
+		{"foobar.com", Fail, "foobar.com", []DKIMResult{{Domain: "foobar.com", Result: Fail}}, Fail, "reject"},
+		{"foobar.com", Fail, "foobar.com", []DKIMResult{{Domain: "evil.com", Result: Pass}}, Fail, "reject"},
+
+		// strict alignment
+		{"strict.com", Pass, "strict.com", nil, Pass, "quarantine"},
+		{"strict.com", Pass, "mail.strict.com", nil, Fail, "quarantine"},
+		{"strict.com", None, "", []DKIMResult{{Domain: "mail.strict.com", Result: Pass}}, Fail, "quarantine"},
+
+		// record of the organizational domain, sp for subdomains
+		{"mail.example.co.uk", Pass, "example.co.uk", nil, Pass, "reject"},
+		{"example.co.uk", Pass, "example.co.uk", nil, Pass, "none"},
+		{"news.foobar.com", Fail, "", nil, Fail, "reject"},
+		{"sub.foobar.com", Fail, "", nil, Fail, "none"},
+
+		{"nothing.com", Pass, "nothing.com", nil, None, ""},
+		{"other.com", Pass, "other.com", nil, None, ""},
+		{"", Pass, "foobar.com", nil, None, ""},
+		{"broken.com", Pass, "broken.com", nil, PermError, ""},
+		{"two.com", Pass, "two.com", nil, PermError, ""},
+	}
+	for _, c := range cases {
+		got, policy := DMARC(fixtures, c.from, c.spf, c.spfDomain, c.dkim)
+		if got != c.want || policy != c.wantPolicy {
+			t.Errorf("DMARC %s (spf %s %s, dkim %v): %s p=%s, want %s p=%s", c.from, c.spf, c.spfDomain, c.dkim, got, policy, c.want, c.wantPolicy)
+		}
+	}
+}
+
+func TestOrgDomain(t *testing.T) {
+	cases := map[string]string{
+		"foobar.com":          "foobar.com",
+		"mail.foobar.com":     "foobar.com",
+		"a.b.mail.foobar.com": "foobar.com",
+		"FOOBAR.COM.":         "foobar.com",
+		"example.co.uk":       "example.co.uk",
+		"mail.example.co.uk":  "example.co.uk",
+		"mail.example.com.pl": "example.com.pl",
+		"mail.example.de":     "example.de",
+		"com":                 "com",
+	}
+	for domain, want := range cases {
+		if got := OrgDomain(domain); got != want {
+			t.Errorf("OrgDomain(%s): %s, want %s", domain, got, want)
+		}
+	}
+}
@@ -0,0 +1,364 @@
+package auth
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ed25519"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+/*
+  Algorithms of the signatures
+*/
+const RSASHA256 string = "rsa-sha256"
+const ED25519SHA256 string = "ed25519-sha256"
+
+/*
+  Result of one DKIM-Signature
+*/
+type DKIMResult struct {
+	Domain   string
+	Selector string
+	Result   string
+	Reason   string
+}
+
+/*
+  One header field, Raw is the whole field with
+  the continuation lines and CRLF at the end
+*/
+type headerField struct {
+	Name string
+	Raw  string
+}
+
+/*
+  Split the e-mail to header fields and body,
+  line ends are changed to CRLF
+*/
+func splitMessage(data []byte) ([]headerField, []byte) {
+	data = crlf(data)
+	end := bytes.Index(data, []byte("\r\n\r\n"))
+	var head, body []byte
+	if end < 0 {
+		head = data
+	} else {
+		head, body = data[:end+2], data[end+4:]
+	}
+
+	var fields []headerField
+	for _, line := range strings.SplitAfter(string(head), "\r\n") {
+		if line == "" {
+			continue
+		}
+		if (line[0] == ' ' || line[0] == '\t') && len(fields) > 0 {
+			fields[len(fields)-1].Raw += line
+			continue
+		}
+		name := line
+		if i := strings.IndexByte(line, ':'); i >= 0 {
+			name = line[:i]
+		}
+		fields = append(fields, headerField{Name: strings.TrimSpace(name), Raw: line})
+	}
+	return fields, body
+}
+
+func crlf(data []byte) []byte {
+	if !bytes.Contains(data, []byte("\n")) || bytes.Count(data, []byte("\r\n")) == bytes.Count(data, []byte("\n")) {
+		return data
+	}
+	data = bytes.Replace(data, []byte("\r\n"), []byte("\n"), -1)
+	return bytes.Replace(data, []byte("\n"), []byte("\r\n"), -1)
+}
+
+/*
+  Canonicalization of the header field (RFC 6376 3.4.1 and 3.4.2)
+*/
+func canonHeader(f headerField, relaxed bool) string {
+	if !relaxed {
+		return f.Raw
+	}
+	value := f.Raw[strings.IndexByte(f.Raw, ':')+1:]
+	value = strings.Replace(value, "\r\n", "", -1)
+	value = strings.Join(strings.Fields(value), " ")
+	return strings.ToLower(f.Name) + ":" + value + "\r\n"
+}
+
+/*
+  Canonicalization of the body (RFC 6376 3.4.3 and 3.4.4)
+*/
+func canonBody(body []byte, relaxed bool) []byte {
+	lines := strings.Split(string(body), "\r\n")
+	if relaxed {
+		for i, l := range lines {
+			l = strings.TrimRight(l, " \t")
+			lines[i] = strings.Join(strings.FieldsFunc(l, func(r rune) bool { return r == ' ' || r == '\t' }), " ")
+			if strings.HasPrefix(l, " ") || strings.HasPrefix(l, "\t") {
+				lines[i] = " " + lines[i]
+			}
+		}
+	}
+	for len(lines) > 0 && lines[len(lines)-1] == "" {
+		lines = lines[:len(lines)-1]
+	}
+	if len(lines) == 0 {
+		if relaxed {
+			return nil
+		}
+		return []byte("\r\n")
+	}
+	return []byte(strings.Join(lines, "\r\n") + "\r\n")
+}
+
+/*
+  Header fields to hash: for every name the last one which
+  was not used yet, missing fields are skipped
+*/
+func selectHeaders(fields []headerField, names []string, relaxed bool) string {
+	used := map[int]bool{}
+	var b strings.Builder
+	for _, name := range names {
+		for i := len(fields) - 1; i >= 0; i-- {
+			if !used[i] && strings.EqualFold(fields[i].Name, strings.TrimSpace(name)) {
+				used[i] = true
+				b.WriteString(canonHeader(fields[i], relaxed))
+				break
+			}
+		}
+	}
+	return b.String()
+}
+
+/*
+  Tags of the signature or the key record, "a=b; c=d"
+*/
+func parseTags(s string) (map[string]string, error) {
+	tags := map[string]string{}
+	for _, t := range strings.Split(s, ";") {
+		if strings.TrimSpace(t) == "" {
+			continue
+		}
+		kv := strings.SplitN(t, "=", 2)
+		if len(kv) != 2 {
+			return nil, fmt.Errorf("wrong tag %q", strings.TrimSpace(t))
+		}
+		name := strings.TrimSpace(kv[0])
+		if _, ok := tags[name]; ok {
+			return nil, fmt.Errorf("duplicated tag %s", name)
+		}
+		tags[name] = strings.TrimSpace(kv[1])
+	}
+	return tags, nil
+}
+
+/*
+  Value of b= removed from the signature field, for the hash
+*/
+func removeSignature(raw string) string {
+	i := strings.IndexByte(raw, ':') + 1
+	parts := strings.Split(raw[i:], ";")
+	for j, p := range parts {
+		kv := strings.SplitN(p, "=", 2)
+		if len(kv) == 2 && strings.TrimSpace(kv[0]) == "b" {
+			parts[j] = kv[0] + "="
+		}
+	}
+	out := raw[:i] + strings.Join(parts, ";")
+	if strings.HasSuffix(raw, "\r\n") && !strings.HasSuffix(out, "\r\n") {
+		out += "\r\n"
+	}
+	return out
+}
+
+func removeWhitespace(s string) string {
+	return strings.Join(strings.Fields(s), "")
+}
+
+/*
+  Verify all DKIM-Signature fields of the e-mail
+*/
+func DKIM(r Resolver, data []byte) []DKIMResult {
+	fields, body := splitMessage(data)
+	var results []DKIMResult
+	for _, f := range fields {
+		if strings.EqualFold(f.Name, "DKIM-Signature") {
+			results = append(results, verify(r, fields, body, f))
+		}
+	}
+	return results
+}
+
+func verify(r Resolver, fields []headerField, body []byte, sig headerField) DKIMResult {
+	res := DKIMResult{Result: PermError}
+	tags, err := parseTags(strings.Replace(sig.Raw[strings.IndexByte(sig.Raw, ':')+1:], "\r\n", "", -1))
+	if err != nil {
+		res.Reason = err.Error()
+		return res
+	}
+	res.Domain = strings.ToLower(tags["d"])
+	res.Selector = tags["s"]
+	for _, t := range []string{"v", "a", "b", "bh", "d", "h", "s"} {
+		if tags[t] == "" {
+			res.Reason = "missing tag " + t
+			return res
+		}
+	}
+	if tags["v"] != "1" {
+		res.Reason = "wrong version " + tags["v"]
+		return res
+	}
+	if x := tags["x"]; x != "" {
+		if exp, err := strconv.ParseInt(x, 10, 64); err == nil && time.Now().Unix() > exp {
+			res.Reason = "signature expired"
+			return res
+		}
+	}
+	names := strings.Split(tags["h"], ":")
+	from := false
+	for _, n := range names {
+		if strings.EqualFold(strings.TrimSpace(n), "From") {
+			from = true
+		}
+	}
+	if !from {
+		res.Reason = "From is not signed"
+		return res
+	}
+
+	headerCanon, bodyCanon := "simple", "simple"
+	if c := tags["c"]; c != "" {
+		cs := strings.SplitN(c, "/", 2)
+		headerCanon = cs[0]
+		if len(cs) == 2 {
+			bodyCanon = cs[1]
+		}
+	}
+	for _, c := range []string{headerCanon, bodyCanon} {
+		if c != "simple" && c != "relaxed" {
+			res.Reason = "unknown canonicalization " + c
+			return res
+		}
+	}
+
+	algorithm := strings.ToLower(tags["a"])
+	if algorithm != RSASHA256 && algorithm != ED25519SHA256 {
+		res.Reason = "unsupported algorithm " + algorithm
+		return res
+	}
+
+	// body hash
+	canon := canonBody(body, bodyCanon == "relaxed")
+	if l := tags["l"]; l != "" {
+		n, err := strconv.Atoi(l)
+		if err != nil || n < 0 || n > len(canon) {
+			res.Reason = "wrong body length " + l
+			return res
+		}
+		canon = canon[:n]
+	}
+	bh := sha256.Sum256(canon)
+	if base64.StdEncoding.EncodeToString(bh[:]) != removeWhitespace(tags["bh"]) {
+		res.Result = Fail
+		res.Reason = "body hash doesn't match"
+		return res
+	}
+	signature, err := base64.StdEncoding.DecodeString(removeWhitespace(tags["b"]))
+	if err != nil {
+		res.Reason = "wrong signature: " + err.Error()
+		return res
+	}
+
+	key, result, why := publicKey(r, res.Selector, res.Domain)
+	if key == nil {
+		res.Result = result
+		res.Reason = why
+		return res
+	}
+
+	// header hash, signature field is the last one without CRLF
+	relaxed := headerCanon == "relaxed"
+	h := selectHeaders(fields, names, relaxed)
+	h += strings.TrimSuffix(canonHeader(headerField{Name: sig.Name, Raw: removeSignature(sig.Raw)}, relaxed), "\r\n")
+	hash := sha256.Sum256([]byte(h))
+
+	switch k := key.(type) {
+	case *rsa.PublicKey:
+		if algorithm != RSASHA256 {
+			res.Reason = "key type doesn't match " + algorithm
+			return res
+		}
+		err = rsa.VerifyPKCS1v15(k, crypto.SHA256, hash[:], signature)
+	case ed25519.PublicKey:
+		if algorithm != ED25519SHA256 {
+			res.Reason = "key type doesn't match " + algorithm
+			return res
+		}
+		if !ed25519.Verify(k, hash[:], signature) {
+			err = fmt.Errorf("verification error")
+		}
+	}
+	if err != nil {
+		res.Result = Fail
+		res.Reason = "signature doesn't match"
+		return res
+	}
+	res.Result = Pass
+	res.Reason = "signature is valid"
+	return res
+}
+
+/*
+  Public key from selector._domainkey.domain
+*/
+func publicKey(r Resolver, selector, domain string) (crypto.PublicKey, string, string) {
+	name := selector + "._domainkey." + domain
+	txt, err := r.LookupTXT(name)
+	if err == ErrNotFound {
+		return nil, PermError, "no key " + name
+	}
+	if err != nil {
+		return nil, TempError, err.Error()
+	}
+	tags, err := parseTags(strings.Join(txt, ""))
+	if err != nil {
+		return nil, PermError, name + ": " + err.Error()
+	}
+	if v, ok := tags["v"]; ok && v != "DKIM1" {
+		return nil, PermError, name + ": wrong version " + v
+	}
+	p := removeWhitespace(tags["p"])
+	if p == "" {
+		return nil, PermError, name + ": key is revoked"
+	}
+	der, err := base64.StdEncoding.DecodeString(p)
+	if err != nil {
+		return nil, PermError, name + ": wrong key"
+	}
+
+	switch tags["k"] {
+	case "", "rsa":
+		if key, err := x509.ParsePKIXPublicKey(der); err == nil {
+			if k, ok := key.(*rsa.PublicKey); ok {
+				return k, "", ""
+			}
+		}
+		if k, err := x509.ParsePKCS1PublicKey(der); err == nil {
+			return k, "", ""
+		}
+		return nil, PermError, name + ": wrong RSA key"
+	case "ed25519":
+		if len(der) != ed25519.PublicKeySize {
+			return nil, PermError, name + ": wrong ed25519 key"
+		}
+		return ed25519.PublicKey(der), "", ""
+	}
+	return nil, PermError, name + ": unknown key type " + tags["k"]
+}
@@ -0,0 +1,99 @@
+package auth
+
+import (
+	"strings"
+)
+
+/*
+  DMARC check of the From domain. SPF and DKIM results
+  are aligned with it. Returns result and policy.
+*/
+func DMARC(r Resolver, fromDomain, spf, spfDomain string, dkim []DKIMResult) (string, string) {
+	if fromDomain == "" {
+		return None, ""
+	}
+	tags, sub, result := dmarcRecord(r, fromDomain)
+	if tags == nil {
+		return result, ""
+	}
+
+	policy := tags["p"]
+	if sub && tags["sp"] != "" {
+		policy = tags["sp"]
+	}
+	switch policy {
+	case "none", "quarantine", "reject":
+	default:
+		return PermError, ""
+	}
+
+	if spf == Pass && aligned(fromDomain, spfDomain, tags["aspf"]) {
+		return Pass, policy
+	}
+	for _, d := range dkim {
+		if d.Result == Pass && aligned(fromDomain, d.Domain, tags["adkim"]) {
+			return Pass, policy
+		}
+	}
+	return Fail, policy
+}
+
+/*
+  Record of the domain or of the organizational domain,
+  sub is true when it's the record of the organizational one
+*/
+func dmarcRecord(r Resolver, domain string) (map[string]string, bool, string) {
+	names := []string{domain}
+	if org := OrgDomain(domain); org != domain {
+		names = append(names, org)
+	}
+	for i, name := range names {
+		txt, err := r.LookupTXT("_dmarc." + name)
+		if err != nil && err != ErrNotFound {
+			return nil, false, TempError
+		}
+		var records []string
+		for _, t := range txt {
+			if strings.HasPrefix(t, "v=DMARC1") {
+				records = append(records, t)
+			}
+		}
+		switch len(records) {
+		case 0:
+			continue
+		case 1:
+			tags, err := parseTags(records[0])
+			if err != nil {
+				return nil, false, PermError
+			}
+			return tags, i > 0, ""
+		}
+		return nil, false, PermError
+	}
+	return nil, false, None
+}
+
+func aligned(fromDomain, domain, mode string) bool {
+	fromDomain, domain = strings.ToLower(fromDomain), strings.ToLower(domain)
+	if mode == "s" {
+		return fromDomain == domain
+	}
+	return domain != "" && OrgDomain(fromDomain) == OrgDomain(domain)
+}
+
+/*
+  Organizational domain, without the public suffix list:
+  last two labels, three for the country domains with
+  a short second level like co.uk or com.pl
+*/
+func OrgDomain(domain string) string {
+	labels := strings.Split(strings.TrimSuffix(strings.ToLower(domain), "."), ".")
+	n := 2
+	if len(labels) > 2 && len(labels[len(labels)-1]) == 2 && len(labels[len(labels)-2]) <= 3 {
+		n = 3
+	}
+	if len(labels) <= n {
+		return strings.Join(labels, ".")
+	}
+	return strings.Join(labels[len(labels)-n:], ".")
+}
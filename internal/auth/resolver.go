@@ -0,0 +1,148 @@
+package auth
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"net"
+	"strings"
+	"time"
+)
+
+/*
+  DNSTIMEOUT: timeout of one DNS lookup
+*/
+const DNSTIMEOUT time.Duration = 5 * time.Second
+
+/*
+  Record doesn't exist, other errors are temporary
+*/
+var ErrNotFound = errors.New("record not found")
+
+/*
+  DNS lookups needed by the checks
+*/
+type Resolver interface {
+	LookupTXT(name string) ([]string, error)
+	LookupIP(host string) ([]net.IP, error)
+	LookupMX(name string) ([]string, error)
+}
+
+/*
+  Resolver using the system DNS
+*/
+type DNS struct {
+	Timeout time.Duration
+}
+
+func (d DNS) ctx() (context.Context, context.CancelFunc) {
+	timeout := d.Timeout
+	if timeout == 0 {
+		timeout = DNSTIMEOUT
+	}
+	return context.WithTimeout(context.Background(), timeout)
+}
+
+func (d DNS) LookupTXT(name string) ([]string, error) {
+	ctx, cancel := d.ctx()
+	defer cancel()
+	txt, err := net.DefaultResolver.LookupTXT(ctx, name)
+	return txt, dnsError(err)
+}
+
+func (d DNS) LookupIP(host string) ([]net.IP, error) {
+	ctx, cancel := d.ctx()
+	defer cancel()
+	addrs, err := net.DefaultResolver.LookupIPAddr(ctx, host)
+	var ips []net.IP
+	for _, a := range addrs {
+		ips = append(ips, a.IP)
+	}
+	return ips, dnsError(err)
+}
+
+func (d DNS) LookupMX(name string) ([]string, error) {
+	ctx, cancel := d.ctx()
+	defer cancel()
+	mxs, err := net.DefaultResolver.LookupMX(ctx, name)
+	var hosts []string
+	for _, mx := range mxs {
+		hosts = append(hosts, strings.TrimSuffix(mx.Host, "."))
+	}
+	return hosts, dnsError(err)
+}
+
+func dnsError(err error) error {
+	var dnsErr *net.DNSError
+	if errors.As(err, &dnsErr) && dnsErr.IsNotFound {
+		return ErrNotFound
+	}
+	return err
+}
+
+/*
+  Resolver with the records from a file, for tests and
+  the policy replay, e.g.
+    {
+      "txt": {"foobar.com": ["v=spf1 ip4:192.0.2.0/24 -all"]},
+      "a": {"mail.foobar.com": ["192.0.2.1"]},
+      "mx": {"foobar.com": ["mail.foobar.com"]}
+    }
+  Names are not case sensitive, names which are not in
+  the file don't exist.
+*/
+type Fixtures struct {
+	TXT map[string][]string `json:"txt"`
+	A   map[string][]string `json:"a"`
+	MX  map[string][]string `json:"mx"`
+}
+
+/*
+  Read fixtures file
+*/
+func LoadFixtures(file string) (*Fixtures, error) {
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	f := &Fixtures{}
+	if err := json.Unmarshal(data, f); err != nil {
+		return nil, err
+	}
+	for _, ips := range f.A {
+		for _, ip := range ips {
+			if net.ParseIP(ip) == nil {
+				return nil, errors.New("wrong IP address " + ip)
+			}
+		}
+	}
+	return f, nil
+}
+
+func lookup(records map[string][]string, name string) ([]string, error) {
+	name = strings.TrimSuffix(strings.ToLower(name), ".")
+	for k, v := range records {
+		if strings.TrimSuffix(strings.ToLower(k), ".") == name {
+			return v, nil
+		}
+	}
+	return nil, ErrNotFound
+}
+
+func (f *Fixtures) LookupTXT(name string) ([]string, error) {
+	return lookup(f.TXT, name)
+}
+
+func (f *Fixtures) LookupIP(host string) ([]net.IP, error) {
+	list, err := lookup(f.A, host)
+	var ips []net.IP
+	for _, s := range list {
+		ips = append(ips, net.ParseIP(s))
+	}
+	return ips, err
+}
+
+func (f *Fixtures) LookupMX(name string) ([]string, error) {
+	return lookup(f.MX, name)
+}
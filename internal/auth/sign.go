@@ -0,0 +1,247 @@
+package auth
+
+import (
+	"crypto"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"strings"
+	"time"
+)
+
+/*
+  Headers signed when they are in the e-mail, From is always signed
+*/
+var SIGNHEADERS = []string{"From", "Reply-To", "To", "Cc", "Subject", "Date", "Message-ID",
+	"In-Reply-To", "References", "MIME-Version", "Content-Type", "Content-Transfer-Encoding"}
+
+/*
+  Signing key of the domain, file is PEM with RSA
+  (PKCS #1 or #8) or ed25519 (PKCS #8) private key.
+  Domain can have more keys, e.g. RSA and ed25519.
+*/
+type SignKey struct {
+	Domain   string `json:"domain"`
+	Selector string `json:"selector"`
+	File     string `json:"key"`
+	signer   crypto.Signer
+}
+
+/*
+  DKIM signing configuration, e.g.
+    {"keys": [{"domain": "foobar.com", "selector": "mail2026", "key": "/etc/mailproxy/foobar.com.pem"}]}
+  Headers: signed headers, SIGNHEADERS when empty
+*/
+type SignConfig struct {
+	Keys    []SignKey `json:"keys"`
+	Headers []string  `json:"headers,omitempty"`
+}
+
+/*
+  Read configuration and the keys. Keys which can't be
+  used are left out and returned as errors, other domains
+  are still signed.
+*/
+func LoadSignConfig(file string) (*SignConfig, []error, error) {
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, nil, err
+	}
+	c := &SignConfig{}
+	if err := json.Unmarshal(data, c); err != nil {
+		return nil, nil, fmt.Errorf("%s: %v", file, err)
+	}
+	var keys []SignKey
+	var errs []error
+	for i, k := range c.Keys {
+		if k.Domain == "" || k.Selector == "" || k.File == "" {
+			errs = append(errs, fmt.Errorf("%s: keys[%d]: domain, selector and key are required", file, i))
+			continue
+		}
+		k.Domain = strings.ToLower(k.Domain)
+		if k.signer, err = ReadKey(k.File); err != nil {
+			errs = append(errs, fmt.Errorf("%s: keys[%d]: %v", file, i, err))
+			continue
+		}
+		keys = append(keys, k)
+	}
+	c.Keys = keys
+	return c, errs, nil
+}
+
+/*
+  Read private key from the PEM file
+*/
+func ReadKey(file string) (crypto.Signer, error) {
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, fmt.Errorf("%s: no PEM data", file)
+	}
+	if block.Type == "RSA PRIVATE KEY" {
+		return x509.ParsePKCS1PrivateKey(block.Bytes)
+	}
+	key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", file, err)
+	}
+	switch k := key.(type) {
+	case *rsa.PrivateKey:
+		return k, nil
+	case ed25519.PrivateKey:
+		return k, nil
+	}
+	return nil, fmt.Errorf("%s: key must be RSA or ed25519", file)
+}
+
+/*
+  Sign the e-mail with all keys of the From domain. E-mail
+  is returned as it is when the domain has no keys. Key which
+  can't sign is skipped, e-mail is signed by the others and
+  the error is returned with it.
+*/
+func (c *SignConfig) Sign(data []byte) ([]byte, error) {
+	fields, _ := splitMessage(data)
+	from := ""
+	for _, f := range fields {
+		if strings.EqualFold(f.Name, "From") {
+			from = f.Raw[strings.IndexByte(f.Raw, ':')+1:]
+		}
+	}
+	domain := domainOf(strings.TrimSpace(strings.Replace(from, "\r\n", "", -1)))
+	if domain == "" {
+		return data, nil
+	}
+
+	headers := c.Headers
+	if len(headers) == 0 {
+		headers = SIGNHEADERS
+	}
+	// last signature has to be on top, all are over the same e-mail
+	var signatures []string
+	var failed error
+	for _, k := range c.Keys {
+		if k.Domain != domain || signed(fields, k) {
+			continue
+		}
+		sig, err := Sign(data, k.Domain, k.Selector, k.signer, headers)
+		if err != nil {
+			failed = fmt.Errorf("%s %s: %v", k.Domain, k.Selector, err)
+			continue
+		}
+		signatures = append([]string{sig}, signatures...)
+	}
+	if len(signatures) == 0 {
+		return data, failed
+	}
+
+	nl := "\n"
+	if strings.Contains(string(data[:headerEnd(data)]), "\r\n") {
+		nl = "\r\n"
+	}
+	var out []byte
+	for _, sig := range signatures {
+		out = append(out, strings.Replace(sig, "\r\n", nl, -1)...)
+	}
+	return append(out, data...), failed
+}
+
+/*
+  E-mail has the signature of the key already, e.g.
+  it was released again
+*/
+func signed(fields []headerField, k SignKey) bool {
+	for _, f := range fields {
+		if !strings.EqualFold(f.Name, "DKIM-Signature") {
+			continue
+		}
+		tags, err := parseTags(strings.Replace(f.Raw[strings.IndexByte(f.Raw, ':')+1:], "\r\n", "", -1))
+		if err == nil && strings.EqualFold(tags["d"], k.Domain) && tags["s"] == k.Selector {
+			return true
+		}
+	}
+	return false
+}
+
+func headerEnd(data []byte) int {
+	for i := 0; i+1 < len(data); i++ {
+		if data[i] == '\n' && (data[i+1] == '\n' || (data[i+1] == '\r' && i+2 < len(data) && data[i+2] == '\n')) {
+			return i
+		}
+	}
+	return len(data)
+}
+
+/*
+  Return DKIM-Signature field (with CRLF) for the e-mail,
+  relaxed/relaxed canonicalization. Only headers which
+  are in the e-mail are signed, From always.
+*/
+func Sign(data []byte, domain, selector string, key crypto.Signer, headers []string) (string, error) {
+	fields, body := splitMessage(data)
+
+	algorithm := RSASHA256
+	if _, ok := key.(ed25519.PrivateKey); ok {
+		algorithm = ED25519SHA256
+	}
+
+	var names []string
+	for _, h := range headers {
+		for _, f := range fields {
+			if strings.EqualFold(f.Name, h) {
+				names = append(names, strings.ToLower(h))
+				break
+			}
+		}
+	}
+	if len(names) == 0 || names[0] != "from" {
+		names = append([]string{"from"}, names...)
+	}
+
+	bh := sha256.Sum256(canonBody(body, true))
+	value := fmt.Sprintf(" v=1; a=%s; c=relaxed/relaxed; d=%s; s=%s;\r\n\tt=%d; h=%s;\r\n\tbh=%s;\r\n\tb=",
+		algorithm, domain, selector, time.Now().Unix(), strings.Join(names, ":"),
+		base64.StdEncoding.EncodeToString(bh[:]))
+
+	field := headerField{Name: "DKIM-Signature", Raw: "DKIM-Signature:" + value}
+	h := selectHeaders(fields, names, true) + canonHeader(field, true)
+	h = strings.TrimSuffix(h, "\r\n")
+	hash := sha256.Sum256([]byte(h))
+
+	var signature []byte
+	var err error
+	if algorithm == ED25519SHA256 {
+		signature, err = key.Sign(rand.Reader, hash[:], crypto.Hash(0))
+	} else {
+		signature, err = key.Sign(rand.Reader, hash[:], crypto.SHA256)
+	}
+	if err != nil {
+		return "", err
+	}
+	return field.Raw + fold(base64.StdEncoding.EncodeToString(signature)) + "\r\n", nil
+}
+
+/*
+  Fold the signature, lines are not longer than 76 characters
+*/
+func fold(s string) string {
+	var b strings.Builder
+	first := 72 - len("\tb=")
+	for len(s) > first {
+		b.WriteString(s[:first] + "\r\n\t")
+		s = s[first:]
+		first = 72
+	}
+	b.WriteString(s)
+	return b.String()
+}
@@ -0,0 +1,336 @@
+package auth
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+)
+
+/*
+  Results of the checks (RFC 7208, 6376 and 7489)
+*/
+const Pass string = "pass"
+const Fail string = "fail"
+const SoftFail string = "softfail"
+const Neutral string = "neutral"
+const None string = "none"
+const TempError string = "temperror"
+const PermError string = "permerror"
+
+/*
+  MAXLOOKUPS: DNS lookups of one SPF check, more is permerror
+*/
+const MAXLOOKUPS int = 10
+
+var qualifiers = map[byte]string{'+': Pass, '-': Fail, '~': SoftFail, '?': Neutral}
+
+/*
+  SPF check of the domain for the client IP, sender is
+  used only in the macros. Returns result and explanation.
+*/
+func SPF(r Resolver, ip net.IP, domain, sender string) (string, string) {
+	if ip == nil {
+		return None, "no client IP"
+	}
+	s := &spf{r: r, ip: ip, sender: sender}
+	return s.check(strings.ToLower(domain))
+}
+
+type spf struct {
+	r       Resolver
+	ip      net.IP
+	sender  string
+	lookups int
+}
+
+func (s *spf) record(domain string) (string, string, string) {
+	txt, err := s.r.LookupTXT(domain)
+	if err == ErrNotFound {
+		return "", None, "no SPF record for " + domain
+	}
+	if err != nil {
+		return "", TempError, err.Error()
+	}
+	var records []string
+	for _, t := range txt {
+		if strings.EqualFold(t, "v=spf1") || strings.HasPrefix(strings.ToLower(t), "v=spf1 ") {
+			records = append(records, t)
+		}
+	}
+	switch len(records) {
+	case 0:
+		return "", None, "no SPF record for " + domain
+	case 1:
+		return records[0], "", ""
+	}
+	return "", PermError, "more SPF records for " + domain
+}
+
+func (s *spf) lookup() bool {
+	s.lookups++
+	return s.lookups <= MAXLOOKUPS
+}
+
+func (s *spf) check(domain string) (string, string) {
+	record, result, why := s.record(domain)
+	if record == "" {
+		return result, why
+	}
+
+	redirect := ""
+	for _, term := range strings.Fields(record)[1:] {
+		lower := strings.ToLower(term)
+		if i := strings.IndexByte(lower, '='); i > 0 && !strings.ContainsAny(lower[:i], ":/") {
+			if lower[:i] == "redirect" {
+				redirect = term[i+1:]
+			}
+			continue
+		}
+
+		qualifier := Pass
+		if q, ok := qualifiers[term[0]]; ok {
+			qualifier = q
+			term = term[1:]
+		}
+		matched, result, why := s.mechanism(term, domain)
+		if result != "" {
+			return result, why
+		}
+		if matched {
+			return qualifier, fmt.Sprintf("%s matched %s in %s", s.ip, term, domain)
+		}
+	}
+
+	if redirect != "" {
+		if !s.lookup() {
+			return PermError, "too many DNS lookups"
+		}
+		target, err := s.expand(redirect, domain)
+		if err != nil {
+			return PermError, err.Error()
+		}
+		result, why := s.check(target)
+		if result == None {
+			return PermError, why
+		}
+		return result, why
+	}
+	return Neutral, "no mechanism matched in " + domain
+}
+
+/*
+  Check one mechanism, result is set when the check has
+  to stop (errors)
+*/
+func (s *spf) mechanism(term, domain string) (bool, string, string) {
+	name, arg := term, ""
+	if i := strings.IndexAny(term, ":/"); i >= 0 {
+		name, arg = term[:i], term[i:]
+	}
+	name = strings.ToLower(name)
+
+	switch name {
+	case "all":
+		return true, "", ""
+	case "ip4", "ip6":
+		_, network, err := parseNetwork(strings.TrimPrefix(arg, ":"))
+		if err != nil {
+			return false, PermError, err.Error()
+		}
+		return network.Contains(s.ip), "", ""
+	case "ptr":
+		// deprecated, never matches
+		return false, "", ""
+	case "include", "a", "mx", "exists":
+	default:
+		return false, PermError, "unknown mechanism " + term
+	}
+
+	if !s.lookup() {
+		return false, PermError, "too many DNS lookups"
+	}
+	target := domain
+	if strings.HasPrefix(arg, ":") {
+		arg = arg[1:]
+		target = arg
+		if i := strings.IndexByte(arg, '/'); i >= 0 {
+			target, arg = arg[:i], arg[i:]
+		} else {
+			arg = ""
+		}
+	}
+	cidr4, cidr6, err := cidrs(arg)
+	if err != nil {
+		return false, PermError, err.Error()
+	}
+	target, err = s.expand(target, domain)
+	if err != nil {
+		return false, PermError, err.Error()
+	}
+
+	switch name {
+	case "include":
+		result, why := s.check(target)
+		switch result {
+		case Pass:
+			return true, "", ""
+		case Fail, SoftFail, Neutral:
+			return false, "", ""
+		case TempError:
+			return false, TempError, why
+		}
+		return false, PermError, "include: " + why
+	case "exists":
+		ips, err := s.r.LookupIP(target)
+		if err != nil && err != ErrNotFound {
+			return false, TempError, err.Error()
+		}
+		return len(ips) > 0, "", ""
+	case "a":
+		return s.matchHost(target, cidr4, cidr6)
+	}
+
+	hosts, err := s.r.LookupMX(target)
+	if err != nil && err != ErrNotFound {
+		return false, TempError, err.Error()
+	}
+	for i, host := range hosts {
+		if i >= MAXLOOKUPS {
+			return false, PermError, "too many MX records"
+		}
+		if matched, result, why := s.matchHost(host, cidr4, cidr6); matched || result != "" {
+			return matched, result, why
+		}
+	}
+	return false, "", ""
+}
+
+func (s *spf) matchHost(host string, cidr4, cidr6 int) (bool, string, string) {
+	ips, err := s.r.LookupIP(host)
+	if err != nil && err != ErrNotFound {
+		return false, TempError, err.Error()
+	}
+	for _, ip := range ips {
+		bits, size := cidr6, 128
+		if ip.To4() != nil {
+			ip, bits, size = ip.To4(), cidr4, 32
+		}
+		network := &net.IPNet{IP: ip.Mask(net.CIDRMask(bits, size)), Mask: net.CIDRMask(bits, size)}
+		if network.Contains(s.ip) {
+			return true, "", ""
+		}
+	}
+	return false, "", ""
+}
+
+/*
+  Prefix lengths of a and mx, "/24", "//64" or "/24//64"
+*/
+func cidrs(arg string) (int, int, error) {
+	cidr4, cidr6 := 32, 128
+	if arg == "" {
+		return cidr4, cidr6, nil
+	}
+	var err error
+	v4, v6 := "", ""
+	switch {
+	case strings.HasPrefix(arg, "//"):
+		v6 = arg[2:]
+	case strings.HasPrefix(arg, "/"):
+		parts := strings.SplitN(arg[1:], "//", 2)
+		v4 = parts[0]
+		if len(parts) == 2 {
+			v6 = parts[1]
+		}
+	default:
+		return 0, 0, fmt.Errorf("wrong prefix length %s", arg)
+	}
+	if v4 != "" {
+		if cidr4, err = strconv.Atoi(v4); err != nil || cidr4 < 0 || cidr4 > 32 {
+			return 0, 0, fmt.Errorf("wrong prefix length %s", arg)
+		}
+	}
+	if v6 != "" {
+		if cidr6, err = strconv.Atoi(v6); err != nil || cidr6 < 0 || cidr6 > 128 {
+			return 0, 0, fmt.Errorf("wrong prefix length %s", arg)
+		}
+	}
+	return cidr4, cidr6, nil
+}
+
+func parseNetwork(s string) (net.IP, *net.IPNet, error) {
+	if !strings.Contains(s, "/") {
+		if ip := net.ParseIP(s); ip != nil {
+			if ip.To4() != nil {
+				s += "/32"
+			} else {
+				s += "/128"
+			}
+		}
+	}
+	return net.ParseCIDR(s)
+}
+
+/*
+  Expand macros of the domain spec, transformers
+  (digits, r and delimiters) are not supported
+*/
+func (s *spf) expand(spec, domain string) (string, error) {
+	if !strings.Contains(spec, "%") {
+		return spec, nil
+	}
+	local, senderDomain := "postmaster", domain
+	if i := strings.LastIndex(s.sender, "@"); i >= 0 {
+		if i > 0 {
+			local = s.sender[:i]
+		}
+		senderDomain = s.sender[i+1:]
+	}
+
+	var b strings.Builder
+	for i := 0; i < len(spec); i++ {
+		if spec[i] != '%' {
+			b.WriteByte(spec[i])
+			continue
+		}
+		if i+1 >= len(spec) {
+			return "", fmt.Errorf("wrong macro in %s", spec)
+		}
+		i++
+		switch spec[i] {
+		case '%':
+			b.WriteByte('%')
+			continue
+		case '_':
+			b.WriteByte(' ')
+			continue
+		case '-':
+			b.WriteString("%20")
+			continue
+		case '{':
+		default:
+			return "", fmt.Errorf("wrong macro in %s", spec)
+		}
+		end := strings.IndexByte(spec[i:], '}')
+		if end != 2 {
+			return "", fmt.Errorf("unsupported macro in %s", spec)
+		}
+		switch spec[i+1] {
+		case 's', 'S':
+			b.WriteString(s.sender)
+		case 'l', 'L':
+			b.WriteString(local)
+		case 'o', 'O':
+			b.WriteString(senderDomain)
+		case 'd', 'D':
+			b.WriteString(domain)
+		case 'i', 'I':
+			b.WriteString(s.ip.String())
+		default:
+			return "", fmt.Errorf("unsupported macro in %s", spec)
+		}
+		i += end
+	}
+	return b.String(), nil
+}
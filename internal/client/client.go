@@ -0,0 +1,234 @@
+/*
+  Package client is sending events from the filter to the mailProxy API.
+
+  Every event which cannot be delivered is written to the spool
+  directory and sent again on the next call or Flush (the filter
+  is calling it on every run), so we are not losing any blocked
+  mail when API is down.
+*/
+package client
+
+import (
+	"bytes"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+/*
+  Config structure
+  URL: full URL of the endpoint, e.g. http://localhost:8080/mails
+  Timeout: timeout of one request
+  Retries: how many times we are trying before spooling the event
+  Token: bearer token, empty for none
+  CertFile, KeyFile: client certificate for mTLS
+  CAFile: CA used to verify the API certificate
+  SpoolDir: directory for the pending events, empty for none
+*/
+type Config struct {
+	URL      string
+	Timeout  time.Duration
+	Retries  int
+	Token    string
+	CertFile string
+	KeyFile  string
+	CAFile   string
+	SpoolDir string
+}
+
+type Client struct {
+	config Config
+	http   *http.Client
+}
+
+/*
+  StatusError is returned when API is answering with non 2xx code
+*/
+type StatusError struct {
+	Code int
+	Body string
+}
+
+func (e *StatusError) Error() string {
+	return fmt.Sprintf("API returned %d: %s", e.Code, e.Body)
+}
+
+/*
+  Create new client, TLS files are loaded here, so
+  problems with them are visible before the first call.
+*/
+func New(config Config) (*Client, error) {
+	if config.Timeout == 0 {
+		config.Timeout = 5 * time.Second
+	}
+	if config.Retries < 1 {
+		config.Retries = 1
+	}
+
+	tlsConfig := &tls.Config{}
+	if config.CertFile != "" {
+		cert, err := tls.LoadX509KeyPair(config.CertFile, config.KeyFile)
+		if err != nil {
+			return nil, err
+		}
+		tlsConfig.Certificates = []tls.Certificate{cert}
+	}
+	if config.CAFile != "" {
+		pem, err := ioutil.ReadFile(config.CAFile)
+		if err != nil {
+			return nil, err
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates in %s", config.CAFile)
+		}
+		tlsConfig.RootCAs = pool
+	}
+
+	c := &Client{
+		config: config,
+		http: &http.Client{
+			Timeout:   config.Timeout,
+			Transport: &http.Transport{TLSClientConfig: tlsConfig},
+		},
+	}
+	return c, nil
+}
+
+/*
+  Send event to the API. Pending events from the spool
+  are sent first. If we cannot send it, event is spooled
+  and error is returned.
+*/
+func (c *Client) Send(event interface{}) error {
+	body, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+
+	c.Flush()
+
+	err = c.post(body)
+	if err == nil {
+		return nil
+	}
+	if se, ok := err.(*StatusError); ok && se.Code < 500 {
+		return err
+	}
+	if spoolErr := c.spool(body); spoolErr != nil {
+		return fmt.Errorf("%v (spool: %v)", err, spoolErr)
+	}
+	return err
+}
+
+/*
+  Send all pending events from the spool. Returns number
+  of events still waiting. Events rejected by the API
+  (4xx) are renamed to *.rejected and not sent again.
+*/
+func (c *Client) Flush() int {
+	if c.config.SpoolDir == "" {
+		return 0
+	}
+	files, err := filepath.Glob(filepath.Join(c.config.SpoolDir, "*.json"))
+	if err != nil {
+		return 0
+	}
+
+	for i, f := range files {
+		// rename is atomic, so two filters are not sending the same event
+		sending := f + ".sending"
+		if err := os.Rename(f, sending); err != nil {
+			continue
+		}
+		body, err := ioutil.ReadFile(sending)
+		if err == nil {
+			err = c.post(body)
+		}
+		if se, ok := err.(*StatusError); ok && se.Code < 500 {
+			// API doesn't want it, keep it for investigation
+			os.Rename(sending, f+".rejected")
+			continue
+		}
+		if err != nil {
+			// API is still down, no reason to try the rest
+			os.Rename(sending, f)
+			return len(files) - i
+		}
+		os.Remove(sending)
+	}
+	return 0
+}
+
+/*
+  POST body to the API with retries
+*/
+func (c *Client) post(body []byte) error {
+	var err error
+	for i := 0; i < c.config.Retries; i++ {
+		if i > 0 {
+			time.Sleep(time.Duration(i) * 500 * time.Millisecond)
+		}
+		err = c.postOnce(body)
+		if err == nil {
+			return nil
+		}
+		// API has seen it and doesn't want it, retry will not help
+		if se, ok := err.(*StatusError); ok && se.Code < 500 {
+			return err
+		}
+	}
+	return err
+}
+
+func (c *Client) postOnce(body []byte) error {
+	req, err := http.NewRequest("POST", c.config.URL, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json; charset=utf-8")
+	if c.config.Token != "" {
+		req.Header.Set("Authorization", "Bearer "+c.config.Token)
+	}
+
+	res, err := c.http.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode < 200 || res.StatusCode > 299 {
+		b, _ := ioutil.ReadAll(io.LimitReader(res.Body, 512))
+		return &StatusError{Code: res.StatusCode, Body: strings.TrimSpace(string(b))}
+	}
+	io.Copy(ioutil.Discard, res.Body)
+	return nil
+}
+
+/*
+  Write event to the spool. File is written under
+  temporary name first, so Flush never sees half of it.
+*/
+func (c *Client) spool(body []byte) error {
+	if c.config.SpoolDir == "" {
+		return fmt.Errorf("no spool directory")
+	}
+	if err := os.MkdirAll(c.config.SpoolDir, 0700); err != nil {
+		return err
+	}
+	name := strconv.FormatInt(time.Now().UnixNano(), 10) + "-" + strconv.Itoa(os.Getpid())
+	tmp := filepath.Join(c.config.SpoolDir, name+".tmp")
+	if err := ioutil.WriteFile(tmp, body, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, filepath.Join(c.config.SpoolDir, name+".json"))
+}
@@ -0,0 +1,261 @@
+/*
+  Package content is walking MIME parts of the e-mail and decoding
+  them, so DLP and attachment checks can look at the real content.
+*/
+package content
+
+import (
+	"bytes"
+	"encoding/base64"
+	"fmt"
+	"html"
+	"io"
+	"io/ioutil"
+	"mime"
+	"mime/multipart"
+	"mime/quotedprintable"
+	"net/mail"
+	"net/textproto"
+	"regexp"
+	"strings"
+
+	"golang.org/x/text/encoding/htmlindex"
+)
+
+/*
+  Limits, nobody needs more, it's rather an attack
+  MAXDEPTH: nested multiparts and attached e-mails
+  MAXPARTS: parts in one e-mail
+  MAXPARTSIZE: decoded bytes kept from one part
+*/
+const MAXDEPTH int = 10
+const MAXPARTS int = 500
+const MAXPARTSIZE int64 = 25 << 20
+
+/*
+  One leaf part of the e-mail
+  Path: position in the e-mail, e.g. "1.2" ("" is the e-mail itself)
+  ContentType: declared media type, lower case
+  Charset: declared charset of the text parts
+  Filename: file name from Content-Disposition or Content-Type
+  Disposition: inline or attachment
+  Size: decoded size, even when Data is truncated
+  Data: content decoded from base64 or quoted-printable
+  Truncated: part was bigger than MAXPARTSIZE
+  Broken: transfer encoding is broken, Data is what was decoded
+*/
+type Part struct {
+	Path        string
+	ContentType string
+	Charset     string
+	Filename    string
+	Disposition string
+	Header      textproto.MIMEHeader
+	Size        int64
+	Data        []byte
+	Truncated   bool
+	Broken      bool
+}
+
+/*
+  Attachment is a part with the file name or attachment disposition
+*/
+func (p Part) IsAttachment() bool {
+	return p.Disposition == "attachment" || p.Filename != ""
+}
+
+var tags = regexp.MustCompile(`(?s)<(script|style)[^>]*>.*?</(script|style)>|<[^>]*>`)
+
+/*
+  Text of the part in UTF-8, HTML without tags.
+  Empty for parts which are not text.
+*/
+func (p Part) Text() string {
+	if !strings.HasPrefix(p.ContentType, "text/") {
+		return ""
+	}
+	text := decodeCharset(p.Charset, p.Data)
+	if p.ContentType == "text/html" {
+		text = HTMLText(text)
+	}
+	return text
+}
+
+/*
+  Text of the HTML without tags, scripts and styles
+*/
+func HTMLText(s string) string {
+	return html.UnescapeString(tags.ReplaceAllString(s, " "))
+}
+
+/*
+  Walk the e-mail and return all leaf parts, attached
+  e-mails (message/rfc822) are walked too. Error is
+  returned for the part which was not read completely
+  too, parts are returned anyway.
+*/
+func Walk(m *mail.Message) ([]Part, error) {
+	var parts []Part
+	h := textproto.MIMEHeader(m.Header)
+	if err := walk(h, m.Body, "", 0, &parts); err != nil {
+		return parts, err
+	}
+	for _, p := range parts {
+		switch {
+		case p.Broken:
+			return parts, partError(p.Path, "broken transfer encoding")
+		case p.Truncated:
+			return parts, partError(p.Path, fmt.Sprintf("bigger than %d bytes", MAXPARTSIZE))
+		}
+	}
+	return parts, nil
+}
+
+func partError(path, msg string) error {
+	if path == "" {
+		return fmt.Errorf("%s", msg)
+	}
+	return fmt.Errorf("%s: %s", path, msg)
+}
+
+func walk(h textproto.MIMEHeader, body io.Reader, path string, depth int, parts *[]Part) error {
+	if depth > MAXDEPTH {
+		return fmt.Errorf("%s: too deep", path)
+	}
+	if len(*parts) >= MAXPARTS {
+		return fmt.Errorf("more than %d parts", MAXPARTS)
+	}
+
+	mediaType, params, err := mime.ParseMediaType(h.Get("Content-Type"))
+	if err != nil {
+		mediaType = "text/plain"
+		params = map[string]string{}
+	}
+
+	if strings.HasPrefix(mediaType, "multipart/") {
+		mr := multipart.NewReader(body, params["boundary"])
+		for i := 1; ; i++ {
+			part, err := mr.NextRawPart()
+			if err == io.EOF {
+				return nil
+			}
+			if err != nil && path == "" {
+				return err
+			}
+			if err != nil {
+				return fmt.Errorf("%s: %v", path, err)
+			}
+			if err := walk(part.Header, part, join(path, i), depth+1, parts); err != nil {
+				return err
+			}
+		}
+	}
+
+	p := Part{
+		Path:        path,
+		ContentType: mediaType,
+		Charset:     strings.ToLower(params["charset"]),
+		Header:      h,
+	}
+	disp, dparams, _ := mime.ParseMediaType(h.Get("Content-Disposition"))
+	p.Disposition = disp
+	p.Filename = dparams["filename"]
+	if p.Filename == "" {
+		p.Filename = params["name"]
+	}
+	p.Filename = DecodeWords(p.Filename)
+
+	var r io.Reader = body
+	switch strings.ToLower(strings.TrimSpace(h.Get("Content-Transfer-Encoding"))) {
+	case "base64":
+		r = base64.NewDecoder(base64.StdEncoding, &base64Cleaner{r: body})
+	case "quoted-printable":
+		r = quotedprintable.NewReader(body)
+	}
+	p.Data, err = ioutil.ReadAll(io.LimitReader(r, MAXPARTSIZE))
+	p.Size = int64(len(p.Data))
+	if err != nil {
+		// broken encoding, we keep what we have
+		p.Broken = true
+	}
+	if rest, _ := io.Copy(ioutil.Discard, r); rest > 0 {
+		p.Size += rest
+		p.Truncated = true
+	}
+
+	// attached e-mail, we need to look inside
+	if mediaType == "message/rfc822" {
+		inner, err := mail.ReadMessage(bytes.NewReader(p.Data))
+		if err == nil {
+			*parts = append(*parts, p)
+			return walk(textproto.MIMEHeader(inner.Header), inner.Body, join(path, 1), depth+1, parts)
+		}
+	}
+	*parts = append(*parts, p)
+	return nil
+}
+
+func join(path string, i int) string {
+	if path == "" {
+		return fmt.Sprint(i)
+	}
+	return fmt.Sprintf("%s.%d", path, i)
+}
+
+/*
+  base64 with broken line ends or spaces, decoder
+  is only skipping \r and \n
+*/
+type base64Cleaner struct {
+	r io.Reader
+}
+
+func (c *base64Cleaner) Read(b []byte) (int, error) {
+	n, err := c.r.Read(b)
+	j := 0
+	for _, ch := range b[:n] {
+		if ch != ' ' && ch != '\t' {
+			b[j] = ch
+			j++
+		}
+	}
+	return j, err
+}
+
+/*
+  Decode text from the charset to UTF-8, text is
+  returned as it is when the charset is unknown
+*/
+func decodeCharset(charset string, data []byte) string {
+	switch charset {
+	case "", "utf-8", "utf8", "us-ascii":
+		return string(data)
+	}
+	enc, err := htmlindex.Get(charset)
+	if err != nil {
+		return string(data)
+	}
+	out, err := enc.NewDecoder().Bytes(data)
+	if err != nil {
+		return string(data)
+	}
+	return string(out)
+}
+
+/*
+  Decode RFC 2047 words, e.g. in the file names or the subject
+*/
+func DecodeWords(s string) string {
+	d := &mime.WordDecoder{CharsetReader: func(charset string, input io.Reader) (io.Reader, error) {
+		enc, err := htmlindex.Get(charset)
+		if err != nil {
+			return nil, err
+		}
+		return enc.NewDecoder().Reader(input), nil
+	}}
+	out, err := d.DecodeHeader(s)
+	if err != nil {
+		return s
+	}
+	return out
+}
@@ -0,0 +1,99 @@
+package content
+
+import (
+	"bytes"
+	"strings"
+)
+
+/*
+  Split the e-mail (or the part) into the raw header, the
+  empty line and the body. Used by the changes of the
+  delivered e-mails: verdict headers and rewrite rules.
+*/
+func SplitHeader(data []byte) ([]byte, []byte, []byte) {
+	start := 0
+	for start < len(data) {
+		end := bytes.IndexByte(data[start:], '\n')
+		if end < 0 {
+			break
+		}
+		line := data[start : start+end+1]
+		if len(bytes.TrimRight(line, "\r\n")) == 0 {
+			return data[:start], line, data[start+len(line):]
+		}
+		start += len(line)
+	}
+	return data, nil, nil
+}
+
+/*
+  Line end of the e-mail, CRLF or LF
+*/
+func Newline(data []byte) string {
+	if i := bytes.IndexByte(data, '\n'); i > 0 && data[i-1] == '\r' {
+		return "\r\n"
+	}
+	return "\n"
+}
+
+/*
+  Fields of the header with their continuation lines
+*/
+func HeaderFields(header []byte) [][]byte {
+	var list [][]byte
+	rest := header
+	for len(rest) > 0 {
+		i := bytes.IndexByte(rest, '\n')
+		line := rest
+		if i >= 0 {
+			line = rest[:i+1]
+		}
+		rest = rest[len(line):]
+		if (line[0] == ' ' || line[0] == '\t') && len(list) > 0 {
+			list[len(list)-1] = append(list[len(list)-1], line...)
+			continue
+		}
+		list = append(list, append([]byte{}, line...))
+	}
+	return list
+}
+
+/*
+  Name and unfolded value of the field, name is
+  empty when it's not a field
+*/
+func FieldValue(f []byte) (string, string) {
+	colon := bytes.IndexByte(f, ':')
+	if colon <= 0 {
+		return "", ""
+	}
+	value := strings.NewReplacer("\r\n", "", "\n", "").Replace(string(f[colon+1:]))
+	return strings.TrimSpace(string(f[:colon])), strings.TrimSpace(value)
+}
+
+/*
+  Fold the field on the spaces, lines are not longer
+  than 78 characters when the words are short enough
+*/
+func Fold(field, nl string) string {
+	words := strings.Split(field, " ")
+	lines := []string{words[0]}
+	for _, w := range words[1:] {
+		last := &lines[len(lines)-1]
+		if len(*last)+1+len(w) > 78 {
+			lines = append(lines, "\t"+w)
+		} else {
+			*last += " " + w
+		}
+	}
+	return strings.Join(lines, nl)
+}
+
+func IsASCII(s string) bool {
+	for i := 0; i < len(s); i++ {
+		if s[i] >= 0x80 {
+			return false
+		}
+	}
+	return true
+}
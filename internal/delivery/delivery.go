@@ -0,0 +1,94 @@
+/*
+  Package delivery is reinjecting e-mails to postfix,
+  the filter and the API are using the same code.
+*/
+package delivery
+
+import (
+	"log"
+	"os"
+	"os/exec"
+	"sync"
+
+	"github.com/wolfedale/go-proxy-mail/internal/auth"
+)
+
+/*
+  SENDMAIL: path to the postfix sendmail
+  DKIMFILE: DKIM signing keys (see auth.SignConfig), e-mails
+  are not signed when it's missing
+*/
+const SENDMAIL string = "/usr/sbin/sendmail"
+const DKIMFILE string = "/var/spool/mailProxy/dkim.json"
+
+/*
+  Function will send an e-mail, we need to call it with three
+  arguments:
+  from - mail from
+  recipients - mail recipients, every one is a separate argument
+  maildata - mail source
+  E-mail is signed with DKIM keys of the From domain,
+  keys which don't work are skipped.
+*/
+func SendMail(from string, recipients []string, maildata []byte) error {
+	maildata = sign(maildata)
+	args := append([]string{"-G", "-i", "-f", from, "--"}, recipients...)
+	sendmail := exec.Command(SENDMAIL, args...)
+	pipe, err := sendmail.StdinPipe()
+	if err != nil {
+		return err
+	}
+	if err := sendmail.Start(); err != nil {
+		return err
+	}
+	if _, err := pipe.Write(maildata); err != nil {
+		pipe.Close()
+		sendmail.Wait()
+		return err
+	}
+	pipe.Close()
+	return sendmail.Wait()
+}
+
+/*
+  Signing configuration is read with the first e-mail,
+  the API has to be restarted when DKIMFILE is changed.
+  It's nil when the file is missing or broken.
+*/
+var signOnce sync.Once
+var signConfig *auth.SignConfig
+
+func loadSignConfig() {
+	config, errs, err := auth.LoadSignConfig(DKIMFILE)
+	if os.IsNotExist(err) {
+		return
+	}
+	if err != nil {
+		log.Println("DKIM: ", err)
+		return
+	}
+	for _, err := range errs {
+		log.Println("DKIM: key is not used: ", err)
+	}
+	signConfig = config
+}
+
+func sign(maildata []byte) []byte {
+	signOnce.Do(loadSignConfig)
+	if signConfig == nil {
+		return maildata
+	}
+	signed, err := signConfig.Sign(maildata)
+	if err != nil {
+		log.Println("DKIM: ", err)
+	}
+	return signed
+}
+
+/*
+  Send e-mail notification with the subject and the body
+*/
+func Notify(from, recipient, subject, body string) error {
+	msg := "Subject: " + subject + "\n\n" + body
+	return SendMail(from, []string{recipient}, []byte(msg))
+}
@@ -0,0 +1,241 @@
+package delivery
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"mime"
+	"os"
+	"strings"
+
+	"github.com/wolfedale/go-proxy-mail/internal/content"
+	"github.com/wolfedale/go-proxy-mail/internal/store"
+)
+
+/*
+  Verdict headers of the delivered e-mails
+  HEADERPREFIX: all our headers, incoming ones are forged
+  HEADERSFILE: which headers are added (see HeaderConfig),
+  all of them when it's missing
+*/
+const HEADERPREFIX string = "X-MailProxy-"
+const QUEUEHEADER string = "X-MailProxy-Queue-ID"
+const VERDICTHEADER string = "X-MailProxy-Verdict"
+const RULEHEADER string = "X-MailProxy-Rule"
+const SCOREHEADER string = "X-MailProxy-Score"
+const AUTHHEADER string = "Authentication-Results"
+const HEADERSFILE string = "/var/spool/mailProxy/headers.json"
+
+/*
+  Names of the headers in the configuration
+*/
+var HEADERS = map[string]string{
+	"queue-id":               QUEUEHEADER,
+	"verdict":                VERDICTHEADER,
+	"rule":                   RULEHEADER,
+	"score":                  SCOREHEADER,
+	"authentication-results": AUTHHEADER,
+}
+
+/*
+  Headers added to the delivered e-mails, e.g.
+    {"add": ["queue-id", "verdict", "authentication-results"], "authservid": "mx.foobar.org"}
+  Add: headers to add, empty list adds none
+  AuthServID: name of our server in Authentication-Results,
+  hostname when it's empty
+  RuleReason: reason of the rule is added to X-MailProxy-Rule,
+  only the name is added by default, reasons can have details
+  of the policy and DLP findings recipients shouldn't see
+*/
+type HeaderConfig struct {
+	Add        []string `json:"add"`
+	AuthServID string   `json:"authservid,omitempty"`
+	RuleReason bool     `json:"rulereason,omitempty"`
+}
+
+/*
+  Read configuration of the headers
+*/
+func LoadHeaderConfig(file string) (*HeaderConfig, error) {
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	c := &HeaderConfig{}
+	if err := json.Unmarshal(data, c); err != nil {
+		return nil, fmt.Errorf("%s: %v", file, err)
+	}
+	for _, name := range c.Add {
+		if _, ok := HEADERS[strings.ToLower(name)]; !ok {
+			return nil, fmt.Errorf("%s: unknown header %q", file, name)
+		}
+	}
+	return c, nil
+}
+
+func headerConfig() *HeaderConfig {
+	c, err := LoadHeaderConfig(HEADERSFILE)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			log.Println("Headers: ", err)
+		}
+		c = &HeaderConfig{Add: []string{"queue-id", "verdict", "rule", "score", "authentication-results"}}
+	}
+	if c.AuthServID == "" {
+		c.AuthServID, _ = os.Hostname()
+	}
+	return c
+}
+
+/*
+  Add verdict headers to the e-mail before it's delivered.
+  Forged copies are removed first: all X-MailProxy-* headers
+  and Authentication-Results of our server. Verdict is the
+  action of the policy, "released" or "unchecked".
+*/
+func Stamp(maildata []byte, m store.Mail, verdict string) []byte {
+	c := headerConfig()
+	maildata = removeFields(maildata, func(name, value string) bool {
+		if len(name) >= len(HEADERPREFIX) && strings.EqualFold(name[:len(HEADERPREFIX)], HEADERPREFIX) {
+			return true
+		}
+		return strings.EqualFold(name, AUTHHEADER) && strings.EqualFold(authServID(value), c.AuthServID)
+	})
+
+	values := map[string]string{
+		QUEUEHEADER:   m.Queue,
+		VERDICTHEADER: verdict,
+	}
+	if len(m.Tags) > 0 {
+		values[VERDICTHEADER] += " (tags: " + strings.Join(m.Tags, ", ") + ")"
+	}
+	if m.Rule != "" {
+		values[RULEHEADER] = m.Rule
+		if m.Reason != "" && c.RuleReason {
+			values[RULEHEADER] += " (" + m.Reason + ")"
+		}
+	}
+	if m.Score != 0 || len(m.Signals) > 0 {
+		values[SCOREHEADER] = store.ScoreSummary(m.Score, m.Signals)
+	}
+	if m.Auth != nil && c.AuthServID != "" {
+		values[AUTHHEADER] = authResults(c.AuthServID, m.Auth)
+	}
+
+	// first one is on top
+	for i := len(c.Add) - 1; i >= 0; i-- {
+		name := HEADERS[strings.ToLower(c.Add[i])]
+		if values[name] != "" {
+			maildata = addHeader(maildata, name, values[name])
+		}
+	}
+	return maildata
+}
+
+/*
+  Authentication-Results (RFC 8601) with the SPF, DKIM
+  and DMARC results of the e-mail
+*/
+func authResults(servid string, a *store.Auth) string {
+	results := []string{servid}
+	if a.SPF != "" {
+		spf := "spf=" + a.SPF
+		if a.ClientIP != "" {
+			spf += " (" + a.ClientIP + ")"
+		}
+		if a.SPFDomain != "" {
+			spf += " smtp.mailfrom=" + a.SPFDomain
+		}
+		results = append(results, spf)
+	}
+	if len(a.DKIMDomains) > 0 {
+		for _, d := range a.DKIMDomains {
+			results = append(results, "dkim=pass header.d="+d)
+		}
+	} else if a.DKIM != "" {
+		dkim := "dkim=" + a.DKIM
+		if a.DKIMReason != "" {
+			dkim += " (" + comment(a.DKIMReason) + ")"
+		}
+		results = append(results, dkim)
+	}
+	if a.DMARC != "" {
+		dmarc := "dmarc=" + a.DMARC
+		if a.DMARCPolicy != "" {
+			dmarc += " (p=" + a.DMARCPolicy + ")"
+		}
+		if a.FromDomain != "" {
+			dmarc += " header.from=" + a.FromDomain
+		}
+		results = append(results, dmarc)
+	}
+	if len(results) == 1 {
+		results = append(results, "none")
+	}
+	return strings.Join(results, "; ")
+}
+
+func comment(s string) string {
+	return strings.NewReplacer("(", "", ")", "", "\\", "").Replace(s)
+}
+
+/*
+  authserv-id, the first word of Authentication-Results
+*/
+func authServID(value string) string {
+	value = strings.TrimSpace(value)
+	if i := strings.IndexAny(value, "; \t\r\n("); i >= 0 {
+		value = value[:i]
+	}
+	return value
+}
+
+/*
+  Set header of the e-mail: fields with the same name are
+  removed (forged ones too) and the new one is added on top.
+  Line ends of the e-mail are kept.
+*/
+func SetHeader(maildata []byte, name, value string) []byte {
+	return addHeader(RemoveHeader(maildata, name), name, value)
+}
+
+/*
+  Add the field on top of the header, folded, non ASCII
+  text is encoded
+*/
+func addHeader(maildata []byte, name, value string) []byte {
+	nl := content.Newline(maildata)
+	value = strings.Join(strings.Fields(value), " ")
+	if !content.IsASCII(value) {
+		value = mime.QEncoding.Encode("utf-8", value)
+	}
+	out := []byte(content.Fold(name+": "+value, nl) + nl)
+	return append(out, maildata...)
+}
+
+/*
+  Remove all fields with the name from the header,
+  with their continuation lines
+*/
+func RemoveHeader(maildata []byte, name string) []byte {
+	return removeFields(maildata, func(n, value string) bool {
+		return strings.EqualFold(n, name)
+	})
+}
+
+/*
+  Remove fields of the header for which remove is true,
+  it gets the name and the unfolded value. Body is kept
+  as it is.
+*/
+func removeFields(maildata []byte, remove func(name, value string) bool) []byte {
+	header, sep, body := content.SplitHeader(maildata)
+	var out []byte
+	for _, f := range content.HeaderFields(header) {
+		if name, value := content.FieldValue(f); name == "" || !remove(name, value) {
+			out = append(out, f...)
+		}
+	}
+	return append(append(out, sep...), body...)
+}
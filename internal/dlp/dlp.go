@@ -0,0 +1,272 @@
+/*
+  Package dlp is looking for sensitive data in the e-mail
+  content: regular expressions, keywords, credit card
+  numbers, IBANs and secrets like API keys.
+*/
+package dlp
+
+import (
+	"fmt"
+	"math/big"
+	"regexp"
+	"strings"
+
+	"github.com/wolfedale/go-proxy-mail/internal/attachment"
+	"github.com/wolfedale/go-proxy-mail/internal/content"
+	"github.com/wolfedale/go-proxy-mail/internal/store"
+)
+
+/*
+  Types of the detectors
+  regex: Pattern is a regular expression
+  keywords: any of Keywords, case insensitive, whole words
+  creditcard: card numbers with correct Luhn checksum
+  iban: IBANs with correct checksum
+  secrets: API keys, tokens and private keys
+*/
+const TypeRegex string = "regex"
+const TypeKeywords string = "keywords"
+const TypeCreditCard string = "creditcard"
+const TypeIBAN string = "iban"
+const TypeSecrets string = "secrets"
+
+/*
+  MAXSNIPPETS: snippets kept for reviewers per detector
+  SNIPPETCONTEXT: characters around the match in the snippet
+*/
+const MAXSNIPPETS int = 5
+const SNIPPETCONTEXT int = 20
+
+/*
+  Detector from the policy
+  Name: used in the rules as "name in dlp"
+  Threshold: matches needed to report it, 1 when not set
+*/
+type Detector struct {
+	Name      string   `json:"name"`
+	Type      string   `json:"type"`
+	Pattern   string   `json:"pattern,omitempty"`
+	Keywords  []string `json:"keywords,omitempty"`
+	Threshold int      `json:"threshold,omitempty"`
+	re        *regexp.Regexp
+}
+
+var cardRe = regexp.MustCompile(`\b\d(?:[ -]?\d){12,18}\b`)
+var ibanRe = regexp.MustCompile(`\b[A-Z]{2}\d{2}(?: ?[A-Z0-9]){11,30}\b`)
+var secretsRe = regexp.MustCompile(strings.Join([]string{
+	`AKIA[0-9A-Z]{16}`,
+	`-----BEGIN (?:RSA |EC |DSA |OPENSSH |ENCRYPTED )?PRIVATE KEY-----`,
+	`gh[pousr]_[A-Za-z0-9]{36}`,
+	`xox[abposr]-[A-Za-z0-9-]{10,}`,
+	`AIza[0-9A-Za-z_\-]{35}`,
+	`sk_live_[0-9a-zA-Z]{24,}`,
+	`(?i)(?:api[_-]?key|secret|passw(?:or)?d|token)["']?\s*[:=]\s*["']?[A-Za-z0-9_\-/+]{16,}`,
+}, "|"))
+
+/*
+  Check and compile the detector
+*/
+func (d *Detector) Compile() error {
+	if d.Name == "" {
+		return fmt.Errorf("name is required")
+	}
+	if d.Threshold < 0 {
+		return fmt.Errorf("threshold must not be negative")
+	}
+	var err error
+	switch d.Type {
+	case TypeRegex:
+		if d.Pattern == "" {
+			return fmt.Errorf("pattern is required")
+		}
+		d.re, err = regexp.Compile(d.Pattern)
+	case TypeKeywords:
+		if len(d.Keywords) == 0 {
+			return fmt.Errorf("keywords are required")
+		}
+		var words []string
+		for i, k := range d.Keywords {
+			// empty one would match everywhere
+			if strings.TrimSpace(k) == "" {
+				return fmt.Errorf("keywords[%d] is empty", i)
+			}
+			words = append(words, regexp.QuoteMeta(strings.TrimSpace(k)))
+		}
+		d.re, err = regexp.Compile(`(?i)\b(?:` + strings.Join(words, "|") + `)\b`)
+	case TypeCreditCard:
+		d.re = cardRe
+	case TypeIBAN:
+		d.re = ibanRe
+	case TypeSecrets:
+		d.re = secretsRe
+	default:
+		return fmt.Errorf("unknown type %q", d.Type)
+	}
+	return err
+}
+
+/*
+  Scan the parts and return findings over the threshold.
+  Attachments are scanned by the real type, files in the
+  archives and office documents too (see attachment.Texts).
+  Detectors have to be compiled.
+*/
+func Scan(detectors []Detector, parts []content.Part) []store.Finding {
+	var findings []store.Finding
+	var texts []attachment.Text
+	if len(detectors) > 0 {
+		texts = attachment.Texts(parts)
+	}
+	for _, d := range detectors {
+		if d.re == nil {
+			continue
+		}
+		f := store.Finding{Detector: d.Name}
+		for _, p := range texts {
+			text := p.Text
+			for _, loc := range d.re.FindAllStringIndex(text, -1) {
+				match := text[loc[0]:loc[1]]
+				if !d.valid(match) {
+					continue
+				}
+				f.Count++
+				if len(f.Snippets) < MAXSNIPPETS {
+					f.Snippets = append(f.Snippets, snippet(text, loc, d.Type))
+				}
+				if !contains(f.Parts, p.Path) {
+					f.Parts = append(f.Parts, p.Path)
+				}
+			}
+		}
+		threshold := d.Threshold
+		if threshold == 0 {
+			threshold = 1
+		}
+		if f.Count >= threshold {
+			findings = append(findings, f)
+		}
+	}
+	return findings
+}
+
+func (d *Detector) valid(match string) bool {
+	switch d.Type {
+	case TypeCreditCard:
+		return Luhn(match)
+	case TypeIBAN:
+		return IBAN(match)
+	}
+	return true
+}
+
+/*
+  Snippet for reviewers, card numbers and secrets are
+  masked, so the quarantine is not keeping them
+*/
+func snippet(text string, loc []int, typ string) string {
+	start := loc[0] - SNIPPETCONTEXT
+	if start < 0 {
+		start = 0
+	}
+	end := loc[1] + SNIPPETCONTEXT
+	if end > len(text) {
+		end = len(text)
+	}
+	// don't cut UTF-8 characters
+	for start > 0 && !isRuneStart(text[start]) {
+		start--
+	}
+	for end < len(text) && !isRuneStart(text[end]) {
+		end++
+	}
+
+	match := text[loc[0]:loc[1]]
+	if typ == TypeCreditCard || typ == TypeSecrets || typ == TypeIBAN {
+		match = mask(match)
+	}
+	s := text[start:loc[0]] + match + text[loc[1]:end]
+	return strings.Join(strings.Fields(s), " ")
+}
+
+func isRuneStart(b byte) bool {
+	return b&0xC0 != 0x80
+}
+
+/*
+  Keep first and last 4 characters
+*/
+func mask(s string) string {
+	if len(s) <= 8 {
+		return strings.Repeat("*", len(s))
+	}
+	return s[:4] + strings.Repeat("*", len(s)-8) + s[len(s)-4:]
+}
+
+func contains(list []string, s string) bool {
+	for _, v := range list {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
+
+func digits(s string) string {
+	var b strings.Builder
+	for _, c := range s {
+		if c >= '0' && c <= '9' {
+			b.WriteRune(c)
+		}
+	}
+	return b.String()
+}
+
+/*
+  Luhn checksum of the card number, spaces and dashes are ignored
+*/
+func Luhn(number string) bool {
+	d := digits(number)
+	// zeros have the right checksum, but they are no card
+	if len(d) < 13 || len(d) > 19 || strings.Trim(d, "0") == "" {
+		return false
+	}
+	sum := 0
+	for i := 0; i < len(d); i++ {
+		n := int(d[len(d)-1-i] - '0')
+		if i%2 == 1 {
+			n *= 2
+			if n > 9 {
+				n -= 9
+			}
+		}
+		sum += n
+	}
+	return sum%10 == 0
+}
+
+/*
+  IBAN checksum (ISO 13616, mod 97), spaces are ignored
+*/
+func IBAN(iban string) bool {
+	s := strings.ToUpper(strings.Replace(iban, " ", "", -1))
+	if len(s) < 15 || len(s) > 34 {
+		return false
+	}
+	s = s[4:] + s[:4]
+	var b strings.Builder
+	for _, c := range s {
+		switch {
+		case c >= '0' && c <= '9':
+			b.WriteRune(c)
+		case c >= 'A' && c <= 'Z':
+			fmt.Fprintf(&b, "%d", c-'A'+10)
+		default:
+			return false
+		}
+	}
+	n, ok := new(big.Int).SetString(b.String(), 10)
+	if !ok {
+		return false
+	}
+	return new(big.Int).Mod(n, big.NewInt(97)).Int64() == 1
+}
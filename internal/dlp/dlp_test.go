@@ -0,0 +1,106 @@
+package dlp
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/wolfedale/go-proxy-mail/internal/content"
+)
+
+func TestLuhn(t *testing.T) {
+	cases := []struct {
+		number string
+		valid  bool
+	}{
+		{"4111111111111111", true},
+		{"4111 1111 1111 1111", true},
+		{"4111-1111-1111-1111", true},
+		{"5500 0000 0000 0004", true},
+		{"3782 822463 10005", true},
+		{"4111 1111 1111 1112", false},
+		{"1234 5678 9012 3456", false},
+		{"0000 0000 0000 0000", false},
+		{"4111 1111 1111", false},
+		{"4111 1111 1111 1111 1111", false},
+	}
+	for _, c := range cases {
+		if got := Luhn(c.number); got != c.valid {
+			t.Errorf("%s: %v, want %v", c.number, got, c.valid)
+		}
+	}
+}
+
+func TestIBAN(t *testing.T) {
+	cases := []struct {
+		iban  string
+		valid bool
+	}{
+		{"GB82 WEST 1234 5698 7654 32", true},
+		{"DE89370400440532013000", true},
+		{"pl61 1090 1014 0000 0712 1981 2874", true},
+		{"GB82 WEST 1234 5698 7654 33", false},
+		{"GB28 WEST 1234 5698 7654 32", false},
+		{"DE89 3704", false},
+		{"DE89-3704-0044-0532-0130-00", false},
+	}
+	for _, c := range cases {
+		if got := IBAN(c.iban); got != c.valid {
+			t.Errorf("%s: %v, want %v", c.iban, got, c.valid)
+		}
+	}
+}
+
+func TestScan(t *testing.T) {
+	text := "Card 4111 1111 1111 1111 and 4111 1111 1111 1112, order 1234 5678 9012 3456,\n" +
+		"phone +48 123 456 789, IBAN GB82 WEST 1234 5698 7654 32 or GB82 WEST 1234 5698 7654 33,\n" +
+		"project Falcon, falconry is fine. api_key = \"abcdefghijklmnopqrstuvwxyz\""
+	parts := []content.Part{{Path: "1", ContentType: "text/plain", Data: []byte(text)}}
+	detectors := []Detector{
+		{Name: "cards", Type: TypeCreditCard},
+		{Name: "iban", Type: TypeIBAN},
+		{Name: "falcon", Type: TypeKeywords, Keywords: []string{"falcon"}},
+		{Name: "secrets", Type: TypeSecrets},
+		{Name: "two-cards", Type: TypeCreditCard, Threshold: 2},
+		{Name: "regex", Type: TypeRegex, Pattern: `\+48( \d{3}){3}`},
+	}
+	for i := range detectors {
+		if err := detectors[i].Compile(); err != nil {
+			t.Fatalf("%s: %v", detectors[i].Name, err)
+		}
+	}
+	counts := map[string]int{}
+	for _, f := range Scan(detectors, parts) {
+		counts[f.Detector] = f.Count
+		for _, s := range f.Snippets {
+			if strings.Contains(s, "4111 1111 1111 1111") || strings.Contains(s, "abcdefghijklmnopqrstuvwxyz") {
+				t.Errorf("%s: snippet is not masked: %s", f.Detector, s)
+			}
+		}
+	}
+	want := map[string]int{"cards": 1, "iban": 1, "falcon": 1, "secrets": 1, "regex": 1}
+	if len(counts) != len(want) {
+		t.Errorf("findings: %v, want %v", counts, want)
+	}
+	for name, n := range want {
+		if counts[name] != n {
+			t.Errorf("%s: %d matches, want %d", name, counts[name], n)
+		}
+	}
+}
+
+func TestCompile(t *testing.T) {
+	bad := []Detector{
+		{Type: TypeCreditCard},
+		{Name: "a", Type: "ssn"},
+		{Name: "a", Type: TypeRegex},
+		{Name: "a", Type: TypeRegex, Pattern: "("},
+		{Name: "a", Type: TypeKeywords},
+		{Name: "a", Type: TypeKeywords, Keywords: []string{"secret", " "}},
+		{Name: "a", Type: TypeCreditCard, Threshold: -1},
+	}
+	for _, d := range bad {
+		if err := d.Compile(); err == nil {
+			t.Errorf("%+v: compiled", d)
+		}
+	}
+}
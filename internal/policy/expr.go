@@ -0,0 +1,480 @@
+package policy
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+/*
+  Match expressions of the rules, e.g.
+    header_from.domain in internal_domains && envelope_from != header_from
+    subject matches "(?i)invoice" or recipients.domain in ["gmail.com", "yahoo.com"]
+    attachments.type not in ["pdf", "png"] || attachments.size > 10MB
+
+  Operators: == != in "not in" contains matches > >= < <=, && || ! (and, or, not)
+  Values: fields (see fields), "strings", numbers (with K, M or G
+  suffix), [lists], true and false.
+  Comparing strings is case insensitive, when one side is a list
+  it's enough that one of the elements matches. Only "in" is
+  different, all elements of the list on the left have to be in
+  the right one, so "not in" is true when any of them is not.
+*/
+
+/*
+  Fields which can be used in the expressions,
+  header.<Name> is the raw value of any header
+*/
+var fields = map[string]string{
+	"envelope_from":             "envelope sender address",
+	"envelope_from.user":        "user part of the envelope sender",
+	"envelope_from.domain":      "domain of the envelope sender",
+	"header_from":               "From header address",
+	"header_from.user":          "user part of the From header",
+	"header_from.domain":        "domain of the From header",
+	"header_from.name":          "display name of the From header",
+	"reply_to":                  "Reply-To address",
+	"reply_to.domain":           "domain of the Reply-To",
+	"recipients":                "list of envelope recipients",
+	"recipients.domain":         "list of envelope recipients domains",
+	"recipients.count":          "number of envelope recipients",
+	"recipients.external":       "list of recipients outside of internal_domains, not allowed for the sender",
+	"recipients.external.count": "number of recipients outside of internal_domains, not allowed for the sender",
+	"recipients.blocked":        "list of recipients in the blocked domains of the policy",
+	"subject":                   "Subject header",
+	"internal_domains":          "domains of the policy",
+	"whitelist":                 "whitelist of the policy",
+	"users":                     "users of the policy",
+	"watched":                   "watched users of the policy, see recipients.go",
+	"dlp":                       "list of DLP detectors over the threshold",
+	"spf":                       "SPF result of the envelope sender: pass, fail, softfail, neutral, none, temperror, permerror",
+	"spf.domain":                "domain checked by SPF",
+	"dkim":                      "DKIM result, pass when any signature is valid",
+	"dkim.domain":               "list of domains with valid signatures",
+	"dmarc":                     "DMARC result of the From domain: pass, fail, none, temperror, permerror",
+	"dmarc.policy":              "DMARC policy of the From domain: none, quarantine, reject",
+	"signals":                   "list of signals with the score, see score.go and internal/spoof",
+	"signals.score":             "the same as score",
+	"score":                     "sum of the scores of the signals",
+	"attachments.name":          "list of attachment names, files in the archives too",
+	"attachments.extension":     "list of extensions of the names, lower case",
+	"attachments.type":          "list of real types, e.g. pdf, zip, exe, docx",
+	"attachments.contenttype":   "list of declared Content-Types",
+	"attachments.count":         "number of attachments",
+	"attachments.size":          "size of the biggest attachment",
+	"attachments.totalsize":     "size of all attachments",
+	"attachments.encrypted":     "archive with encrypted files",
+	"attachments.uninspected":   "archive which was not inspected, e.g. too deep or a bomb",
+	"attachments.mismatch":      "extension doesn't match the real type",
+}
+
+/*
+  Values of the fields for one e-mail
+*/
+type env interface {
+	field(name string) interface{}
+}
+
+type node interface {
+	eval(e env) interface{}
+}
+
+type lit struct{ v interface{} }
+type field struct{ name string }
+type list struct{ items []node }
+type not struct{ n node }
+type and struct{ l, r node }
+type or struct{ l, r node }
+type cmp struct {
+	op   string
+	l, r node
+	re   *regexp.Regexp
+}
+
+func (n lit) eval(e env) interface{}   { return n.v }
+func (n field) eval(e env) interface{} { return e.field(n.name) }
+func (n not) eval(e env) interface{}   { return !truth(n.n.eval(e)) }
+func (n and) eval(e env) interface{}   { return truth(n.l.eval(e)) && truth(n.r.eval(e)) }
+func (n or) eval(e env) interface{}    { return truth(n.l.eval(e)) || truth(n.r.eval(e)) }
+
+func (n list) eval(e env) interface{} {
+	var out []string
+	for _, i := range n.items {
+		out = append(out, strs(i.eval(e))...)
+	}
+	return out
+}
+
+func (n cmp) eval(e env) interface{} {
+	l, r := n.l.eval(e), n.r.eval(e)
+	switch n.op {
+	case "==":
+		return equal(l, r)
+	case "!=":
+		return !equal(l, r)
+	case "in":
+		return all(l, r)
+	case "not in":
+		return !all(l, r)
+	case ">", ">=", "<", "<=":
+		b, ok := num(r)
+		if !ok {
+			return false
+		}
+		for _, s := range strs(l) {
+			a, ok := num(s)
+			if ok && order(n.op, a, b) {
+				return true
+			}
+		}
+		return false
+	case "contains":
+		if _, ok := l.([]string); ok {
+			return equal(l, r)
+		}
+		for _, s := range strs(r) {
+			if strings.Contains(strings.ToLower(str(l)), strings.ToLower(s)) {
+				return true
+			}
+		}
+		return false
+	case "matches":
+		for _, s := range strs(l) {
+			if n.re.MatchString(s) {
+				return true
+			}
+		}
+		return false
+	}
+	return false
+}
+
+func truth(v interface{}) bool {
+	switch t := v.(type) {
+	case bool:
+		return t
+	case string:
+		return t != ""
+	case []string:
+		return len(t) > 0
+	case int64:
+		return t != 0
+	}
+	return false
+}
+
+func str(v interface{}) string {
+	switch t := v.(type) {
+	case string:
+		return t
+	case bool:
+		return strconv.FormatBool(t)
+	case int64:
+		return strconv.FormatInt(t, 10)
+	case []string:
+		return strings.Join(t, " ")
+	}
+	return ""
+}
+
+func strs(v interface{}) []string {
+	if l, ok := v.([]string); ok {
+		return l
+	}
+	return []string{str(v)}
+}
+
+func equal(l, r interface{}) bool {
+	for _, a := range strs(l) {
+		for _, b := range strs(r) {
+			if strings.EqualFold(a, b) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+/*
+  All elements of l are in r
+*/
+func all(l, r interface{}) bool {
+	for _, a := range strs(l) {
+		if !equal(a, r) {
+			return false
+		}
+	}
+	return true
+}
+
+func num(v interface{}) (int64, bool) {
+	if n, ok := v.(int64); ok {
+		return n, true
+	}
+	n, err := strconv.ParseInt(strings.TrimSpace(str(v)), 10, 64)
+	return n, err == nil
+}
+
+func order(op string, a, b int64) bool {
+	switch op {
+	case ">":
+		return a > b
+	case ">=":
+		return a >= b
+	case "<":
+		return a < b
+	}
+	return a <= b
+}
+
+/*
+  Number with K, M or G suffix (KB, MB, GB too)
+*/
+func parseNumber(t string) (int64, error) {
+	i := 0
+	for i < len(t) && t[i] >= '0' && t[i] <= '9' {
+		i++
+	}
+	n, err := strconv.ParseInt(t[:i], 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("wrong number %s", t)
+	}
+	switch strings.ToUpper(t[i:]) {
+	case "":
+	case "K", "KB":
+		n <<= 10
+	case "M", "MB":
+		n <<= 20
+	case "G", "GB":
+		n <<= 30
+	default:
+		return 0, fmt.Errorf("wrong number %s", t)
+	}
+	return n, nil
+}
+
+/*
+  Parser, tokens are read by lexer and
+  expression is built by recursive descent
+*/
+type parser struct {
+	toks []string
+	pos  int
+}
+
+func compile(src string) (node, error) {
+	toks, err := lex(src)
+	if err != nil {
+		return nil, err
+	}
+	if len(toks) == 0 {
+		return nil, fmt.Errorf("expression is empty")
+	}
+	p := &parser{toks: toks}
+	n, err := p.or()
+	if err != nil {
+		return nil, err
+	}
+	if p.pos < len(p.toks) {
+		return nil, fmt.Errorf("unexpected %q", p.toks[p.pos])
+	}
+	return n, nil
+}
+
+func lex(src string) ([]string, error) {
+	var toks []string
+	for i := 0; i < len(src); {
+		c := src[i]
+		switch {
+		case c == ' ' || c == '\t' || c == '\n' || c == '\r':
+			i++
+		case c == '"':
+			j := i + 1
+			for ; j < len(src) && src[j] != '"'; j++ {
+				if src[j] == '\\' {
+					j++
+				}
+			}
+			if j >= len(src) {
+				return nil, fmt.Errorf("string is not closed: %s", src[i:])
+			}
+			toks = append(toks, src[i:j+1])
+			i = j + 1
+		case strings.HasPrefix(src[i:], "==") || strings.HasPrefix(src[i:], "!=") ||
+			strings.HasPrefix(src[i:], "&&") || strings.HasPrefix(src[i:], "||") ||
+			strings.HasPrefix(src[i:], ">=") || strings.HasPrefix(src[i:], "<="):
+			toks = append(toks, src[i:i+2])
+			i += 2
+		case strings.IndexByte("()[],!<>", c) >= 0:
+			toks = append(toks, src[i:i+1])
+			i++
+		case isIdent(c) || (c >= '0' && c <= '9'):
+			j := i
+			for j < len(src) && (isIdent(src[j]) || src[j] == '.' || src[j] == '-' || (src[j] >= '0' && src[j] <= '9')) {
+				j++
+			}
+			toks = append(toks, src[i:j])
+			i = j
+		default:
+			return nil, fmt.Errorf("unexpected %q", string(c))
+		}
+	}
+	return toks, nil
+}
+
+func isIdent(c byte) bool {
+	return c == '_' || (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z')
+}
+
+func (p *parser) peek() string {
+	if p.pos < len(p.toks) {
+		return p.toks[p.pos]
+	}
+	return ""
+}
+
+func (p *parser) next() string {
+	t := p.peek()
+	p.pos++
+	return t
+}
+
+func (p *parser) or() (node, error) {
+	l, err := p.and()
+	if err != nil {
+		return nil, err
+	}
+	for p.peek() == "||" || strings.ToLower(p.peek()) == "or" {
+		p.next()
+		r, err := p.and()
+		if err != nil {
+			return nil, err
+		}
+		l = or{l, r}
+	}
+	return l, nil
+}
+
+func (p *parser) and() (node, error) {
+	l, err := p.not()
+	if err != nil {
+		return nil, err
+	}
+	for p.peek() == "&&" || strings.ToLower(p.peek()) == "and" {
+		p.next()
+		r, err := p.not()
+		if err != nil {
+			return nil, err
+		}
+		l = and{l, r}
+	}
+	return l, nil
+}
+
+func (p *parser) not() (node, error) {
+	if p.peek() == "!" || strings.ToLower(p.peek()) == "not" {
+		p.next()
+		n, err := p.not()
+		if err != nil {
+			return nil, err
+		}
+		return not{n}, nil
+	}
+	return p.cmp()
+}
+
+func (p *parser) cmp() (node, error) {
+	l, err := p.primary()
+	if err != nil {
+		return nil, err
+	}
+
+	op := strings.ToLower(p.peek())
+	switch op {
+	case "==", "!=", "in", "contains", "matches", ">", ">=", "<", "<=":
+		p.next()
+	case "not":
+		if p.pos+1 < len(p.toks) && strings.ToLower(p.toks[p.pos+1]) == "in" {
+			p.pos += 2
+			op = "not in"
+		} else {
+			return l, nil
+		}
+	default:
+		return l, nil
+	}
+
+	r, err := p.primary()
+	if err != nil {
+		return nil, err
+	}
+	c := cmp{op: op, l: l, r: r}
+	if op == "matches" {
+		s, ok := r.(lit)
+		if !ok {
+			return nil, fmt.Errorf("matches needs a \"regexp\"")
+		}
+		c.re, err = regexp.Compile(str(s.v))
+		if err != nil {
+			return nil, err
+		}
+	}
+	return c, nil
+}
+
+func (p *parser) primary() (node, error) {
+	t := p.next()
+	switch {
+	case t == "":
+		return nil, fmt.Errorf("unexpected end of expression")
+	case t == "(":
+		n, err := p.or()
+		if err != nil {
+			return nil, err
+		}
+		if p.next() != ")" {
+			return nil, fmt.Errorf("missing )")
+		}
+		return n, nil
+	case t == "[":
+		var l list
+		for p.peek() != "]" {
+			n, err := p.primary()
+			if err != nil {
+				return nil, err
+			}
+			l.items = append(l.items, n)
+			if p.peek() == "," {
+				p.next()
+			} else if p.peek() != "]" {
+				return nil, fmt.Errorf("missing ]")
+			}
+		}
+		p.next()
+		return l, nil
+	case t[0] == '"':
+		s, err := strconv.Unquote(t)
+		if err != nil {
+			return nil, fmt.Errorf("wrong string %s", t)
+		}
+		return lit{s}, nil
+	case t[0] >= '0' && t[0] <= '9':
+		n, err := parseNumber(t)
+		if err != nil {
+			return nil, err
+		}
+		return lit{n}, nil
+	case strings.ToLower(t) == "true":
+		return lit{true}, nil
+	case strings.ToLower(t) == "false":
+		return lit{false}, nil
+	case isIdent(t[0]):
+		name := strings.ToLower(t)
+		if _, ok := fields[name]; !ok && !strings.HasPrefix(name, "header.") {
+			return nil, fmt.Errorf("unknown field %s", t)
+		}
+		return field{name}, nil
+	}
+	return nil, fmt.Errorf("unexpected %q", t)
+}
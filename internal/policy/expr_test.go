@@ -0,0 +1,100 @@
+package policy
+
+import (
+	"strings"
+	"testing"
+)
+
+type testEnv map[string]interface{}
+
+func (e testEnv) field(name string) interface{} { return e[name] }
+
+func TestExpr(t *testing.T) {
+	e := testEnv{
+		"subject":           `Invoice "Q3" a\b`,
+		"recipients.domain": []string{"gmail.com", "yahoo.com"},
+		"recipients.count":  int64(2),
+		"attachments.size":  int64(11 << 20),
+		"attachments.type":  []string{"pdf", "exe"},
+		"header.x-mailer":   "Microsoft Outlook 16.0",
+		"dlp":               []string{},
+	}
+	cases := []struct {
+		expr string
+		want bool
+	}{
+		// && is before ||, ! is before &&
+		{`true || false && false`, true},
+		{`(true || false) && false`, false},
+		{`!false && false`, false},
+		{`not true or true`, true},
+		{`!(true and false)`, true},
+		{`false || !false`, true},
+
+		// in needs all elements on the left, not in is true when any is missing
+		{`recipients.domain in ["gmail.com", "YAHOO.com", "foobar.org"]`, true},
+		{`recipients.domain in ["gmail.com"]`, false},
+		{`recipients.domain not in ["gmail.com"]`, true},
+		{`"gmail.com" in recipients.domain`, true},
+		{`attachments.type not in ["pdf", "exe"]`, false},
+
+		{`recipients.domain == "yahoo.com"`, true},
+		{`recipients.domain != "yahoo.com"`, false},
+		{`subject contains "q3"`, true},
+		{`recipients.domain contains "gmail.com"`, true},
+		{`subject matches "^(?i)invoice"`, true},
+		{`subject matches "^invoice"`, false},
+		{`header.x-mailer contains "outlook"`, true},
+		{`header.X-Mailer contains "thunderbird"`, false},
+		{`dlp`, false},
+
+		{`attachments.size > 10MB`, true},
+		{`attachments.size > 11M`, false},
+		{`attachments.size >= 11264K`, true},
+		{`recipients.count <= 2 && recipients.count < 3`, true},
+		{`subject > 1`, false},
+
+		// escapes are the ones of the Go strings
+		{`subject == "invoice \"q3\" a\\b"`, true},
+		{`subject contains "\x22Q3\x22"`, true},
+		{`subject == "Invoice Q3"`, false},
+	}
+	for _, c := range cases {
+		n, err := compile(c.expr)
+		if err != nil {
+			t.Errorf("%s: %v", c.expr, err)
+			continue
+		}
+		if got := truth(n.eval(e)); got != c.want {
+			t.Errorf("%s: %v, want %v", c.expr, got, c.want)
+		}
+	}
+}
+
+func TestExprErrors(t *testing.T) {
+	cases := []struct {
+		expr string
+		err  string
+	}{
+		{``, "expression is empty"},
+		{`sender == "a"`, "unknown field sender"},
+		{`envelope_from.name == "a"`, "unknown field envelope_from.name"},
+		{`subject ==`, "unexpected end of expression"},
+		{`(true || false`, "missing )"},
+		{`recipients.domain in ["a" "b"]`, "missing ]"},
+		{`subject == "abc`, "string is not closed"},
+		{`subject == "\q"`, "wrong string"},
+		{`attachments.size > 10XB`, "wrong number 10XB"},
+		{`subject matches envelope_from`, "matches needs a \"regexp\""},
+		{`subject matches "("`, "missing closing )"},
+		{`subject @ "a"`, `unexpected "@"`},
+		{`true true`, `unexpected "true"`},
+		{`subject == )`, `unexpected ")"`},
+	}
+	for _, c := range cases {
+		_, err := compile(c.expr)
+		if err == nil || !strings.Contains(err.Error(), c.err) {
+			t.Errorf("%s: error %v, want %q", c.expr, err, c.err)
+		}
+	}
+}
@@ -0,0 +1,366 @@
+/*
+  Package policy has the checks used by the filter to decide
+  if e-mail should be blocked.
+*/
+package policy
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/mail"
+	"os"
+	"strings"
+
+	"github.com/wolfedale/go-proxy-mail/internal/auth"
+	"github.com/wolfedale/go-proxy-mail/internal/content"
+	"github.com/wolfedale/go-proxy-mail/internal/dlp"
+	"github.com/wolfedale/go-proxy-mail/internal/store"
+)
+
+/*
+  POLICYFILE: policy used by the filter, OURDOMAIN, WHITELIST
+  and CheckUserList are used when the file is missing
+*/
+const POLICYFILE string = "/var/spool/mailProxy/policy.json"
+
+/*
+  ARRAY
+  OURDOMAIN: domain list that we want to check
+*/
+var OURDOMAIN = [2]string{"foobar.org",
+	"foobar.com"}
+
+/*
+  SLICE
+  WHITELIST: we can whitelist e-mails by name
+*/
+var WHITELIST = [...]string{"alerter.test",
+	"system.email",
+	"jira",
+	"alerter.live",
+	"salesforce.com",
+	"sf.com"}
+
+var CheckUserList = [...]string{"pawel.grzesik"}
+
+/*
+  Policy of the filter
+  Domains: our domains, the same as OURDOMAIN
+  Whitelist: whitelisted domains, the same as WHITELIST
+  Users: users checked for sender mismatch, the same as CheckUserList
+  Names: display names of our people, checked with Users for
+  impersonation, e.g. "Pawel Grzesik" <x@gmail.com>
+  Mode: first-match (default) or accumulate, see rules.go
+  Rules: ordered rules, built in checks are used when empty
+  Detectors: DLP detectors, rules can use them as "name in dlp"
+  Verify: check SPF, DKIM and DMARC, rules can use the results
+  DNSFixtures: file with DNS records used instead of DNS, see auth.Fixtures
+  Resolver: DNS used by Verify, set from DNSFixtures or system DNS
+  Scoring: weights of the signals and thresholds, see score.go
+  BreakDKIM: rewrite rules change e-mails with DKIM signatures too
+  Recipients: checks of the recipients, see recipients.go
+*/
+type Policy struct {
+	Domains     []string        `json:"domains"`
+	Whitelist   []string        `json:"whitelist"`
+	Users       []string        `json:"users"`
+	Names       []string        `json:"names,omitempty"`
+	Mode        string          `json:"mode,omitempty"`
+	Rules       []Rule          `json:"rules,omitempty"`
+	Detectors   []dlp.Detector  `json:"detectors,omitempty"`
+	Verify      bool            `json:"verify,omitempty"`
+	DNSFixtures string          `json:"dnsfixtures,omitempty"`
+	Scoring     Scoring         `json:"scoring"`
+	BreakDKIM   bool            `json:"breakdkim,omitempty"`
+	Recipients  RecipientPolicy `json:"recipients"`
+	Resolver    auth.Resolver   `json:"-"`
+}
+
+/*
+  Verdict of the policy
+  Action: pass, hold or reject
+  Rule: rule which decided, empty when no rule matched
+  Reason: why, for the logs and the dashboard
+  Matched: all matching rules, for the hit counters
+  Tags: tags added by the matching rules
+  Notify: notification should be sent
+  Findings: DLP detectors over the threshold
+  Attachments: attachments with the real types and archive files
+  Auth: SPF, DKIM and DMARC results, when Verify is set
+  Signals: signals of the checks with their scores
+  Score: sum of the scores
+  Rewrite: changes of the rewrite rules
+  Trace: every check with its result, in order
+*/
+type Verdict struct {
+	Action      string             `json:"action"`
+	Rule        string             `json:"rule"`
+	Reason      string             `json:"reason"`
+	Matched     []string           `json:"matched,omitempty"`
+	Tags        []string           `json:"tags,omitempty"`
+	Notify      bool               `json:"notify,omitempty"`
+	Findings    []store.Finding    `json:"findings,omitempty"`
+	Attachments []store.Attachment `json:"attachments,omitempty"`
+	Auth        *store.Auth        `json:"auth,omitempty"`
+	Signals     []store.Signal     `json:"signals,omitempty"`
+	Score       int                `json:"score"`
+	Rewrite     *store.Rewrite     `json:"rewrite,omitempty"`
+	Trace       []Step             `json:"trace,omitempty"`
+}
+
+/*
+  One check of the policy
+  Check: name of the check
+  Value: what was checked
+  Result: outcome of the check
+*/
+type Step struct {
+	Check  string `json:"check"`
+	Value  string `json:"value"`
+	Result bool   `json:"result"`
+}
+
+/*
+  Policy built in the filter
+*/
+var Default = &Policy{
+	Domains:   OURDOMAIN[:],
+	Whitelist: WHITELIST[:],
+	Users:     CheckUserList[:],
+}
+
+/*
+  Load policy from the file, Default is used when it's missing
+*/
+func Load(file string) (*Policy, error) {
+	data, err := ioutil.ReadFile(file)
+	if os.IsNotExist(err) {
+		return Default, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	p, errs := Parse(data)
+	if len(errs) > 0 {
+		return nil, fmt.Errorf("%s: %v", file, errs[0])
+	}
+	return p, nil
+}
+
+/*
+  Parse and validate policy, unknown fields are errors
+  so typos are not ignored
+*/
+func Parse(data []byte) (*Policy, []error) {
+	p := &Policy{}
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(p); err != nil {
+		return nil, []error{err}
+	}
+	if errs := p.Validate(); len(errs) > 0 {
+		return nil, errs
+	}
+	return p, nil
+}
+
+/*
+  Validate policy and return all problems found
+*/
+func (p *Policy) Validate() []error {
+	var errs []error
+	if len(p.Domains) == 0 {
+		errs = append(errs, fmt.Errorf("domains: at least one domain is required"))
+	}
+	check := func(field string, list []string) {
+		seen := map[string]bool{}
+		for i, v := range list {
+			switch {
+			case v == "":
+				errs = append(errs, fmt.Errorf("%s[%d]: is empty", field, i))
+			case v != strings.ToLower(strings.TrimSpace(v)):
+				errs = append(errs, fmt.Errorf("%s[%d]: %q must be lower case without spaces", field, i, v))
+			case strings.ContainsAny(v, "@<>"):
+				errs = append(errs, fmt.Errorf("%s[%d]: %q must not have @, < or >", field, i, v))
+			case seen[v]:
+				errs = append(errs, fmt.Errorf("%s[%d]: %q is duplicated", field, i, v))
+			}
+			seen[v] = true
+		}
+	}
+	check("domains", p.Domains)
+	check("whitelist", p.Whitelist)
+	check("users", p.Users)
+	if p.DNSFixtures != "" {
+		fixtures, err := auth.LoadFixtures(p.DNSFixtures)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("dnsfixtures: %v", err))
+		} else {
+			p.Resolver = fixtures
+		}
+	}
+	errs = append(errs, p.Scoring.validate()...)
+	errs = append(errs, p.Recipients.validate()...)
+	return append(errs, p.validateRules()...)
+}
+
+/*
+  Check envelope sender and From header against the policy.
+  From header must have a correct format, see SenderFormat.
+  Null sender of the bounces ("") is never a mismatch.
+*/
+func (p *Policy) Check(sender, senderHeader string) Verdict {
+	var trace []Step
+	test := func(check, value string, result bool) bool {
+		trace = append(trace, Step{Check: check, Value: value, Result: result})
+		return result
+	}
+
+	whitelistFromArg := test("whitelist", sender, p.WhitelistDomainCheck(sender))
+	whitelistFromHeaders := test("whitelist", senderHeader, p.WhitelistDomainCheck(senderHeader))
+	domainResult := test("domain", senderHeader, p.CheckDomain(senderHeader))
+	userResult := test("user", sender, p.CheckUserFromList(sender))
+	userResultHeader := test("user", senderHeader, p.CheckUserFromList(senderHeader))
+	userFromArg, _ := CheckUserNameFromList(sender)
+	userFromHeaders, _ := CheckUserNameFromList(senderHeader)
+	mismatch := test("mismatch", userFromArg+" != "+userFromHeaders, strings.Contains(sender, "@") && userFromArg != userFromHeaders)
+
+	v := Verdict{Action: ActionPass, Trace: trace}
+	switch {
+	case whitelistFromArg || whitelistFromHeaders:
+		v.Rule = "whitelist"
+		v.Reason = "whitelisted domain"
+	case domainResult && (userResult || userResultHeader) && mismatch:
+		v.Action = ActionHold
+		v.Rule = "sender-mismatch"
+		v.Reason = "envelope sender " + userFromArg + " is not From " + userFromHeaders
+	}
+	if v.Rule != "" {
+		v.Matched = []string{v.Rule}
+	}
+	return v
+}
+
+/*
+  Check raw e-mail the same way as the filter does. E-mail
+  which can't be read or has wrong From format is passed.
+*/
+func (p *Policy) CheckMail(sender string, recipients []string, data []byte) Verdict {
+	m, err := mail.ReadMessage(bytes.NewReader(data))
+	if err != nil {
+		return Verdict{Action: ActionPass, Reason: "cannot read e-mail: " + err.Error()}
+	}
+	senderHeader := m.Header.Get("From")
+	senderFromFormat, _ := SenderFormat(senderHeader)
+	step := Step{Check: "from-format", Value: senderHeader, Result: senderFromFormat}
+	if senderFromFormat == false {
+		return Verdict{Action: ActionPass, Reason: "wrong From format", Trace: []Step{step}}
+	}
+	in := Input{Sender: sender, Recipients: recipients, Header: m.Header, Data: data}
+	if in.Parts, err = content.Walk(m); err != nil {
+		in.Incomplete = err.Error()
+	}
+	v := p.Evaluate(in)
+	v.Trace = append([]Step{step}, v.Trace...)
+	return v
+}
+
+/*
+  Checking if sender has a corrent format
+*/
+func SenderFormat(sender string) (bool, error) {
+	senderOk := true
+	numAt := strings.Count(sender, "@")
+	if (numAt != 1) && (numAt != 2) {
+		senderOk = false
+	}
+	return senderOk, nil
+}
+
+/*
+  Checking if OURDOMAIN is the same as MAIL_FROM
+*/
+func CheckDomain(sender string) (bool, error) {
+	return Default.CheckDomain(sender), nil
+}
+
+func (p *Policy) CheckDomain(sender string) bool {
+	rbool := false
+	if !strings.Contains(sender, "@") {
+		return rbool
+	}
+	host := strings.Split(sender, "@")[1]
+	hostfinal := strings.Split(host, ">")[0]
+	for _, domain := range p.Domains {
+		// log.Println("Checking domain: " + domain)
+		if hostfinal == domain {
+			// log.Println(domain + " == " + hostfinal)
+			rbool = true
+			break
+		}
+	}
+	return rbool
+}
+
+/*
+  Checking if e-mail name is in our WHITELIST slice
+*/
+func WhitelistDomainCheck(sender string) (bool, error) {
+	return Default.WhitelistDomainCheck(sender), nil
+}
+
+func (p *Policy) WhitelistDomainCheck(sender string) bool {
+	rbool := false
+	if !strings.Contains(sender, "@") {
+		return rbool
+	}
+	domain := strings.Split(sender, "@")[1]
+	if len(strings.Split(domain, "<")) == 2 {
+		domain = strings.Split(domain, "<")[1]
+	}
+	for _, w := range p.Whitelist {
+		if domain == w {
+			rbool = true
+			break
+		}
+	}
+	return rbool
+}
+
+func CheckUserFromList(sender string) (bool, error) {
+	return Default.CheckUserFromList(sender), nil
+}
+
+func (p *Policy) CheckUserFromList(sender string) bool {
+	rbool := false
+	user := strings.Split(sender, "@")[0]
+	if len(strings.Split(user, "<")) == 2 {
+		user = strings.Split(user, "<")[1]
+	}
+	user = strings.ToLower(user)
+	for _, w := range p.Users {
+		// log.Println("Checking user from CheckUserList: " + user + "==" + w)
+		if user == w {
+			rbool = true
+			break
+		}
+	}
+	return rbool
+}
+
+func CheckUserNameFromList(sender string) (string, error) {
+	if !strings.Contains(sender, "@") {
+		return sender, fmt.Errorf("no @ in %q", sender)
+	}
+	user := strings.Split(sender, "@")[0]
+	domain := strings.Split(sender, "@")[1]
+
+	if len(strings.Split(user, "<")) == 2 {
+		user = strings.Split(user, "<")[1]
+		tmp := strings.Split(sender, "@")[1]
+		domain = strings.Split(tmp, ">")[0]
+	}
+	return user + "@" + domain, nil
+}
@@ -0,0 +1,175 @@
+package policy
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/wolfedale/go-proxy-mail/internal/content"
+)
+
+const bounce = "From: MAILER-DAEMON@foobar.org (Mail Delivery System)\r\n" +
+	"To: pawel.grzesik@foobar.org\r\n" +
+	"Subject: Undelivered Mail Returned to Sender\r\n" +
+	"Content-Type: text/plain\r\n" +
+	"\r\n" +
+	"This is the mail system. Card 4111 1111 1111 1111 was returned.\r\n"
+
+/*
+  Bounces have the null sender (MAIL FROM:<>), the checks
+  splitting the sender on @ must not panic
+*/
+func TestNullSender(t *testing.T) {
+	for _, sender := range []string{"", "MAILER-DAEMON", "<>"} {
+		if Default.CheckDomain(sender) || Default.WhitelistDomainCheck(sender) || Default.CheckUserFromList(sender) {
+			t.Errorf("%q: sender checks matched", sender)
+		}
+		if _, err := CheckUserNameFromList(sender); err == nil {
+			t.Errorf("%q: CheckUserNameFromList without error", sender)
+		}
+	}
+
+	v := Default.CheckMail("", []string{"pawel.grzesik@foobar.org"}, []byte(bounce))
+	if v.Action != ActionPass || v.Rule == "sender-mismatch" {
+		t.Errorf("built in policy: %s %s: %s", v.Action, v.Rule, v.Reason)
+	}
+
+	p, errs := Parse([]byte(`{
+		"domains": ["foobar.org"],
+		"users": ["pawel.grzesik", "mailer-daemon"],
+		"whitelist": ["foobar.org"],
+		"detectors": [{"name": "cards", "type": "creditcard"}],
+		"rules": [{"name": "cards", "match": "\"cards\" in dlp", "action": "hold"}],
+		"scoring": {"weights": {"whitelist": -100}}
+	}`))
+	if len(errs) > 0 {
+		t.Fatal(errs)
+	}
+	v = p.CheckMail("", []string{"pawel.grzesik@foobar.org"}, []byte(bounce))
+	if v.Action != ActionHold || v.Rule != "cards" {
+		t.Errorf("DLP of the bounce: %s %s: %s", v.Action, v.Rule, v.Reason)
+	}
+	for _, s := range v.Signals {
+		if s.Name == SignalWhitelist || s.Name == SignalSenderMismatch {
+			t.Errorf("signal %s for the null sender", s.Name)
+		}
+	}
+}
+
+func TestRecipients(t *testing.T) {
+	p, errs := Parse([]byte(`{
+		"domains": ["foobar.org"],
+		"whitelist": ["partner.com"],
+		"recipients": {
+			"maxexternal": 1,
+			"blocked": ["competitor.com"],
+			"allow": {"supplier.com": ["sales"]}
+		},
+		"rules": [
+			{"name": "ceo", "match": "envelope_from == \"ceo@foobar.org\"", "action": "pass"},
+			{"name": "external", "match": "recipients.external.count > 0", "action": "tag", "tag": "external"}
+		],
+		"mode": "accumulate"
+	}`))
+	if len(errs) > 0 {
+		t.Fatal(errs)
+	}
+	cases := []struct {
+		sender     string
+		recipients []string
+		action     string
+		rule       string
+	}{
+		{"ceo@foobar.org", []string{"x@competitor.com"}, ActionReject, "recipient-blocked"},
+		{"a@partner.com", []string{"x@mail.competitor.com"}, ActionReject, "recipient-blocked"},
+		{"ceo@foobar.org", []string{"x@example.com", "y@example.net"}, ActionPass, "ceo"},
+		{"sales@foobar.org", []string{"x@supplier.com", "y@supplier.com"}, ActionPass, ""},
+		{"sales@foobar.org", []string{"x@supplier.com", "y@example.com"}, ActionPass, "external"},
+		{"bob@foobar.org", []string{"x@supplier.com"}, ActionHold, "recipient-not-allowed"},
+		{"bob@foobar.org", []string{"x@example.com", "y@example.net"}, ActionHold, "too-many-external"},
+		{"bob@foobar.org", []string{"x@foobar.org", "y@foobar.org"}, ActionPass, ""},
+	}
+	for _, c := range cases {
+		data := "From: " + c.sender + "\r\nTo: " + c.recipients[0] + "\r\nSubject: hi\r\n\r\nhi\r\n"
+		v := p.CheckMail(c.sender, c.recipients, []byte(data))
+		if v.Action != c.action || v.Rule != c.rule {
+			t.Errorf("%s => %v: %s %s (%s), want %s %s", c.sender, c.recipients, v.Action, v.Rule, v.Reason, c.action, c.rule)
+		}
+	}
+
+	// built in policy, whitelist is not skipping the recipient checks
+	builtin, errs := Parse([]byte(`{
+		"domains": ["foobar.org"],
+		"whitelist": ["foobar.org"],
+		"recipients": {"maxexternal": 1, "allow": {"supplier.com": ["sales"]}}
+	}`))
+	if len(errs) > 0 {
+		t.Fatal(errs)
+	}
+	whitelisted := []struct {
+		recipients []string
+		action     string
+		rule       string
+	}{
+		{[]string{"x@example.com"}, ActionPass, "whitelist"},
+		{[]string{"x@supplier.com"}, ActionHold, "recipient-not-allowed"},
+		{[]string{"x@example.com", "y@example.net"}, ActionHold, "too-many-external"},
+	}
+	for _, c := range whitelisted {
+		data := "From: bob@foobar.org\r\nTo: " + c.recipients[0] + "\r\nSubject: hi\r\n\r\nhi\r\n"
+		v := builtin.CheckMail("bob@foobar.org", c.recipients, []byte(data))
+		if v.Action != c.action || v.Rule != c.rule {
+			t.Errorf("whitelisted => %v: %s %s (%s), want %s %s", c.recipients, v.Action, v.Rule, v.Reason, c.action, c.rule)
+		}
+	}
+
+	sales := p.externalRecipients([]string{"x@supplier.com", "y@example.com", "z@foobar.org"}, "sales@foobar.org")
+	if len(sales) != 1 || sales[0] != "y@example.com" {
+		t.Errorf("external recipients of sales: %v", sales)
+	}
+	bob := p.externalRecipients([]string{"x@supplier.com", "y@example.com", "z@foobar.org"}, "bob@foobar.org")
+	if len(bob) != 2 {
+		t.Errorf("external recipients of bob: %v", bob)
+	}
+}
+
+/*
+  Parts with broken transfer encoding or over MAXPARTSIZE
+  are not inspected, the e-mail is held instead of passed
+*/
+func TestIncomplete(t *testing.T) {
+	mixed := "From: a@foobar.org\r\n" +
+		"To: b@example.com\r\n" +
+		"Subject: hi\r\n" +
+		"Content-Type: multipart/mixed; boundary=XX\r\n" +
+		"\r\n" +
+		"--XX\r\n" +
+		"Content-Type: text/plain\r\n" +
+		"\r\n" +
+		"hi\r\n" +
+		"--XX\r\n" +
+		"Content-Type: application/octet-stream\r\n" +
+		"Content-Disposition: attachment; filename=a.bin\r\n" +
+		"Content-Transfer-Encoding: base64\r\n" +
+		"\r\n" +
+		"%s\r\n" +
+		"--XX--\r\n"
+	cases := []struct {
+		name   string
+		body   string
+		reason string
+	}{
+		{"complete", "SGVsbG8K", ""},
+		{"broken", "SGVs!!!bG8K", "MIME parts not inspected: 2: broken transfer encoding"},
+		{"too big", strings.Repeat("QUFB", int(content.MAXPARTSIZE)/3+1), "MIME parts not inspected: 2: bigger than 26214400 bytes"},
+	}
+	for _, c := range cases {
+		v := Default.CheckMail("a@foobar.org", []string{"b@example.com"}, []byte(fmt.Sprintf(mixed, c.body)))
+		if c.reason == "" && v.Action != ActionPass {
+			t.Errorf("%s: %s %s: %s", c.name, v.Action, v.Rule, v.Reason)
+		}
+		if c.reason != "" && (v.Action != ActionHold || v.Rule != "content-uninspected" || v.Reason != c.reason) {
+			t.Errorf("%s: %s %s: %s, want hold content-uninspected: %s", c.name, v.Action, v.Rule, v.Reason, c.reason)
+		}
+	}
+}
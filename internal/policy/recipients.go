@@ -0,0 +1,231 @@
+package policy
+
+import (
+	"fmt"
+	"strings"
+)
+
+/*
+  Recipient checks of the policy, used when no rule decided,
+  blocked domains are checked first
+  Watched: users (like Users) who can't send e-mails outside of
+  our domains, these e-mails are held
+  MaxExternal: e-mails with more external recipients are held, 0 is off
+  Blocked: recipient domains (and their subdomains) e-mails can't
+  be sent to, e.g. competitors or personal webmail, they are rejected
+  Allow: recipient domain with the senders which can send to it:
+  addresses, users of our domains or sender domains. E-mails from
+  other senders are held. For the allowed senders recipients of
+  the domain don't count as external.
+  e.g.
+    "recipients": {
+      "watched": ["pawel.grzesik"],
+      "maxexternal": 20,
+      "blocked": ["competitor.com", "gmail.com"],
+      "allow": {"partner.com": ["sales", "ceo@foobar.org"]}
+    }
+*/
+type RecipientPolicy struct {
+	Watched     []string            `json:"watched,omitempty"`
+	MaxExternal int                 `json:"maxexternal,omitempty"`
+	Blocked     []string            `json:"blocked,omitempty"`
+	Allow       map[string][]string `json:"allow,omitempty"`
+}
+
+func (r *RecipientPolicy) validate() []error {
+	var errs []error
+	if r.MaxExternal < 0 {
+		errs = append(errs, fmt.Errorf("recipients: maxexternal must not be negative"))
+	}
+	for i := range r.Watched {
+		r.Watched[i] = strings.ToLower(r.Watched[i])
+	}
+	for i := range r.Blocked {
+		r.Blocked[i] = strings.ToLower(r.Blocked[i])
+	}
+	allow := map[string][]string{}
+	for domain, senders := range r.Allow {
+		if len(senders) == 0 {
+			errs = append(errs, fmt.Errorf("recipients: allow list of %s is empty", domain))
+		}
+		for _, s := range senders {
+			allow[strings.ToLower(domain)] = append(allow[strings.ToLower(domain)], strings.ToLower(s))
+		}
+	}
+	if r.Allow != nil {
+		r.Allow = allow
+	}
+	return errs
+}
+
+func (r RecipientPolicy) empty() bool {
+	return len(r.Watched) == 0 && r.MaxExternal == 0 && len(r.Blocked) == 0 && len(r.Allow) == 0
+}
+
+/*
+  Domain is the same as one of the list or its subdomain,
+  returns the one from the list
+*/
+func under(domain string, list []string) string {
+	for _, d := range list {
+		if domain == d || strings.HasSuffix(domain, "."+d) {
+			return d
+		}
+	}
+	return ""
+}
+
+func (p *Policy) internal(domain string) bool {
+	for _, d := range p.Domains {
+		if strings.EqualFold(domain, d) {
+			return true
+		}
+	}
+	return false
+}
+
+/*
+  Sender is on the allow list of the recipient domain, second
+  value is false when the domain has no allow list
+*/
+func (p *Policy) allowed(domain, sender string) (bool, bool) {
+	var list []string
+	for d, senders := range p.Recipients.Allow {
+		if domain == d || strings.HasSuffix(domain, "."+d) {
+			list = append(list, senders...)
+		}
+	}
+	if list == nil {
+		return false, false
+	}
+	user, senderDomain := addressPart(sender, ".user"), addressPart(sender, ".domain")
+	for _, s := range list {
+		if s == sender || s == senderDomain || (s == user && p.internal(senderDomain)) {
+			return true, true
+		}
+	}
+	return false, true
+}
+
+/*
+  What the recipient is for the sender: "internal", "blocked",
+  "allowed", "not allowed" or "external"
+*/
+func (p *Policy) recipient(addr, sender string) string {
+	domain := addressPart(addr, ".domain")
+	switch ok, listed := p.allowed(domain, sender); {
+	case under(domain, p.Recipients.Blocked) != "":
+		return "blocked"
+	case listed && !ok:
+		return "not allowed"
+	case listed:
+		return "allowed"
+	case !p.internal(domain):
+		return "external"
+	}
+	return "internal"
+}
+
+/*
+  Recipients outside of our domains, recipients allowed
+  for the sender don't count
+*/
+func (p *Policy) externalRecipients(recipients []string, sender string) []string {
+	sender, _ = address(sender)
+	var list []string
+	for _, r := range recipients {
+		addr, _ := address(r)
+		switch p.recipient(addr, sender) {
+		case "internal", "allowed":
+		default:
+			list = append(list, addr)
+		}
+	}
+	return list
+}
+
+/*
+  Recipients in the blocked domains
+*/
+func (p *Policy) blockedRecipients(recipients []string) []string {
+	var list []string
+	for _, r := range recipients {
+		addr, _ := address(r)
+		if under(addressPart(addr, ".domain"), p.Recipients.Blocked) != "" {
+			list = append(list, addr)
+		}
+	}
+	return list
+}
+
+/*
+  Reject e-mails to the blocked domains. It's checked before
+  the whitelist and the rules, so they can't pass them.
+*/
+func (p *Policy) checkBlocked(v *Verdict, in Input) bool {
+	blocked := p.blockedRecipients(in.Recipients)
+	if len(blocked) == 0 {
+		return false
+	}
+	for _, addr := range blocked {
+		v.Trace = append(v.Trace, Step{Check: "recipient " + addr, Value: "blocked", Result: true})
+	}
+	v.Action, v.Rule, v.Reason = ActionReject, "recipient-blocked", "recipient "+blocked[0]+" is in a blocked domain"
+	v.Matched = append(v.Matched, v.Rule)
+	return true
+}
+
+/*
+  Use recipient checks of the policy, when no rule decided.
+  Recipients not allowed, external recipients of the watched
+  users and too many external recipients are held (blocked
+  domains are checked before, see checkBlocked). Returns true
+  when it decided.
+*/
+func (p *Policy) checkRecipients(v *Verdict, in Input) bool {
+	r := p.Recipients
+	if r.empty() {
+		return false
+	}
+	sender, _ := address(in.Sender)
+	user, senderDomain := addressPart(sender, ".user"), addressPart(sender, ".domain")
+	watched := p.internal(senderDomain)
+	if watched {
+		watched = false
+		for _, w := range r.Watched {
+			if w == user {
+				watched = true
+			}
+		}
+	}
+
+	decide := func(action, rule, reason string) bool {
+		v.Action, v.Rule, v.Reason = action, rule, reason
+		v.Matched = append(v.Matched, rule)
+		return true
+	}
+	var notAllowed []string
+	for _, rcpt := range in.Recipients {
+		addr, _ := address(rcpt)
+		result := p.recipient(addr, sender)
+		switch result {
+		case "not allowed":
+			notAllowed = append(notAllowed, addr)
+			result += " for " + sender
+		case "allowed":
+			result += " for " + sender
+		}
+		v.Trace = append(v.Trace, Step{Check: "recipient " + addr, Value: result, Result: result != "internal" && !strings.HasPrefix(result, "allowed")})
+	}
+	external := p.externalRecipients(in.Recipients, in.Sender)
+
+	switch {
+	case len(notAllowed) > 0:
+		return decide(ActionHold, "recipient-not-allowed", sender+" can't send to "+strings.Join(notAllowed, ", "))
+	case watched && len(external) > 0:
+		return decide(ActionHold, "watched-external", "watched user "+sender+" sends to "+strings.Join(external, ", "))
+	case r.MaxExternal > 0 && len(external) > r.MaxExternal:
+		return decide(ActionHold, "too-many-external", fmt.Sprintf("%d external recipients, more than %d", len(external), r.MaxExternal))
+	}
+	return false
+}
@@ -0,0 +1,559 @@
+package policy
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/mail"
+	"os"
+	"sort"
+	"strings"
+	"syscall"
+
+	"github.com/wolfedale/go-proxy-mail/internal/attachment"
+	"github.com/wolfedale/go-proxy-mail/internal/auth"
+	"github.com/wolfedale/go-proxy-mail/internal/content"
+	"github.com/wolfedale/go-proxy-mail/internal/dlp"
+	"github.com/wolfedale/go-proxy-mail/internal/store"
+)
+
+/*
+  Actions of the rules
+  pass: deliver e-mail
+  hold: keep it in the quarantine
+  reject: bounce it to the sender
+  tag: deliver it, Tag is added to the record
+  notify: deliver it and send notification
+  rewrite: deliver it changed, see Subject, Banner and Footer
+*/
+const ActionPass string = "pass"
+const ActionHold string = "hold"
+const ActionReject string = "reject"
+const ActionTag string = "tag"
+const ActionNotify string = "notify"
+const ActionRewrite string = "rewrite"
+
+/*
+  Modes of the rule list
+  first-match: first matching rule decides
+  accumulate: tags and notifications of all matching
+  rules are used, first matching pass, hold or reject decides
+*/
+const ModeFirstMatch string = "first-match"
+const ModeAccumulate string = "accumulate"
+
+/*
+  HITSFILE: per rule hit counters, updated by the filter
+*/
+const HITSFILE string = "/var/spool/mailProxy/rulehits.json"
+
+/*
+  One rule of the policy
+  Name: used in the logs, dashboard and hit counters
+  Match: expression, see expr.go
+  Action: pass, hold, reject, tag or notify
+  Priority: rules are checked from the lowest priority,
+  rules with the same priority in the file order
+  Tag: tag added by the tag action
+  Reason: why, for the logs and the dashboard
+  Subject, Banner, Footer: subject prefix, warning on top
+  of the text and the disclaimer at the end of it, added
+  by the rewrite action
+*/
+type Rule struct {
+	Name     string `json:"name"`
+	Match    string `json:"match"`
+	Action   string `json:"action"`
+	Priority int    `json:"priority"`
+	Tag      string `json:"tag,omitempty"`
+	Reason   string `json:"reason,omitempty"`
+	Subject  string `json:"subject,omitempty"`
+	Banner   string `json:"banner,omitempty"`
+	Footer   string `json:"footer,omitempty"`
+	expr     node
+}
+
+/*
+  E-mail checked by the rules
+  Parts: decoded MIME parts, needed by DLP detectors
+  and attachment checks
+  Data: raw e-mail, needed by DKIM
+  Incomplete: why not all MIME parts were read (content.Walk
+  error), the e-mail is not passed then
+*/
+type Input struct {
+	Sender     string
+	Recipients []string
+	Header     mail.Header
+	Parts      []content.Part
+	Data       []byte
+	Incomplete string
+}
+
+/*
+  Field values of the e-mail for the expressions
+*/
+type mailEnv struct {
+	p           *Policy
+	in          Input
+	findings    []store.Finding
+	attachments []store.Attachment
+	auth        store.Auth
+	signals     []store.Signal
+}
+
+func (e mailEnv) field(name string) interface{} {
+	if strings.HasPrefix(name, "header.") {
+		return e.in.Header.Get(strings.TrimPrefix(name, "header."))
+	}
+	switch name {
+	case "envelope_from", "envelope_from.user", "envelope_from.domain":
+		addr, _ := address(e.in.Sender)
+		return addressPart(addr, name)
+	case "header_from", "header_from.user", "header_from.domain":
+		addr, _ := address(e.in.Header.Get("From"))
+		return addressPart(addr, name)
+	case "header_from.name":
+		_, display := address(e.in.Header.Get("From"))
+		return display
+	case "reply_to", "reply_to.domain":
+		addr, _ := address(e.in.Header.Get("Reply-To"))
+		return addressPart(addr, name)
+	case "recipients":
+		return e.in.Recipients
+	case "recipients.domain":
+		var domains []string
+		for _, r := range e.in.Recipients {
+			addr, _ := address(r)
+			domains = append(domains, addressPart(addr, ".domain"))
+		}
+		return domains
+	case "recipients.count":
+		return int64(len(e.in.Recipients))
+	case "recipients.external":
+		return e.p.externalRecipients(e.in.Recipients, e.in.Sender)
+	case "recipients.external.count":
+		return int64(len(e.p.externalRecipients(e.in.Recipients, e.in.Sender)))
+	case "recipients.blocked":
+		return e.p.blockedRecipients(e.in.Recipients)
+	case "subject":
+		return e.in.Header.Get("Subject")
+	case "internal_domains":
+		return e.p.Domains
+	case "whitelist":
+		return e.p.Whitelist
+	case "users":
+		return e.p.Users
+	case "watched":
+		return e.p.Recipients.Watched
+	case "dlp":
+		var names []string
+		for _, f := range e.findings {
+			names = append(names, f.Detector)
+		}
+		return names
+	case "spf":
+		return e.auth.SPF
+	case "spf.domain":
+		return e.auth.SPFDomain
+	case "dkim":
+		return e.auth.DKIM
+	case "dkim.domain":
+		return e.auth.DKIMDomains
+	case "dmarc":
+		return e.auth.DMARC
+	case "dmarc.policy":
+		return e.auth.DMARCPolicy
+	case "signals":
+		var names []string
+		for _, s := range e.signals {
+			names = append(names, s.Name)
+		}
+		return names
+	case "score", "signals.score":
+		return int64(total(e.signals))
+	}
+	if strings.HasPrefix(name, "attachments.") {
+		return attachmentField(e.attachments, name)
+	}
+	return ""
+}
+
+func attachmentField(list []store.Attachment, name string) interface{} {
+	files := attachment.Files(list)
+	var values []string
+	switch name {
+	case "attachments.name":
+		for _, f := range files {
+			values = append(values, f.Name)
+		}
+	case "attachments.extension":
+		for _, f := range files {
+			values = append(values, attachment.Extension(f.Name))
+		}
+	case "attachments.type":
+		for _, f := range files {
+			values = append(values, f.Type)
+		}
+	case "attachments.contenttype":
+		for _, a := range list {
+			values = append(values, a.ContentType)
+		}
+	case "attachments.count":
+		return int64(len(list))
+	case "attachments.size", "attachments.totalsize":
+		var max, total int64
+		for _, a := range list {
+			total += int64(a.Size)
+			if int64(a.Size) > max {
+				max = int64(a.Size)
+			}
+		}
+		if name == "attachments.size" {
+			return max
+		}
+		return total
+	case "attachments.encrypted":
+		for _, a := range list {
+			if a.Encrypted {
+				return true
+			}
+		}
+		return false
+	case "attachments.uninspected":
+		for _, a := range list {
+			if a.Error != "" {
+				return true
+			}
+		}
+		return false
+	case "attachments.mismatch":
+		for _, f := range files {
+			if attachment.Mismatch(f.Name, f.Type) {
+				return true
+			}
+		}
+		return false
+	}
+	return values
+}
+
+/*
+  Return lower case address and display name, the same
+  way as CheckUserNameFromList when it can't be parsed
+*/
+func address(s string) (string, string) {
+	if a, err := mail.ParseAddress(s); err == nil {
+		return strings.ToLower(a.Address), a.Name
+	}
+	if strings.Contains(s, "@") {
+		addr, _ := CheckUserNameFromList(s)
+		return strings.ToLower(strings.TrimSpace(addr)), ""
+	}
+	return strings.ToLower(strings.TrimSpace(s)), ""
+}
+
+func addressPart(addr, name string) string {
+	i := strings.LastIndex(addr, "@")
+	switch {
+	case strings.HasSuffix(name, ".user"):
+		if i < 0 {
+			return addr
+		}
+		return addr[:i]
+	case strings.HasSuffix(name, ".domain"):
+		if i < 0 {
+			return ""
+		}
+		return addr[i+1:]
+	}
+	return addr
+}
+
+/*
+  Check and compile the rules
+*/
+func (p *Policy) validateRules() []error {
+	var errs []error
+	switch p.Mode {
+	case "", ModeFirstMatch, ModeAccumulate:
+	default:
+		errs = append(errs, fmt.Errorf("mode: must be %s or %s", ModeFirstMatch, ModeAccumulate))
+	}
+
+	detectors := map[string]bool{}
+	for i := range p.Detectors {
+		d := &p.Detectors[i]
+		if err := d.Compile(); err != nil {
+			errs = append(errs, fmt.Errorf("detectors[%d]: %v", i, err))
+		}
+		if detectors[d.Name] {
+			errs = append(errs, fmt.Errorf("detectors[%d]: name %q is duplicated", i, d.Name))
+		}
+		detectors[d.Name] = true
+	}
+
+	seen := map[string]bool{}
+	for i := range p.Rules {
+		r := &p.Rules[i]
+		switch {
+		case r.Name == "":
+			errs = append(errs, fmt.Errorf("rules[%d]: name is required", i))
+		case seen[r.Name]:
+			errs = append(errs, fmt.Errorf("rules[%d]: name %q is duplicated", i, r.Name))
+		}
+		seen[r.Name] = true
+
+		switch r.Action {
+		case ActionPass, ActionHold, ActionReject, ActionNotify:
+		case ActionTag:
+			if r.Tag == "" {
+				errs = append(errs, fmt.Errorf("rules[%d]: tag is required for the tag action", i))
+			}
+		case ActionRewrite:
+			if r.Subject == "" && r.Banner == "" && r.Footer == "" {
+				errs = append(errs, fmt.Errorf("rules[%d]: subject, banner or footer is required for the rewrite action", i))
+			}
+		default:
+			errs = append(errs, fmt.Errorf("rules[%d]: unknown action %q", i, r.Action))
+		}
+
+		expr, err := compile(r.Match)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("rules[%d]: match: %v", i, err))
+			continue
+		}
+		r.expr = expr
+	}
+	return errs
+}
+
+/*
+  Evaluate the e-mail. Rules of the policy are used when there
+  are any, the built in checks (see Check) otherwise.
+  Action of the verdict is always pass, hold or reject.
+*/
+func (p *Policy) Evaluate(in Input) Verdict {
+	var findings []store.Finding
+	var trace []Step
+	if len(p.Detectors) > 0 {
+		findings = dlp.Scan(p.Detectors, in.Parts)
+		for _, f := range findings {
+			trace = append(trace, Step{Check: "dlp " + f.Detector, Value: fmt.Sprintf("%d matches in %s", f.Count, strings.Join(f.Parts, ", ")), Result: true})
+		}
+	}
+	attachments := attachment.Inspect(in.Parts)
+	for _, a := range attachment.Files(attachments) {
+		trace = append(trace, Step{Check: "attachment " + a.Name, Value: describe(a), Result: a.Encrypted || a.Error != "" || attachment.Mismatch(a.Name, a.Type)})
+	}
+	var results *store.Auth
+	if p.Verify && in.Data != nil {
+		results = p.verify(in)
+		trace = append(trace,
+			Step{Check: "spf", Value: results.SPF + ": " + results.SPFReason, Result: results.SPF == auth.Pass},
+			Step{Check: "dkim", Value: results.DKIM + ": " + strings.Join(results.DKIMDomains, ", ") + results.DKIMReason, Result: results.DKIM == auth.Pass},
+			Step{Check: "dmarc", Value: results.DMARC + ": " + results.FromDomain + " p=" + results.DMARCPolicy, Result: results.DMARC == auth.Pass})
+	}
+
+	signals := p.signals(in, findings, attachments, results)
+	score := total(signals)
+	for _, s := range signals {
+		trace = append(trace, Step{Check: fmt.Sprintf("signal %s %+d", s.Name, s.Score), Value: s.Reason, Result: true})
+	}
+	trace = append(trace, Step{Check: "score", Value: fmt.Sprintf("%d (tag %d, hold %d, reject %d)", score, p.Scoring.Tag, p.Scoring.Hold, p.Scoring.Reject), Result: score > 0})
+
+	if len(p.Rules) == 0 {
+		v := p.Check(in.Sender, in.Header.Get("From"))
+		v.Findings = findings
+		v.Attachments = attachments
+		v.Auth = results
+		v.Signals = signals
+		v.Score = score
+		v.Trace = append(trace, v.Trace...)
+		// whitelisted senders are checked for the recipients too
+		if !p.checkBlocked(&v, in) && v.Action == ActionPass && !p.checkRecipients(&v, in) && v.Rule == "" {
+			p.threshold(&v)
+		}
+		p.checkIncomplete(&v, in)
+		return v
+	}
+
+	rules := make([]Rule, len(p.Rules))
+	copy(rules, p.Rules)
+	sort.SliceStable(rules, func(i, j int) bool { return rules[i].Priority < rules[j].Priority })
+
+	e := mailEnv{p: p, in: in, findings: findings, attachments: attachments, signals: signals}
+	if results != nil {
+		e.auth = *results
+	}
+	v := Verdict{Action: ActionPass, Findings: findings, Attachments: attachments, Auth: results, Signals: signals, Score: score, Trace: trace}
+	if p.checkBlocked(&v, in) {
+		return v
+	}
+	decided := false
+	for _, r := range rules {
+		if r.expr == nil {
+			continue
+		}
+		matched := truth(r.expr.eval(e))
+		v.Trace = append(v.Trace, Step{Check: "rule " + r.Name, Value: r.Match, Result: matched})
+		if !matched {
+			continue
+		}
+		v.Matched = append(v.Matched, r.Name)
+
+		switch r.Action {
+		case ActionTag:
+			v.Tags = append(v.Tags, r.Tag)
+		case ActionNotify:
+			v.Notify = true
+		case ActionRewrite:
+			v.Rewrite = p.rewrite(v.Rewrite, r)
+		}
+		if !decided {
+			v.Rule = r.Name
+			v.Reason = r.Reason
+			if v.Reason == "" {
+				v.Reason = "rule " + r.Name + " matched"
+			}
+			if r.Action == ActionPass || r.Action == ActionHold || r.Action == ActionReject {
+				v.Action = r.Action
+				decided = true
+			}
+		}
+		if p.Mode != ModeAccumulate {
+			break
+		}
+	}
+	if !decided && !p.checkRecipients(&v, in) {
+		p.threshold(&v)
+	}
+	p.checkIncomplete(&v, in)
+	return v
+}
+
+/*
+  Parts which were not read were not checked by DLP and
+  attachment checks, so the e-mail is held instead of passed
+*/
+func (p *Policy) checkIncomplete(v *Verdict, in Input) {
+	if in.Incomplete == "" {
+		return
+	}
+	v.Trace = append(v.Trace, Step{Check: "content", Value: "not all MIME parts read: " + in.Incomplete, Result: true})
+	if v.Action != ActionPass {
+		return
+	}
+	v.Action, v.Rule, v.Reason = ActionHold, "content-uninspected", "MIME parts not inspected: "+in.Incomplete
+	v.Matched = append(v.Matched, v.Rule)
+}
+
+/*
+  Add changes of the rewrite rule
+*/
+func (p *Policy) rewrite(rw *store.Rewrite, r Rule) *store.Rewrite {
+	if rw == nil {
+		rw = &store.Rewrite{BreakDKIM: p.BreakDKIM}
+	}
+	if r.Subject != "" {
+		rw.Subject = append(rw.Subject, r.Subject)
+	}
+	if r.Banner != "" {
+		rw.Banners = append(rw.Banners, r.Banner)
+	}
+	if r.Footer != "" {
+		rw.Footers = append(rw.Footers, r.Footer)
+	}
+	return rw
+}
+
+/*
+  SPF, DKIM and DMARC of the e-mail, system DNS is
+  used when the policy has no Resolver
+*/
+func (p *Policy) verify(in Input) *store.Auth {
+	r := p.Resolver
+	if r == nil {
+		r = auth.DNS{}
+	}
+	results := auth.Verify(r, in.Data, in.Sender, in.Header)
+	return &results
+}
+
+/*
+  Type and problems of the attachment for the trace
+*/
+func describe(a store.Attachment) string {
+	s := fmt.Sprintf("%s, %d bytes", a.Type, a.Size)
+	if a.Encrypted {
+		s += ", encrypted"
+	}
+	if attachment.Mismatch(a.Name, a.Type) {
+		s += ", extension mismatch"
+	}
+	if a.Error != "" {
+		s += ", " + a.Error
+	}
+	return s
+}
+
+/*
+  Add hits of the matched rules to the counters file,
+  file is locked, so many filters can run at the same time
+*/
+func AddHits(file string, rules []string) error {
+	if len(rules) == 0 {
+		return nil
+	}
+	f, err := os.OpenFile(file, os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	if err := syscall.Flock(int(f.Fd()), syscall.LOCK_EX); err != nil {
+		return err
+	}
+	defer syscall.Flock(int(f.Fd()), syscall.LOCK_UN)
+
+	hits := map[string]int{}
+	data, err := ioutil.ReadAll(f)
+	if err != nil {
+		return err
+	}
+	if len(data) > 0 {
+		if err := json.Unmarshal(data, &hits); err != nil {
+			return fmt.Errorf("%s: %v", file, err)
+		}
+	}
+	for _, r := range rules {
+		hits[r]++
+	}
+
+	data, err = json.Marshal(hits)
+	if err != nil {
+		return err
+	}
+	if err := f.Truncate(0); err != nil {
+		return err
+	}
+	_, err = f.WriteAt(data, 0)
+	return err
+}
+
+/*
+  Read hit counters
+*/
+func Hits(file string) (map[string]int, error) {
+	hits := map[string]int{}
+	data, err := ioutil.ReadFile(file)
+	if os.IsNotExist(err) {
+		return hits, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if len(data) > 0 {
+		err = json.Unmarshal(data, &hits)
+	}
+	return hits, err
+}
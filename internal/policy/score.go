@@ -0,0 +1,202 @@
+package policy
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/wolfedale/go-proxy-mail/internal/attachment"
+	"github.com/wolfedale/go-proxy-mail/internal/auth"
+	"github.com/wolfedale/go-proxy-mail/internal/spoof"
+	"github.com/wolfedale/go-proxy-mail/internal/store"
+)
+
+/*
+  Signals of the checks, spoofing signals are in internal/spoof
+  whitelist: sender domain is on the whitelist
+  sender-mismatch: our user with envelope sender other than From
+  dlp-<detector>: DLP detector over the threshold
+  attachment-*: executable, encrypted, not inspected or
+  with extension not matching the real type
+  spf-*, dkim-fail, dmarc-fail: results of the verification
+*/
+const SignalWhitelist string = "whitelist"
+const SignalSenderMismatch string = "sender-mismatch"
+const SignalDLP string = "dlp"
+const SignalExecutable string = "attachment-executable"
+const SignalEncrypted string = "attachment-encrypted"
+const SignalUninspected string = "attachment-uninspected"
+const SignalMismatch string = "attachment-mismatch"
+const SignalSPFFail string = "spf-fail"
+const SignalSPFSoftFail string = "spf-softfail"
+const SignalDKIMFail string = "dkim-fail"
+const SignalDMARCFail string = "dmarc-fail"
+
+/*
+  Scores of the signals, "dlp" is used by all DLP detectors
+*/
+var SCORES = map[string]int{
+	SignalWhitelist:      -100,
+	SignalSenderMismatch: 60,
+	SignalDLP:            40,
+	SignalExecutable:     40,
+	SignalEncrypted:      30,
+	SignalUninspected:    40,
+	SignalMismatch:       50,
+	SignalSPFFail:        30,
+	SignalSPFSoftFail:    10,
+	SignalDKIMFail:       20,
+	SignalDMARCFail:      50,
+}
+
+/*
+  Types which can run on the computer of the recipient
+*/
+var executables = map[string]bool{"exe": true, "elf": true, "macho": true, "script": true, "jar": true}
+
+/*
+  Scoring of the policy
+  Weights: scores of the signals, they are used instead of the
+  built in ones, 0 turns the signal off. Weight of "dlp" is used
+  by the detectors which have no own weight ("dlp-cards").
+  Tag, Hold, Reject: thresholds of the whole policy, not of the
+  rules, used when no rule decided, 0 is off. Rule with its own
+  threshold is matching the score, e.g. "score >= 80".
+*/
+type Scoring struct {
+	Weights map[string]int `json:"weights,omitempty"`
+	Tag     int            `json:"tag,omitempty"`
+	Hold    int            `json:"hold,omitempty"`
+	Reject  int            `json:"reject,omitempty"`
+}
+
+func (s Scoring) validate() []error {
+	var errs []error
+	if s.Tag < 0 || s.Hold < 0 || s.Reject < 0 {
+		errs = append(errs, fmt.Errorf("scoring: thresholds must not be negative"))
+	}
+	if s.Hold > 0 && s.Reject > 0 && s.Hold > s.Reject {
+		errs = append(errs, fmt.Errorf("scoring: hold threshold is bigger than reject"))
+	}
+	if s.Tag > 0 && s.Hold > 0 && s.Tag > s.Hold {
+		errs = append(errs, fmt.Errorf("scoring: tag threshold is bigger than hold"))
+	}
+	return errs
+}
+
+func (s Scoring) weight(name string, score int) int {
+	if w, ok := s.Weights[name]; ok {
+		return w
+	}
+	if strings.HasPrefix(name, SignalDLP+"-") {
+		if w, ok := s.Weights[SignalDLP]; ok {
+			return w
+		}
+		return SCORES[SignalDLP]
+	}
+	if w, ok := SCORES[name]; ok {
+		return w
+	}
+	return score
+}
+
+/*
+  Signals of all checks with their weights, signals
+  with weight 0 are left out
+*/
+func (p *Policy) signals(in Input, findings []store.Finding, attachments []store.Attachment, results *store.Auth) []store.Signal {
+	var signals []store.Signal
+	add := func(name string, score int, reason string) {
+		if w := p.Scoring.weight(name, score); w != 0 {
+			signals = append(signals, store.Signal{Name: name, Score: w, Reason: reason})
+		}
+	}
+
+	// null sender of the bounces has no domain and no user
+	if strings.Contains(in.Sender, "@") {
+		check := p.Check(in.Sender, in.Header.Get("From"))
+		switch check.Rule {
+		case "whitelist":
+			add(SignalWhitelist, 0, "sender domain is on the whitelist")
+		case "sender-mismatch":
+			add(SignalSenderMismatch, 0, check.Reason)
+		}
+	}
+
+	for _, f := range findings {
+		add(SignalDLP+"-"+f.Detector, 0, fmt.Sprintf("%d matches of %s", f.Count, f.Detector))
+	}
+
+	reasons := map[string][]string{}
+	for _, a := range attachment.Files(attachments) {
+		if executables[a.Type] {
+			reasons[SignalExecutable] = append(reasons[SignalExecutable], a.Name+" is "+a.Type)
+		}
+		if a.Encrypted && len(a.Files) == 0 {
+			reasons[SignalEncrypted] = append(reasons[SignalEncrypted], a.Name+" is encrypted")
+		}
+		if a.Error != "" && len(a.Files) == 0 {
+			reasons[SignalUninspected] = append(reasons[SignalUninspected], a.Name+": "+a.Error)
+		}
+		if attachment.Mismatch(a.Name, a.Type) {
+			reasons[SignalMismatch] = append(reasons[SignalMismatch], a.Name+" is "+a.Type)
+		}
+	}
+	for _, name := range []string{SignalExecutable, SignalEncrypted, SignalUninspected, SignalMismatch} {
+		if len(reasons[name]) > 0 {
+			add(name, 0, strings.Join(reasons[name], ", "))
+		}
+	}
+
+	if results != nil {
+		switch results.SPF {
+		case auth.Fail:
+			add(SignalSPFFail, 0, "SPF of "+results.SPFDomain+" failed for "+results.ClientIP)
+		case auth.SoftFail:
+			add(SignalSPFSoftFail, 0, "SPF of "+results.SPFDomain+" soft failed for "+results.ClientIP)
+		}
+		if results.DKIM != auth.Pass && results.DKIM != auth.None {
+			add(SignalDKIMFail, 0, "DKIM "+results.DKIM+": "+results.DKIMReason)
+		}
+		if results.DMARC == auth.Fail {
+			add(SignalDMARCFail, 0, "DMARC of "+results.FromDomain+" failed, policy "+results.DMARCPolicy)
+		}
+	}
+
+	names := append(append([]string{}, p.Names...), p.Users...)
+	for _, s := range spoof.Check(p.Domains, names, in.Sender, in.Header) {
+		add(s.Name, s.Score, s.Reason)
+	}
+	return signals
+}
+
+func total(signals []store.Signal) int {
+	score := 0
+	for _, s := range signals {
+		score += s.Score
+	}
+	return score
+}
+
+/*
+  Use global thresholds of the scoring, when no rule decided
+*/
+func (p *Policy) threshold(v *Verdict) {
+	s := p.Scoring
+	reason := func(name string, limit int) string {
+		return fmt.Sprintf("score %d is over the %s threshold %d", v.Score, name, limit)
+	}
+	switch {
+	case s.Reject > 0 && v.Score >= s.Reject:
+		v.Action, v.Rule, v.Reason = ActionReject, "score", reason("reject", s.Reject)
+	case s.Hold > 0 && v.Score >= s.Hold:
+		v.Action, v.Rule, v.Reason = ActionHold, "score", reason("hold", s.Hold)
+	case s.Tag > 0 && v.Score >= s.Tag:
+		v.Tags = append(v.Tags, "score")
+		if v.Rule == "" {
+			v.Rule, v.Reason = "score", reason("tag", s.Tag)
+		}
+	default:
+		return
+	}
+	v.Matched = append(v.Matched, "score")
+}
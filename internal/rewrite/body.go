@@ -0,0 +1,317 @@
+package rewrite
+
+import (
+	"bytes"
+	"encoding/base64"
+	"fmt"
+	"html"
+	"io/ioutil"
+	"mime"
+	"mime/quotedprintable"
+	"regexp"
+	"strings"
+
+	"golang.org/x/text/encoding/htmlindex"
+
+	"github.com/wolfedale/go-proxy-mail/internal/content"
+	"github.com/wolfedale/go-proxy-mail/internal/store"
+)
+
+/*
+  Styles of the HTML banner and footer
+*/
+const BANNERSTYLE string = "border:1px solid #d9a300;background:#fff4cc;color:#333;padding:8px;margin:0 0 12px 0;font-family:sans-serif;font-size:13px"
+const FOOTERSTYLE string = "border-top:1px solid #ccc;color:#666;padding:8px 0 0 0;margin:16px 0 0 0;font-family:sans-serif;font-size:11px"
+
+var bodyTag = regexp.MustCompile(`(?i)<body[^>]*>`)
+var bodyEnd = regexp.MustCompile(`(?i)</body\s*>`)
+
+/*
+  Change the body of the part. Main is true for the text of the
+  e-mail: all alternatives, first part of the other multiparts.
+  Signed and encrypted multiparts and attached e-mails are not
+  changed.
+*/
+func part(header, body []byte, r store.Rewrite, nl string, main bool, depth int) ([]byte, []byte, error) {
+	if !main || depth > MAXDEPTH {
+		return header, body, nil
+	}
+	mediatype, params := "text/plain", map[string]string{}
+	if ct := field(header, "Content-Type"); ct != "" {
+		var err error
+		if mediatype, params, err = mime.ParseMediaType(ct); err != nil {
+			return header, body, nil
+		}
+	}
+
+	switch {
+	case mediatype == "multipart/signed" || mediatype == "multipart/encrypted":
+		return header, body, nil
+	case strings.HasPrefix(mediatype, "multipart/"):
+		if params["boundary"] == "" {
+			return header, body, nil
+		}
+		out, err := multipart(body, params["boundary"], mediatype == "multipart/alternative", r, nl, depth)
+		return header, out, err
+	case mediatype == "text/plain" || mediatype == "text/html":
+		if d, _, _ := mime.ParseMediaType(field(header, "Content-Disposition")); d == "attachment" {
+			return header, body, nil
+		}
+		return text(header, body, mediatype, params, r, nl)
+	}
+	return header, body, nil
+}
+
+/*
+  Change parts of the multipart, preamble, delimiters
+  and the epilogue are kept as they are
+*/
+func multipart(body []byte, boundary string, alternative bool, r store.Rewrite, nl string, depth int) ([]byte, error) {
+	delimiter := []byte("--" + boundary)
+	var out []byte
+	start := -1 // start of the current part
+	n := 0
+	pos := 0
+	for pos < len(body) {
+		end := bytes.IndexByte(body[pos:], '\n')
+		line := body[pos:]
+		if end >= 0 {
+			line = body[pos : pos+end+1]
+		}
+		isDelimiter, last := delimiterLine(line, delimiter)
+		if !isDelimiter {
+			if start < 0 {
+				out = append(out, line...)
+			}
+			pos += len(line)
+			continue
+		}
+
+		if start >= 0 {
+			h, sep, b := content.SplitHeader(body[start:pos])
+			h, b, err := part(h, b, r, nl, n == 0 || alternative, depth+1)
+			if err != nil {
+				return body, err
+			}
+			out = append(append(append(out, h...), sep...), b...)
+			n++
+		}
+		out = append(out, line...)
+		pos += len(line)
+		start = pos
+		if last {
+			// epilogue
+			return append(out, body[pos:]...), nil
+		}
+	}
+	if start >= 0 {
+		out = append(out, body[start:]...)
+	}
+	return out, nil
+}
+
+/*
+  Line is "--boundary" with optional white space or the close
+  delimiter "--boundary--", other lines starting with the
+  boundary are text of the part. Second value is true for
+  the close delimiter.
+*/
+func delimiterLine(line, delimiter []byte) (bool, bool) {
+	if !bytes.HasPrefix(line, delimiter) {
+		return false, false
+	}
+	rest := line[len(delimiter):]
+	last := bytes.HasPrefix(rest, []byte("--"))
+	if last {
+		rest = rest[2:]
+	}
+	if len(bytes.Trim(rest, " \t\r\n")) > 0 {
+		return false, false
+	}
+	return true, last
+}
+
+/*
+  Add banners and footers to the text or HTML part, it's
+  encoded back with its charset and transfer encoding.
+  Charset is changed to UTF-8 when the text doesn't fit
+  in it, 7bit parts with non ASCII text are changed to
+  quoted-printable.
+*/
+func text(header, body []byte, mediatype string, params map[string]string, r store.Rewrite, nl string) ([]byte, []byte, error) {
+	encoding := strings.ToLower(field(header, "Content-Transfer-Encoding"))
+	raw, err := decode(body, encoding)
+	if err != nil {
+		return header, body, err
+	}
+	charset := strings.ToLower(params["charset"])
+	s, ok := toUTF8(charset, raw)
+	if !ok {
+		// unknown charset, we can't change the text
+		return header, body, nil
+	}
+
+	pnl := nl
+	if encoding == "base64" && !bytes.Contains(raw, []byte("\r\n")) {
+		pnl = "\n"
+	}
+	if mediatype == "text/html" {
+		s = htmlText(s, r, pnl)
+	} else {
+		s = plainText(s, r, pnl)
+	}
+
+	data, ok := fromUTF8(charset, s)
+	if !ok {
+		params["charset"] = "utf-8"
+		data = []byte(s)
+		header = setField(header, "Content-Type", mime.FormatMediaType(mediatype, params), nl)
+	}
+	if (encoding == "" || encoding == "7bit") && !content.IsASCII(string(data)) {
+		encoding = "quoted-printable"
+		header = setField(header, "Content-Transfer-Encoding", encoding, nl)
+	}
+
+	out := encode(data, encoding, nl)
+	if bytes.HasSuffix(body, []byte("\n")) && !bytes.HasSuffix(out, []byte("\n")) {
+		out = append(out, nl...)
+	}
+	return header, out, nil
+}
+
+func plainText(s string, r store.Rewrite, nl string) string {
+	lines := func(list []string) string {
+		text := strings.Join(list, "\n\n")
+		return strings.Replace(strings.Replace(text, "\r\n", "\n", -1), "\n", nl, -1)
+	}
+	if len(r.Banners) > 0 {
+		s = lines(r.Banners) + nl + nl + s
+	}
+	if len(r.Footers) > 0 {
+		if s != "" && !strings.HasSuffix(s, nl) {
+			s += nl
+		}
+		s += nl + lines(r.Footers) + nl
+	}
+	return s
+}
+
+func htmlText(s string, r store.Rewrite, nl string) string {
+	div := func(style string, list []string) string {
+		var texts []string
+		for _, t := range list {
+			t = html.EscapeString(strings.Replace(t, "\r\n", "\n", -1))
+			texts = append(texts, strings.Replace(t, "\n", "<br>", -1))
+		}
+		return `<div style="` + style + `">` + strings.Join(texts, "<br><br>") + "</div>" + nl
+	}
+	if len(r.Banners) > 0 {
+		banner := div(BANNERSTYLE, r.Banners)
+		if loc := bodyTag.FindStringIndex(s); loc != nil {
+			s = s[:loc[1]] + nl + banner + s[loc[1]:]
+		} else {
+			s = banner + s
+		}
+	}
+	if len(r.Footers) > 0 {
+		footer := div(FOOTERSTYLE, r.Footers)
+		if all := bodyEnd.FindAllStringIndex(s, -1); len(all) > 0 {
+			last := all[len(all)-1][0]
+			s = s[:last] + footer + s[last:]
+		} else {
+			s += nl + footer
+		}
+	}
+	return s
+}
+
+func decode(body []byte, encoding string) ([]byte, error) {
+	switch encoding {
+	case "base64":
+		clean := bytes.Map(func(r rune) rune {
+			if r == '\r' || r == '\n' || r == ' ' || r == '\t' {
+				return -1
+			}
+			return r
+		}, body)
+		out, err := base64.StdEncoding.DecodeString(string(clean))
+		if err != nil {
+			return nil, fmt.Errorf("base64: %v", err)
+		}
+		return out, nil
+	case "quoted-printable":
+		out, err := ioutil.ReadAll(quotedprintable.NewReader(bytes.NewReader(body)))
+		if err != nil {
+			return nil, fmt.Errorf("quoted-printable: %v", err)
+		}
+		return out, nil
+	}
+	return body, nil
+}
+
+func encode(data []byte, encoding, nl string) []byte {
+	switch encoding {
+	case "base64":
+		s := base64.StdEncoding.EncodeToString(data)
+		var b bytes.Buffer
+		for len(s) > 76 {
+			b.WriteString(s[:76] + nl)
+			s = s[76:]
+		}
+		if s != "" {
+			b.WriteString(s + nl)
+		}
+		return b.Bytes()
+	case "quoted-printable":
+		var b bytes.Buffer
+		w := quotedprintable.NewWriter(&b)
+		w.Write(bytes.Replace(data, []byte("\r\n"), []byte("\n"), -1))
+		w.Close()
+		if nl == "\n" {
+			return bytes.Replace(b.Bytes(), []byte("\r\n"), []byte("\n"), -1)
+		}
+		return b.Bytes()
+	}
+	return data
+}
+
+/*
+  Text of the charset in UTF-8, false when the
+  charset is unknown
+*/
+func toUTF8(charset string, data []byte) (string, bool) {
+	switch charset {
+	case "", "utf-8", "utf8", "us-ascii":
+		return string(data), true
+	}
+	enc, err := htmlindex.Get(charset)
+	if err != nil {
+		return "", false
+	}
+	out, err := enc.NewDecoder().Bytes(data)
+	if err != nil {
+		return "", false
+	}
+	return string(out), true
+}
+
+/*
+  Text in the charset, false when it doesn't fit in it
+*/
+func fromUTF8(charset, s string) ([]byte, bool) {
+	switch charset {
+	case "utf-8", "utf8":
+		return []byte(s), true
+	case "", "us-ascii":
+		return []byte(s), content.IsASCII(s)
+	}
+	enc, err := htmlindex.Get(charset)
+	if err != nil {
+		return nil, false
+	}
+	out, err := enc.NewEncoder().Bytes([]byte(s))
+	if err != nil {
+		return nil, false
+	}
+	return out, true
+}
@@ -0,0 +1,164 @@
+/*
+  Package rewrite is changing delivered e-mails: subject
+  prefixes, warning banners and disclaimers. Only the changed
+  fields and parts are written again, structure, charsets and
+  encodings of the rest of the e-mail are kept.
+*/
+package rewrite
+
+import (
+	"log"
+	"mime"
+	"strings"
+
+	"github.com/wolfedale/go-proxy-mail/internal/content"
+	"github.com/wolfedale/go-proxy-mail/internal/store"
+)
+
+/*
+  MAXDEPTH: nested multiparts, deeper ones are not changed
+*/
+const MAXDEPTH int = 10
+
+/*
+  Change the e-mail. Changes which would break DKIM signatures
+  of the e-mail (subject when it's signed, body always) are
+  skipped unless BreakDKIM is set, their names are returned.
+*/
+func Apply(data []byte, r store.Rewrite) ([]byte, []string, error) {
+	header, sep, body := content.SplitHeader(data)
+	nl := content.Newline(data)
+
+	var skipped []string
+	signed, hasSignature := signedHeaders(header)
+	subject := len(r.Subject) > 0
+	if subject && signed["subject"] && !r.BreakDKIM {
+		skipped = append(skipped, "subject")
+		subject = false
+	}
+	changeBody := len(r.Banners) > 0 || len(r.Footers) > 0
+	if changeBody && hasSignature && !r.BreakDKIM {
+		skipped = append(skipped, "body")
+		changeBody = false
+	}
+
+	if changeBody {
+		var err error
+		if header, body, err = part(header, body, r, nl, true, 0); err != nil {
+			return data, skipped, err
+		}
+		if field(header, "MIME-Version") == "" && field(header, "Content-Type") != "" {
+			header = setField(header, "MIME-Version", "1.0", nl)
+		}
+	}
+	if subject {
+		header = prefixSubject(header, r.Subject, nl)
+	}
+
+	out := make([]byte, 0, len(header)+len(sep)+len(body))
+	out = append(append(append(out, header...), sep...), body...)
+	return out, skipped, nil
+}
+
+/*
+  E-mail for the delivery, changed by the rewrite rules. Problems
+  are logged with the queue id, the original is returned when
+  it can't be changed.
+*/
+func Delivered(queue string, data []byte, r *store.Rewrite) []byte {
+	if r == nil {
+		return data
+	}
+	changed, skipped, err := Apply(data, *r)
+	if err != nil {
+		log.Println(queue+" Cannot rewrite e-mail: ", err)
+		return data
+	}
+	if len(skipped) > 0 {
+		log.Println(queue + " Not rewritten, DKIM signature would break: " + strings.Join(skipped, ", "))
+	}
+	return changed
+}
+
+/*
+  Prefix the subject, prefixes which are in the subject
+  already (e.g. in the replies) are not added again
+*/
+func prefixSubject(header []byte, prefixes []string, nl string) []byte {
+	subject := content.DecodeWords(field(header, "Subject"))
+	changed := false
+	for i := len(prefixes) - 1; i >= 0; i-- {
+		if !strings.Contains(subject, prefixes[i]) {
+			subject = strings.TrimSpace(prefixes[i] + " " + subject)
+			changed = true
+		}
+	}
+	if !changed {
+		return header
+	}
+	if !content.IsASCII(subject) {
+		subject = mime.QEncoding.Encode("utf-8", subject)
+	}
+	return setField(header, "Subject", subject, nl)
+}
+
+/*
+  Names of the headers signed by DKIM, second value is
+  true when the e-mail has any signature
+*/
+func signedHeaders(header []byte) (map[string]bool, bool) {
+	signed := map[string]bool{}
+	found := false
+	for _, f := range content.HeaderFields(header) {
+		name, value := content.FieldValue(f)
+		if !strings.EqualFold(name, "DKIM-Signature") {
+			continue
+		}
+		found = true
+		for _, tag := range strings.Split(value, ";") {
+			tag = strings.Join(strings.Fields(tag), "")
+			if !strings.HasPrefix(tag, "h=") {
+				continue
+			}
+			for _, h := range strings.Split(tag[2:], ":") {
+				signed[strings.ToLower(h)] = true
+			}
+		}
+	}
+	return signed, found
+}
+
+/*
+  Unfolded value of the first field with the name
+*/
+func field(header []byte, name string) string {
+	for _, f := range content.HeaderFields(header) {
+		if n, v := content.FieldValue(f); strings.EqualFold(n, name) {
+			return v
+		}
+	}
+	return ""
+}
+
+/*
+  Replace the first field with the name, other fields
+  stay where they are. It's added at the end when
+  the header doesn't have it.
+*/
+func setField(header []byte, name, value, nl string) []byte {
+	line := []byte(content.Fold(name+": "+value, nl) + nl)
+	var out []byte
+	done := false
+	for _, f := range content.HeaderFields(header) {
+		if n, _ := content.FieldValue(f); !done && strings.EqualFold(n, name) {
+			out = append(out, line...)
+			done = true
+			continue
+		}
+		out = append(out, f...)
+	}
+	if !done {
+		out = append(out, line...)
+	}
+	return out
+}
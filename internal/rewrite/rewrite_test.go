@@ -0,0 +1,148 @@
+package rewrite
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/wolfedale/go-proxy-mail/internal/store"
+)
+
+const plain = "From: a@foobar.org\n" +
+	"To: b@example.com\n" +
+	"Subject: Offer\n" +
+	"\n" +
+	"Hello\n"
+
+const alternative = "From: a@foobar.org\r\n" +
+	"Subject: Offer\r\n" +
+	"MIME-Version: 1.0\r\n" +
+	"Content-Type: multipart/alternative; boundary=\"XX\"\r\n" +
+	"\r\n" +
+	"preamble\r\n" +
+	"--XX\r\n" +
+	"Content-Type: text/plain; charset=utf-8\r\n" +
+	"\r\n" +
+	"Hello\r\n" +
+	"--XXY is not a delimiter\r\n" +
+	"--XX \r\n" +
+	"Content-Type: text/html; charset=utf-8\r\n" +
+	"\r\n" +
+	"<html><body><p>Hello</p></body></html>\r\n" +
+	"--XX--\r\n" +
+	"epilogue\r\n"
+
+const mixed = "From: a@foobar.org\n" +
+	"Subject: Offer\n" +
+	"Content-Type: multipart/mixed; boundary=XX\n" +
+	"\n" +
+	"--XX\n" +
+	"Content-Type: text/plain\n" +
+	"Content-Transfer-Encoding: base64\n" +
+	"\n" +
+	"SGVsbG8K\n" +
+	"--XX\n" +
+	"Content-Type: text/plain\n" +
+	"Content-Disposition: attachment; filename=notes.txt\n" +
+	"\n" +
+	"notes\n" +
+	"--XX--\n"
+
+const signed = "DKIM-Signature: v=1; a=rsa-sha256; d=foobar.org; s=mail;\n" +
+	"\th=from:subject; bh=abc; b=abc\n" +
+	plain
+
+func TestApply(t *testing.T) {
+	cases := []struct {
+		name    string
+		data    string
+		r       store.Rewrite
+		has     []string
+		hasNot  []string
+		skipped string
+	}{
+		{"subject", plain, store.Rewrite{Subject: []string{"[EXTERNAL]"}},
+			[]string{"Subject: [EXTERNAL] Offer\n", "\nHello\n"}, nil, ""},
+		{"subject prefix is not added again", strings.Replace(plain, "Offer", "Re: [EXTERNAL] Offer", 1), store.Rewrite{Subject: []string{"[EXTERNAL]"}},
+			[]string{"Subject: Re: [EXTERNAL] Offer\n"}, []string{"[EXTERNAL] Re:"}, ""},
+		{"non ASCII subject", plain, store.Rewrite{Subject: []string{"[ZEWNĘTRZNY]"}},
+			[]string{"Subject: =?utf-8?q?"}, []string{"Ę"}, ""},
+		{"plain banner and footer", plain, store.Rewrite{Banners: []string{"Be careful"}, Footers: []string{"Disclaimer"}},
+			[]string{"\nBe careful\n\nHello\n\nDisclaimer\n"}, nil, ""},
+		{"alternative", alternative, store.Rewrite{Banners: []string{"Be careful"}},
+			[]string{"\r\nBe careful\r\n\r\nHello\r\n--XXY is not a delimiter\r\n--XX \r\n", "<body>\r\n<div style=", "--XX--\r\nepilogue\r\n", "preamble\r\n--XX\r\n"},
+			[]string{"\n\n", "Be careful\r\n\r\n--XXY"}, ""},
+		{"mixed", mixed, store.Rewrite{Footers: []string{"Disclaimer"}},
+			[]string{"SGVsbG8KCkRpc2NsYWltZXIK\n", "\nnotes\n--XX--\n"}, []string{"notes\n\nDisclaimer"}, ""},
+		{"signed subject", signed, store.Rewrite{Subject: []string{"[EXTERNAL]"}},
+			[]string{"Subject: Offer\n"}, []string{"[EXTERNAL]"}, "subject"},
+		{"signed body", signed, store.Rewrite{Subject: []string{"[EXTERNAL]"}, Footers: []string{"Disclaimer"}, BreakDKIM: false},
+			[]string{"\nHello\n"}, []string{"Disclaimer"}, "subject, body"},
+		{"break DKIM", signed, store.Rewrite{Subject: []string{"[EXTERNAL]"}, Footers: []string{"Disclaimer"}, BreakDKIM: true},
+			[]string{"Subject: [EXTERNAL] Offer\n", "Hello\n\nDisclaimer\n"}, nil, ""},
+		{"signed multipart", strings.Replace(mixed, "multipart/mixed; boundary=XX", "multipart/signed; boundary=XX", 1), store.Rewrite{Footers: []string{"Disclaimer"}},
+			[]string{"SGVsbG8K\n"}, []string{"Disclaimer"}, ""},
+	}
+	for _, c := range cases {
+		out, skipped, err := Apply([]byte(c.data), c.r)
+		if err != nil {
+			t.Errorf("%s: %v", c.name, err)
+			continue
+		}
+		if got := strings.Join(skipped, ", "); got != c.skipped {
+			t.Errorf("%s: skipped %q, want %q", c.name, got, c.skipped)
+		}
+		for _, s := range c.has {
+			if !strings.Contains(string(out), s) {
+				t.Errorf("%s: %q is missing in\n%s", c.name, s, out)
+			}
+		}
+		for _, s := range c.hasNot {
+			if strings.Contains(string(out), s) {
+				t.Errorf("%s: %q is in\n%s", c.name, s, out)
+			}
+		}
+	}
+}
+
+func TestApplyBrokenPart(t *testing.T) {
+	data := strings.Replace(mixed, "SGVsbG8K", "!!!", 1)
+	out, _, err := Apply([]byte(data), store.Rewrite{Footers: []string{"Disclaimer"}})
+	if err == nil {
+		t.Errorf("broken base64 without error")
+	}
+	if string(out) != data {
+		t.Errorf("broken e-mail was changed:\n%s", out)
+	}
+	if got := Delivered("TEST", []byte(data), &store.Rewrite{Footers: []string{"Disclaimer"}}); string(got) != data {
+		t.Errorf("Delivered changed broken e-mail:\n%s", got)
+	}
+	if got := Delivered("TEST", []byte(plain), nil); string(got) != plain {
+		t.Errorf("Delivered without rewrite changed e-mail:\n%s", got)
+	}
+}
+
+func TestDelimiterLine(t *testing.T) {
+	cases := []struct {
+		line      string
+		delimiter bool
+		last      bool
+	}{
+		{"--XX\n", true, false},
+		{"--XX\r\n", true, false},
+		{"--XX \t\r\n", true, false},
+		{"--XX", true, false},
+		{"--XX--\r\n", true, true},
+		{"--XX-- \n", true, true},
+		{"--XXY\n", false, false},
+		{"--XX-\n", false, false},
+		{"--XX text\n", false, false},
+		{"--XX--text\n", false, false},
+		{"XX\n", false, false},
+	}
+	for _, c := range cases {
+		delimiter, last := delimiterLine([]byte(c.line), []byte("--XX"))
+		if delimiter != c.delimiter || last != c.last {
+			t.Errorf("%q: %v %v, want %v %v", c.line, delimiter, last, c.delimiter, c.last)
+		}
+	}
+}
@@ -0,0 +1,257 @@
+package spoof
+
+import (
+	"fmt"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+
+	"golang.org/x/text/unicode/norm"
+)
+
+/*
+  Characters which look like latin letters or digits,
+  Cyrillic and Greek ones are used in the homoglyph attacks
+*/
+var confusables = map[rune]string{
+	'а': "a", 'е': "e", 'о': "o", 'р': "p", 'с': "c", 'у': "y", 'х': "x",
+	'і': "i", 'ј': "j", 'ѕ': "s", 'ԁ': "d", 'һ': "h", 'ӏ': "l", 'ԛ': "q",
+	'ԝ': "w", 'к': "k", 'м': "m", 'н': "h", 'т': "t", 'в': "b", 'г': "r",
+	'α': "a", 'ο': "o", 'ρ': "p", 'ν': "v", 'ι': "i", 'κ': "k", 'τ': "t",
+	'υ': "u", 'χ': "x", 'ε': "e", 'ɡ': "g", 'ł': "l", 'ø': "o", 'đ': "d",
+	'ß': "ss", 'æ': "ae", 'œ': "oe",
+	'0': "o", '1': "l", 'i': "l", '|': "l", '3': "e", '5': "s",
+}
+
+/*
+  Letters which look like one letter when they are together
+*/
+var sequences = strings.NewReplacer("rn", "m", "vv", "w", "cl", "d")
+
+/*
+  Skeleton of the text: lower case, without accents, with
+  the similar looking characters replaced, so "fooЬаr.оrg",
+  "f00bar.org" and "foobár.org" are all the same
+*/
+func skeleton(s string) string {
+	var b strings.Builder
+	for _, r := range norm.NFKD.String(strings.ToLower(s)) {
+		if unicode.Is(unicode.Mn, r) {
+			continue
+		}
+		if c, ok := confusables[r]; ok {
+			b.WriteString(c)
+		} else {
+			b.WriteRune(r)
+		}
+	}
+	return sequences.Replace(b.String())
+}
+
+/*
+  Domain with the punycode labels (xn--) decoded,
+  second value is true when there were any
+*/
+func decodeDomain(domain string) (string, bool) {
+	labels := strings.Split(domain, ".")
+	puny := false
+	for i, l := range labels {
+		if !strings.HasPrefix(l, "xn--") {
+			continue
+		}
+		puny = true
+		if d, err := punycode(l[4:]); err == nil {
+			labels[i] = d
+		}
+	}
+	return strings.Join(labels, "."), puny
+}
+
+/*
+  Punycode decoder (RFC 3492)
+*/
+func punycode(s string) (string, error) {
+	const base, tmin, tmax, skew, damp = 36, 1, 26, 38, 700
+	adapt := func(delta, points int, first bool) int {
+		if first {
+			delta /= damp
+		} else {
+			delta /= 2
+		}
+		delta += delta / points
+		k := 0
+		for delta > ((base-tmin)*tmax)/2 {
+			delta /= base - tmin
+			k += base
+		}
+		return k + (base-tmin+1)*delta/(delta+skew)
+	}
+
+	var output []rune
+	if pos := strings.LastIndexByte(s, '-'); pos >= 0 {
+		for _, c := range s[:pos] {
+			if c >= utf8.RuneSelf {
+				return "", fmt.Errorf("wrong punycode %s", s)
+			}
+			output = append(output, c)
+		}
+		s = s[pos+1:]
+	}
+
+	n, bias, i := 128, 72, 0
+	for len(s) > 0 {
+		oldi, w := i, 1
+		for k := base; ; k += base {
+			if len(s) == 0 {
+				return "", fmt.Errorf("wrong punycode")
+			}
+			c := s[0]
+			s = s[1:]
+			digit := 0
+			switch {
+			case c >= 'a' && c <= 'z':
+				digit = int(c - 'a')
+			case c >= 'A' && c <= 'Z':
+				digit = int(c - 'A')
+			case c >= '0' && c <= '9':
+				digit = int(c-'0') + 26
+			default:
+				return "", fmt.Errorf("wrong punycode")
+			}
+			i += digit * w
+			if i > 1<<24 {
+				return "", fmt.Errorf("wrong punycode")
+			}
+			t := k - bias
+			if t < tmin {
+				t = tmin
+			} else if t > tmax {
+				t = tmax
+			}
+			if digit < t {
+				break
+			}
+			w *= base - t
+		}
+		bias = adapt(i-oldi, len(output)+1, oldi == 0)
+		n += i / (len(output) + 1)
+		i %= len(output) + 1
+		if n > unicode.MaxRune {
+			return "", fmt.Errorf("wrong punycode")
+		}
+		output = append(output[:i], append([]rune{rune(n)}, output[i:]...)...)
+		i++
+	}
+	return string(output), nil
+}
+
+/*
+  Edit distance with transpositions (optimal string alignment)
+*/
+func distance(a, b string) int {
+	ra, rb := []rune(a), []rune(b)
+	d := make([][]int, len(ra)+1)
+	for i := range d {
+		d[i] = make([]int, len(rb)+1)
+		d[i][0] = i
+	}
+	for j := range d[0] {
+		d[0][j] = j
+	}
+	for i := 1; i <= len(ra); i++ {
+		for j := 1; j <= len(rb); j++ {
+			cost := 1
+			if ra[i-1] == rb[j-1] {
+				cost = 0
+			}
+			d[i][j] = min(d[i-1][j]+1, d[i][j-1]+1, d[i-1][j-1]+cost)
+			if i > 1 && j > 1 && ra[i-1] == rb[j-2] && ra[i-2] == rb[j-1] {
+				d[i][j] = min(d[i][j], d[i-2][j-2]+1)
+			}
+		}
+	}
+	return d[len(ra)][len(rb)]
+}
+
+/*
+  Name of the domain without the TLD, e.g. "foobar" for foobar.co.uk
+*/
+func name(domain string) (string, string) {
+	org := orgDomain(domain)
+	i := strings.IndexByte(org, '.')
+	if i < 0 {
+		return org, ""
+	}
+	return org[:i], org[i+1:]
+}
+
+func orgDomain(domain string) string {
+	labels := strings.Split(domain, ".")
+	n := 2
+	if len(labels) > 2 && len(labels[len(labels)-1]) == 2 && len(labels[len(labels)-2]) <= 3 {
+		n = 3
+	}
+	if len(labels) <= n {
+		return domain
+	}
+	return strings.Join(labels[len(labels)-n:], ".")
+}
+
+/*
+  Check if the domain is looking like our domain, returns
+  signal name, the reason and how close it is (0 is the
+  closest), signal is empty when it's not
+*/
+func lookalike(domain, ours string) (string, string, int) {
+	domain = strings.ToLower(strings.TrimSuffix(domain, "."))
+	if domain == ours || strings.HasSuffix(domain, "."+ours) {
+		return "", "", 0
+	}
+	decoded, puny := decodeDomain(domain)
+	ascii := true
+	for _, r := range decoded {
+		if r >= utf8.RuneSelf {
+			ascii = false
+		}
+	}
+	signal := SignalLookalike
+	switch {
+	case puny:
+		signal = SignalPunycode
+	case !ascii:
+		signal = SignalHomoglyph
+	}
+
+	skel, ourSkel := skeleton(decoded), skeleton(ours)
+	if skel == ourSkel {
+		return signal, fmt.Sprintf("%s looks like %s", decoded, ours), 0
+	}
+
+	// foobar.org.evil.com, foobar-org.com, foobarorg.com
+	flat := "." + strings.Replace(skel, "-", ".", -1)
+	if strings.Contains(flat, "."+ourSkel+".") || strings.Contains(flat, "."+strings.Replace(ourSkel, ".", "", -1)+".") {
+		return signal, fmt.Sprintf("%s has %s in it", decoded, ours), 1
+	}
+
+	// fooba.org, foobar.co, fooabr.org
+	label, tld := name(skel)
+	ourLabel, ourTld := name(ourSkel)
+	if label == ourLabel && tld != ourTld {
+		return signal, fmt.Sprintf("%s is %s with other TLD", decoded, ours), 2
+	}
+	limit := 0
+	switch {
+	case len(ourLabel) >= 8:
+		limit = 2
+	case len(ourLabel) >= 4:
+		limit = 1
+	}
+	if d := distance(label, ourLabel); d > 0 && d <= limit {
+		rank := 3 + 2*d
+		if tld != ourTld {
+			rank++
+		}
+		return signal, fmt.Sprintf("%s is %d character(s) from %s", decoded, d, ours), rank
+	}
+	return "", "", 0
+}
@@ -0,0 +1,152 @@
+/*
+  Package spoof is looking for e-mails pretending to be
+  from us: display names of our people, domains looking
+  like our domains and Reply-To outside of them.
+*/
+package spoof
+
+import (
+	"net/mail"
+	"sort"
+	"strings"
+	"unicode"
+
+	"github.com/wolfedale/go-proxy-mail/internal/store"
+)
+
+/*
+  Signals
+  display-name: display name of our person or our address, from other domain
+  lookalike-domain: domain similar to our domain, e.g. fooba.org, foobar-org.com
+  homoglyph-domain: our domain written with similar looking characters
+  punycode-domain: punycode (xn--) domain looking like our domain
+  reply-to-external: replies are going outside of our domains
+*/
+const SignalDisplayName string = "display-name"
+const SignalLookalike string = "lookalike-domain"
+const SignalHomoglyph string = "homoglyph-domain"
+const SignalPunycode string = "punycode-domain"
+const SignalReplyTo string = "reply-to-external"
+
+/*
+  Scores of the signals
+*/
+var SCORES = map[string]int{
+	SignalDisplayName: 40,
+	SignalLookalike:   50,
+	SignalHomoglyph:   60,
+	SignalPunycode:    60,
+	SignalReplyTo:     20,
+}
+
+/*
+  Check the e-mail
+  domains: our domains
+  names: display names of our people, users like
+  "pawel.grzesik" are matching "Pawel Grzesik" too
+*/
+func Check(domains, names []string, sender string, header mail.Header) []store.Signal {
+	var signals []store.Signal
+	add := func(name, reason string) {
+		for _, s := range signals {
+			if s.Name == name {
+				return
+			}
+		}
+		signals = append(signals, store.Signal{Name: name, Score: SCORES[name], Reason: reason})
+	}
+
+	fromAddr, fromName := address(header.Get("From"))
+	fromDomain := domainOf(fromAddr)
+	if fromDomain != "" && !ours(fromDomain, domains) && fromName != "" {
+		if reason := displayName(fromName, domains, names); reason != "" {
+			add(SignalDisplayName, reason+", but it's from "+fromAddr)
+		}
+	}
+
+	replyTo, _ := address(header.Get("Reply-To"))
+	replyDomain := domainOf(replyTo)
+	if replyDomain != "" && !ours(replyDomain, domains) {
+		add(SignalReplyTo, "Reply-To "+replyTo+" is outside of our domains")
+	}
+
+	envelope, _ := address(sender)
+	for _, d := range []string{fromDomain, domainOf(envelope), replyDomain} {
+		if d == "" || ours(d, domains) {
+			continue
+		}
+		// the closest of our domains
+		best, why, rank := "", "", 0
+		for _, o := range domains {
+			if signal, reason, r := lookalike(d, o); signal != "" && (best == "" || r < rank) {
+				best, why, rank = signal, reason, r
+			}
+		}
+		if best != "" {
+			add(best, why)
+		}
+	}
+	return signals
+}
+
+/*
+  Display name has our address or name of our person
+*/
+func displayName(display string, domains, names []string) string {
+	lower := strings.ToLower(display)
+	for _, d := range domains {
+		if strings.Contains(lower, "@"+d) {
+			return "display name \"" + display + "\" has our address"
+		}
+	}
+	words := nameWords(display)
+	if len(words) == 0 {
+		return ""
+	}
+	for _, n := range names {
+		w := nameWords(n)
+		if (len(w) > 1 || len(strings.Join(w, "")) >= 4) && strings.Join(w, " ") == strings.Join(words, " ") {
+			return "display name \"" + display + "\" is " + n
+		}
+	}
+	return ""
+}
+
+/*
+  Words of the name, without accents and similar looking
+  characters, sorted, so "Grzesik, Paweł" is "pawel grzesik"
+*/
+func nameWords(s string) []string {
+	words := strings.FieldsFunc(skeleton(s), func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsDigit(r)
+	})
+	sort.Strings(words)
+	return words
+}
+
+func ours(domain string, domains []string) bool {
+	for _, d := range domains {
+		if domain == d || strings.HasSuffix(domain, "."+d) {
+			return true
+		}
+	}
+	return false
+}
+
+func address(s string) (string, string) {
+	if a, err := mail.ParseAddress(s); err == nil {
+		return strings.ToLower(a.Address), a.Name
+	}
+	s = strings.TrimSpace(s)
+	if i := strings.LastIndex(s, "<"); i >= 0 {
+		return strings.ToLower(strings.Trim(s[i:], "<> ")), strings.Trim(s[:i], "\" ")
+	}
+	return strings.ToLower(s), ""
+}
+
+func domainOf(addr string) string {
+	if i := strings.LastIndex(addr, "@"); i >= 0 {
+		return addr[i+1:]
+	}
+	return ""
+}
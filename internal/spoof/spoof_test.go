@@ -0,0 +1,116 @@
+package spoof
+
+import (
+	"net/mail"
+	"strings"
+	"testing"
+)
+
+func TestDecodeDomain(t *testing.T) {
+	cases := []struct {
+		domain  string
+		decoded string
+		puny    bool
+	}{
+		{"xn--mnchen-3ya.de", "münchen.de", true},
+		{"xn--fbar-55da.org", "fооbar.org", true},
+		{"mail.xn--foobr-7ve.org", "mail.foobаr.org", true},
+		{"foobar.org", "foobar.org", false},
+		{"xn--!!!.org", "xn--!!!.org", true},
+	}
+	for _, c := range cases {
+		decoded, puny := decodeDomain(c.domain)
+		if decoded != c.decoded || puny != c.puny {
+			t.Errorf("%s: %q %v, want %q %v", c.domain, decoded, puny, c.decoded, c.puny)
+		}
+	}
+}
+
+func TestSkeleton(t *testing.T) {
+	same := [][2]string{
+		{"foobar.org", "FOOBAR.org"},
+		{"f00bar.org", "foobar.org"},
+		{"fооbаr.org", "foobar.org"},
+		{"foobár.org", "foobar.org"},
+		{"rnicrosoft.com", "microsoft.com"},
+		{"paypa1.com", "paypal.com"},
+		{"vvalmart.com", "walmart.com"},
+	}
+	for _, c := range same {
+		if skeleton(c[0]) != skeleton(c[1]) {
+			t.Errorf("%s and %s: %q and %q", c[0], c[1], skeleton(c[0]), skeleton(c[1]))
+		}
+	}
+	if skeleton("foobaz.org") == skeleton("foobar.org") {
+		t.Errorf("foobaz.org looks like foobar.org")
+	}
+}
+
+func TestLookalike(t *testing.T) {
+	cases := []struct {
+		domain string
+		signal string
+		rank   int
+	}{
+		{"foobar.org", "", 0},
+		{"mail.foobar.org", "", 0},
+		{"f00bar.org", SignalLookalike, 0},
+		{"fооbar.org", SignalHomoglyph, 0},
+		{"xn--fbar-55da.org", SignalPunycode, 0},
+		{"foobar.org.evil.com", SignalLookalike, 1},
+		{"foobar-org.com", SignalLookalike, 1},
+		{"foobar.com", SignalLookalike, 2},
+		{"fooba.org", SignalLookalike, 5},
+		{"fooabr.org", SignalLookalike, 5},
+		{"fooba.com", SignalLookalike, 6},
+		{"foo.org", "", 0},
+		{"example.org", "", 0},
+	}
+	for _, c := range cases {
+		signal, reason, rank := lookalike(c.domain, "foobar.org")
+		if signal != c.signal || rank != c.rank {
+			t.Errorf("%s: %s %d (%s), want %s %d", c.domain, signal, rank, reason, c.signal, c.rank)
+		}
+	}
+}
+
+func TestCheck(t *testing.T) {
+	domains := []string{"foobar.org", "fooba.net"}
+	names := []string{"pawel.grzesik"}
+	cases := []struct {
+		from    string
+		replyTo string
+		want    []string
+		reason  string
+	}{
+		{"Pawel Grzesik <pawel.grzesik@foobar.org>", "", nil, ""},
+		{"Pawel Grzesik <pawel@gmail.com>", "", []string{SignalDisplayName}, ""},
+		{"\"Grzesik, Paweł\" <pawel@gmail.com>", "", []string{SignalDisplayName}, ""},
+		{"\"pawel.grzesik@foobar.org\" <x@gmail.com>", "", []string{SignalDisplayName}, ""},
+		{"Pawel <pawel@gmail.com>", "", nil, ""},
+		{"Pawel Grzesik <pawel.grzesik@foobar.org>", "x@gmail.com", []string{SignalReplyTo}, ""},
+		// closer to fooba.net (other TLD) than to foobar.org (one character)
+		{"x@fooba.org", "", []string{SignalLookalike}, "fooba.org is fooba.net with other TLD"},
+		{"Pawel Grzesik <x@xn--fbar-55da.org>", "", []string{SignalDisplayName, SignalPunycode}, "fооbar.org looks like foobar.org"},
+	}
+	for _, c := range cases {
+		header := mail.Header{"From": {c.from}}
+		if c.replyTo != "" {
+			header["Reply-To"] = []string{c.replyTo}
+		}
+		var got []string
+		reason := ""
+		for _, s := range Check(domains, names, "", header) {
+			got = append(got, s.Name)
+			if s.Name != SignalDisplayName {
+				reason = s.Reason
+			}
+		}
+		if strings.Join(got, ", ") != strings.Join(c.want, ", ") {
+			t.Errorf("%s: %v, want %v", c.from, got, c.want)
+		}
+		if c.reason != "" && reason != c.reason {
+			t.Errorf("%s: reason %q, want %q", c.from, reason, c.reason)
+		}
+	}
+}
@@ -0,0 +1,233 @@
+/*
+  Package store has the data model and the quarantine spool
+  shared by the filter and the API, so both of them are using
+  the same fields and the same files.
+*/
+package store
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+)
+
+/*
+  Status of the blocked e-mail
+*/
+type Status string
+
+const (
+	StatusHeld      Status = "held"
+	StatusReleased  Status = "released"
+	StatusDiscarded Status = "discarded"
+	StatusExpired   Status = "expired"
+	StatusBounced   Status = "bounced"
+)
+
+/*
+  All statuses, in the order we are showing them
+*/
+var Statuses = []Status{StatusHeld, StatusReleased, StatusDiscarded, StatusExpired, StatusBounced}
+
+/*
+  Check if status is one of the known ones
+*/
+func (s Status) Valid() bool {
+	for _, known := range Statuses {
+		if s == known {
+			return true
+		}
+	}
+	return false
+}
+
+/*
+  Attachment summary, we are not keeping the content
+  ContentType: declared by the sender
+  Type: real type from the magic bytes, e.g. "pdf" or "exe"
+  Encrypted: archive has encrypted files, they can't be inspected
+  Error: why it was not inspected, e.g. archive bomb
+  Files: files of the archive
+*/
+type Attachment struct {
+	Name        string       `json:"name"`
+	ContentType string       `json:"contenttype"`
+	Size        int          `json:"size"`
+	Type        string       `json:"type,omitempty"`
+	Encrypted   bool         `json:"encrypted,omitempty"`
+	Error       string       `json:"error,omitempty"`
+	Files       []Attachment `json:"files,omitempty"`
+}
+
+/*
+  Sensitive data found by DLP, snippets of card numbers
+  and secrets are masked
+  Detector: name of the detector from the policy
+  Count: how many times it was found
+  Parts: MIME parts where it was found, e.g. "1.2"
+  Snippets: text around the first matches, for reviewers
+*/
+type Finding struct {
+	Detector string   `json:"detector"`
+	Count    int      `json:"count"`
+	Parts    []string `json:"parts"`
+	Snippets []string `json:"snippets"`
+}
+
+/*
+  Signal of a suspicious e-mail, e.g. lookalike domain
+  Name: name of the signal, used in the rules
+  Score: how suspicious it is
+  Reason: why, for the reviewers
+*/
+type Signal struct {
+	Name   string `json:"name"`
+	Score  int    `json:"score"`
+	Reason string `json:"reason"`
+}
+
+/*
+  Score with the signals, for the header and the logs,
+  e.g. "70 (lookalike-domain=50, reply-to-external=20)"
+*/
+func ScoreSummary(score int, signals []Signal) string {
+	var list []string
+	for _, s := range signals {
+		list = append(list, fmt.Sprintf("%s=%d", s.Name, s.Score))
+	}
+	if len(list) == 0 {
+		return fmt.Sprint(score)
+	}
+	return fmt.Sprintf("%d (%s)", score, strings.Join(list, ", "))
+}
+
+/*
+  SPF, DKIM and DMARC results, see internal/auth
+  SPFDomain: domain of the envelope sender
+  ClientIP: from the first Received header
+  DKIMDomains: domains of the valid signatures
+  FromDomain: domain of the From header, checked by DMARC
+  DMARCPolicy: none, quarantine or reject
+*/
+type Auth struct {
+	SPF         string   `json:"spf"`
+	SPFDomain   string   `json:"spfdomain,omitempty"`
+	SPFReason   string   `json:"spfreason,omitempty"`
+	ClientIP    string   `json:"clientip,omitempty"`
+	DKIM        string   `json:"dkim"`
+	DKIMDomains []string `json:"dkimdomains,omitempty"`
+	DKIMReason  string   `json:"dkimreason,omitempty"`
+	DMARC       string   `json:"dmarc"`
+	DMARCPolicy string   `json:"dmarcpolicy,omitempty"`
+	FromDomain  string   `json:"fromdomain,omitempty"`
+}
+
+/*
+  Changes of the e-mail made by the rewrite rules, see internal/rewrite
+  Subject: prefixes of the subject, e.g. "[EXTERNAL]"
+  Banners: warnings on top of the text and HTML body
+  Footers: disclaimers at the end of it
+  BreakDKIM: e-mails with DKIM signatures are changed too
+*/
+type Rewrite struct {
+	Subject   []string `json:"subject,omitempty"`
+	Banners   []string `json:"banners,omitempty"`
+	Footers   []string `json:"footers,omitempty"`
+	BreakDKIM bool     `json:"breakdkim,omitempty"`
+}
+
+/*
+  Changes of the rewrite rules, for the logs,
+  e.g. `subject "[EXTERNAL]", 1 banner(s), 1 footer(s)`
+*/
+func RewriteSummary(r *Rewrite) string {
+	if r == nil {
+		return ""
+	}
+	var list []string
+	for _, s := range r.Subject {
+		list = append(list, fmt.Sprintf("subject %q", s))
+	}
+	if len(r.Banners) > 0 {
+		list = append(list, fmt.Sprintf("%d banner(s)", len(r.Banners)))
+	}
+	if len(r.Footers) > 0 {
+		list = append(list, fmt.Sprintf("%d footer(s)", len(r.Footers)))
+	}
+	return strings.Join(list, ", ")
+}
+
+/*
+  Mail structure
+  Id: assigned by the API
+  Queue: name of the file in the queue directory
+  Sender: envelope sender (from postfix)
+  SenderHeader: From header
+  Recipients: envelope recipients
+  Received: when filter got the e-mail
+  Decided: when filter blocked it
+  Released: when it has been released
+  Reviewed: when it got the final status (released, discarded,
+  bounced or expired), from the reviewer or the janitor
+  Rule, Reason: which rule blocked it and why
+  Findings: sensitive data found in the content
+  Auth: SPF, DKIM and DMARC results, when verification is enabled
+  Score, Signals: score of the e-mail and signals it's made of
+  Rewrite: changes made when the e-mail is delivered
+*/
+type Mail struct {
+	Id           int          `json:"id"`
+	Queue        string       `json:"queue"`
+	Sender       string       `json:"sender"`
+	SenderHeader string       `json:"senderheader"`
+	Recipients   []string     `json:"recipients"`
+	Subject      string       `json:"subject"`
+	MessageId    string       `json:"messageid"`
+	Size         int          `json:"size"`
+	Attachments  []Attachment `json:"attachments"`
+	Status       Status       `json:"status"`
+	Rule         string       `json:"rule"`
+	Reason       string       `json:"reason"`
+	Tags         []string     `json:"tags"`
+	Findings     []Finding    `json:"findings,omitempty"`
+	Auth         *Auth        `json:"auth,omitempty"`
+	Score        int          `json:"score,omitempty"`
+	Signals      []Signal     `json:"signals,omitempty"`
+	Rewrite      *Rewrite     `json:"rewrite,omitempty"`
+	Received     time.Time    `json:"received"`
+	Decided      time.Time    `json:"decided"`
+	Released     *time.Time   `json:"released,omitempty"`
+	Reviewed     *time.Time   `json:"reviewed,omitempty"`
+}
+
+/*
+  Recipients as one string, the way postfix logs them
+*/
+func (m Mail) Recipient() string {
+	return strings.Join(m.Recipients, " ")
+}
+
+/*
+  UnmarshalJSON is reading old records as well, they
+  had one "recipient" string and "blocked" bool.
+*/
+func (m *Mail) UnmarshalJSON(data []byte) error {
+	type mail Mail
+	var old struct {
+		mail
+		Recipient string `json:"recipient"`
+		Blocked   *bool  `json:"blocked"`
+	}
+	if err := json.Unmarshal(data, &old); err != nil {
+		return err
+	}
+	*m = Mail(old.mail)
+	if len(m.Recipients) == 0 && old.Recipient != "" {
+		m.Recipients = strings.Fields(old.Recipient)
+	}
+	if m.Status == "" && old.Blocked != nil && *old.Blocked {
+		m.Status = StatusHeld
+	}
+	return nil
+}
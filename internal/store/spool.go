@@ -0,0 +1,76 @@
+package store
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path"
+	"strings"
+)
+
+/*
+  PROXYDIR: main directory for the mailProxy tools
+  QUEUEDIR: quarantine spool with blocked e-mails
+  SIDECAR: extension of the metadata file written next
+  to the blocked e-mail, e.g. queue/ABC123 and queue/ABC123.json
+*/
+const PROXYDIR string = "/var/spool/mailProxy/"
+const QUEUEDIR string = PROXYDIR + "queue/"
+const SIDECAR string = ".json"
+
+/*
+  QUEUECHARS: characters used in the queue names, queue
+  name is used as a file name so nothing else is allowed
+*/
+const QUEUECHARS string = "123456789ABCDEFGHIJKLMNOPQRSTUVWXYZ"
+
+/*
+  Check if queue name is safe to use as a file name
+*/
+func ValidQueue(queue string) bool {
+	return queue != "" && strings.Trim(queue, QUEUECHARS) == ""
+}
+
+/*
+  Path of the raw e-mail in the queue
+*/
+func QueueFile(queue string) string {
+	return path.Join(QUEUEDIR, queue)
+}
+
+/*
+  Path of the sidecar metadata in the queue
+*/
+func SidecarFile(queue string) string {
+	return path.Join(QUEUEDIR, queue+SIDECAR)
+}
+
+/*
+  Write metadata next to the blocked e-mail. File is written
+  under temporary name first, so the API watcher never sees
+  half of it.
+*/
+func WriteSidecar(dir string, m Mail) error {
+	data, err := json.Marshal(m)
+	if err != nil {
+		return err
+	}
+	tmp := path.Join(dir, "."+m.Queue+".tmp")
+	if err := ioutil.WriteFile(tmp, data, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path.Join(dir, m.Queue+SIDECAR))
+}
+
+/*
+  Read metadata from the sidecar file
+*/
+func ReadSidecar(file string) (Mail, error) {
+	var m Mail
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		return m, err
+	}
+	err = json.Unmarshal(data, &m)
+	return m, err
+}
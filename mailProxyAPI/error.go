@@ -1,10 +0,0 @@
-package main
-
-/*
-  simple structure for errors
-*/
-
-type jsonErr struct {
-	Code int    `json:"code"`
-	Text string `json:"text"`
-}
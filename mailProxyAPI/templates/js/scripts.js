@@ -1 +0,0 @@
-// Empty JS for your own code to be here
\ No newline at end of file